@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lhartung/mealplanner/pkg/backend"
+	"gopkg.in/gorp.v2"
+)
+
+func openDatabase(config backend.Config) *gorp.DbMap {
+	dbmap, err := backend.OpenDatabase(config.Database.Driver, config.Database.Source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+
+	backend.MigrateDatabase(dbmap)
+	return dbmap
+}
+
+func exportFamily(config backend.Config, args []string) {
+	flags := flag.NewFlagSet("export-family", flag.ExitOnError)
+	familyId := flags.Int64("family", 0, "id of the family to export")
+	output := flags.String("o", "-", "file to write the archive to, or - for standard output")
+	flags.Parse(args)
+
+	if *familyId == 0 {
+		fmt.Fprintln(os.Stderr, "The -family flag is required.")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	dbmap := openDatabase(config)
+	defer dbmap.Db.Close()
+
+	archive, err := backend.ExportFamily(dbmap, *familyId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting family: %v\n", err)
+		os.Exit(1)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(archive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing archive: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func importFamily(config backend.Config, args []string) {
+	flags := flag.NewFlagSet("import-family", flag.ExitOnError)
+	familyId := flags.Int64("family", 0, "id of an existing family to restore into, instead of creating one")
+	owner := flags.String("owner", "", "email address of the new family's owner (default: the archive's owner)")
+	onConflict := flags.String("on-conflict", backend.ConflictSkip, "what to do with recipes, stores and pantry items the family already has: skip, replace or keep")
+	createClasses := flags.Bool("create-classes", true, "add ingredient classes that do not exist yet")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import-family [flags] archive.json\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	archive := &backend.FamilyArchive{}
+	err := json.NewDecoder(in).Decode(archive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading archive: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbmap := openDatabase(config)
+	defer dbmap.Db.Close()
+
+	// The classifier keeps its counts in the database, so it has to learn
+	// the restored ingredients here. A running server picks them up when it
+	// is restarted.
+	classifier, err := backend.LoadClassifier(dbmap, config.Classifier.Strategy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading classifier: %v\n", err)
+		os.Exit(1)
+	}
+
+	options := backend.ArchiveOptions{
+		FamilyId:      *familyId,
+		OwnerEmail:    *owner,
+		OnConflict:    *onConflict,
+		CreateClasses: *createClasses,
+	}
+
+	report, err := backend.RestoreFamily(dbmap, classifier, archive, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring family: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restored into family %d:\n", report.FamilyId)
+	fmt.Printf("  %d recipes, %d ingredients, %d planned meals\n",
+		report.Recipes, report.Ingredients, report.Assignments)
+	fmt.Printf("  %d stores, %d pantry items, %d new classes\n",
+		report.Stores, report.PantryItems, report.Classes)
+	fmt.Printf("  %d skipped and %d replaced because the family already had them\n",
+		report.Skipped, report.Replaced)
+
+	if len(report.MissingClasses) > 0 {
+		fmt.Printf("Classes that do not exist: %s\n", strings.Join(report.MissingClasses, ", "))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lhartung/mealplanner/pkg/backend"
+)
+
+func evaluateClassifier(config backend.Config, args []string) {
+	flags := flag.NewFlagSet("evaluate-classifier", flag.ExitOnError)
+	folds := flags.Int("folds", 10, "number of cross-validation folds")
+	seed := flags.Int64("seed", 1, "seed for shuffling the ingredients into folds")
+	strategies := flags.String("classifier", config.Classifier.Strategy, "classifier strategies to evaluate, separated by commas")
+	flags.IntVar(&backend.SplitThreshold, "split-threshold", backend.SplitThreshold, "split words at least this long in half")
+	flags.Float64Var(&backend.RegularizationTerm, "regularization", backend.RegularizationTerm, "count added to every feature under every class")
+	flags.Float64Var(&backend.CertaintyThreshold, "certainty-threshold", backend.CertaintyThreshold, "margin the best class needs over the runner-up (bayes)")
+	flags.Float64Var(&backend.CentroidThreshold, "centroid-threshold", backend.CentroidThreshold, "margin the best class needs over the runner-up (centroid)")
+	flags.Float64Var(&backend.DictionaryThreshold, "dictionary-threshold", backend.DictionaryThreshold, "margin the best class needs over the runner-up (dictionary)")
+	flags.Float64Var(&backend.DictionaryMinSimilarity, "min-similarity", backend.DictionaryMinSimilarity, "least similarity of names matched by the dictionary")
+	flags.Parse(args)
+
+	dbmap := openDatabase(config)
+	defer dbmap.Db.Close()
+
+	for i, strategy := range strings.Split(*strategies, ",") {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		evaluation, err := backend.EvaluateClassifier(dbmap, strings.TrimSpace(strategy), *folds, *seed)
+		if err == nil {
+			err = evaluation.WriteReport(os.Stdout)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error evaluating classifier: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
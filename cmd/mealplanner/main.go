@@ -1,9 +1,44 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/lhartung/mealplanner/pkg/backend"
 )
 
 func main() {
-	backend.Run()
+	configPath := flag.String("config", os.Getenv("MEALPLANNER_CONFIG"), "path to a JSON configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [command]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Without a command, the server is started. Commands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  evaluate-classifier  cross-validate the ingredient classifier")
+		fmt.Fprintln(flag.CommandLine.Output(), "  export-family        write a family's data to a JSON archive")
+		fmt.Fprintln(flag.CommandLine.Output(), "  import-family        restore a family from a JSON archive")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	config, err := backend.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		backend.Run(config)
+	case "evaluate-classifier":
+		evaluateClassifier(config, flag.Args()[1:])
+	case "export-family":
+		exportFamily(config, flag.Args()[1:])
+	case "import-family":
+		importFamily(config, flag.Args()[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
 }
@@ -3,23 +3,19 @@ module github.com/lhartung/mealplanner
 go 1.12
 
 require (
-	github.com/auth0/go-jwt-middleware v0.0.0-20190805220309-36081240882b
 	github.com/aws/aws-sdk-go v1.23.4
 	github.com/boj/redistore v0.0.0-20180917114910-cd5dcc76aeff // indirect
 	github.com/codegangsta/inject v0.0.0-20150114235600-33e0aa1cb7c0 // indirect
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-martini/martini v0.0.0-20170121215854-22fa46961aab
-	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/sessions v1.2.0 // indirect
+	github.com/lib/pq v1.10.9
 	github.com/martini-contrib/render v0.0.0-20150707142108-ec18f8345a11
 	github.com/martini-contrib/sessions v0.0.0-20140630231722-fa13114fbcf0
 	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
-	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
-	gopkg.in/dgrijalva/jwt-go.v3 v3.2.0
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
 	gopkg.in/flosch/pongo2.v3 v3.0.0-20141028000813-5e81b817a0c4
-	gopkg.in/go-martini/martini.v1 v1.0.0-20140519164645-49411a5b6468
-	gopkg.in/gorp.v1 v1.7.2
 	gopkg.in/gorp.v2 v2.0.0
 	gopkg.in/guregu/null.v3 v3.4.0
 )
@@ -35,28 +35,21 @@ func GetToken(session sessions.Session, db *gorp.DbMap, params martini.Params, r
 		return
 	}
 
-	memberships := []FamilyMember{}
-	_, err = db.Select(&memberships, "SELECT * FROM familymembers WHERE familymembers.user_id=? ORDER BY familymembers.family_id", user.Id)
+	families, err := selectFamilyIds(db, user.Id)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusBadRequest, nil)
 		return
 	}
 
-	families := make([]int64, 0)
-	for _, membership := range memberships {
-		families = append(families, membership.FamilyId)
-	}
-
-	session.Set("Admin", user.Admin.Bool)
-	session.Set("Families", families)
-	session.Set("FamilyId", user.DefaultFamilyId)
-	session.Set("UserId", user.Id)
+	startSession(session, &user, families)
 
 	//response.Token = tokenString
 	response.UserId = user.Id
 	response.Families = families
 
+	acceptLoginInvitation(db, session, &user, req.FormValue("invitation"), &response)
+
 	ren.JSON(http.StatusOK, &response)
 }
 
@@ -65,7 +58,28 @@ func ClearToken(session sessions.Session, db *gorp.DbMap, params martini.Params,
 	res.WriteHeader(http.StatusNoContent)
 }
 
-func CreateAccount(session sessions.Session, db *gorp.DbMap, params martini.Params, req *http.Request, ren render.Render) {
+// ClearAllSessions signs the user out on every device, including this one.
+// API tokens are not affected; they are revoked individually.
+func ClearAllSessions(session sessions.Session, db *gorp.DbMap, params martini.Params, req *http.Request, res http.ResponseWriter) {
+	userId, ok := checkCookieSession(session)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	_, err := db.Exec("UPDATE users SET sessions_valid_after=? WHERE id=?",
+		time.Now().UnixNano(), userId)
+	if err != nil {
+		logError(err)
+		http.Error(res, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	session.Clear()
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func CreateAccount(session sessions.Session, db *gorp.DbMap, config *Config, mailer Mailer, params martini.Params, req *http.Request, ren render.Render) {
 	response := AuthResponse{}
 
 	username := req.FormValue("username")
@@ -96,16 +110,7 @@ func CreateAccount(session sessions.Session, db *gorp.DbMap, params martini.Para
 		return
 	}
 
-	today := time.Now()
-	family := Family{
-		UserId:          user.Id,
-		Name:            user.Name,
-		CreatedOn:       today.Format(dateFormat),
-		AccountStatus:   "trial",
-		StatusExpiresOn: today.AddDate(0, 0, 30).Format(dateFormat),
-	}
-
-	err = db.Insert(&family)
+	family, err := createFamily(db, user.Id, user.Name)
 	if err != nil {
 		logError(err)
 		response.Message = "Server error - please try again later."
@@ -113,13 +118,9 @@ func CreateAccount(session sessions.Session, db *gorp.DbMap, params martini.Para
 		return
 	}
 
-	member := FamilyMember{
-		FamilyId: family.Id,
-		UserId:   user.Id,
-		CanEdit:  true,
-	}
+	user.DefaultFamilyId = family.Id
 
-	err = db.Insert(&member)
+	_, err = db.Update(&user)
 	if err != nil {
 		logError(err)
 		response.Message = "Server error - please try again later."
@@ -127,14 +128,12 @@ func CreateAccount(session sessions.Session, db *gorp.DbMap, params martini.Para
 		return
 	}
 
-	user.DefaultFamilyId = family.Id
-
-	_, err = db.Update(&user)
+	// The account is usable without a verified address, so a failure to
+	// send the email is not fatal. The user can request another from the
+	// profile page.
+	err = sendEmailVerification(db, config, mailer, &user)
 	if err != nil {
 		logError(err)
-		response.Message = "Server error - please try again later."
-		ren.JSON(http.StatusInternalServerError, &response)
-		return
 	}
 
 	families := []int64{family.Id}
@@ -143,10 +142,9 @@ func CreateAccount(session sessions.Session, db *gorp.DbMap, params martini.Para
 	response.UserId = user.Id
 	response.Families = families
 
-	session.Set("Admin", user.Admin.Bool)
-	session.Set("Families", families)
-	session.Set("FamilyId", user.DefaultFamilyId)
-	session.Set("UserId", user.Id)
+	startSession(session, &user, families)
+
+	acceptLoginInvitation(db, session, &user, req.FormValue("invitation"), &response)
 
 	ren.JSON(http.StatusOK, &response)
 }
@@ -0,0 +1,287 @@
+package backend
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// unitScale places a unit in a family of convertible units, as a multiple of
+// the family's smallest unit. Metric and US units are kept apart, so that
+// totals stay in the units the recipes were written in.
+type unitScale struct {
+	family string
+	factor float64
+}
+
+var unitScales = map[string]unitScale{
+	"mg": {"metric mass", 0.001},
+	"g":  {"metric mass", 1},
+	"kg": {"metric mass", 1000},
+
+	"oz": {"us mass", 1},
+	"lb": {"us mass", 16},
+
+	"ml": {"metric volume", 1},
+	"cl": {"metric volume", 10},
+	"dl": {"metric volume", 100},
+	"l":  {"metric volume", 1000},
+
+	"tsp":   {"us volume", 1},
+	"tbsp":  {"us volume", 3},
+	"fl oz": {"us volume", 6},
+	"cup":   {"us volume", 48},
+	"pt":    {"us volume", 96},
+	"qt":    {"us volume", 192},
+	"gal":   {"us volume", 768},
+}
+
+// Units that are words rather than abbreviations, with their plurals.
+var unitPlurals = map[string]string{
+	"cup": "cups", "pinch": "pinches", "dash": "dashes", "clove": "cloves",
+	"can": "cans", "package": "packages", "slice": "slices", "piece": "pieces",
+	"bunch": "bunches", "stick": "sticks", "sprig": "sprigs", "head": "heads",
+	"handful": "handfuls",
+}
+
+// AggregatedAmount is one part of a merged ingredient's total. Amounts in
+// units that cannot be converted into each other are separate parts, and
+// amounts that could not be parsed are kept as text.
+type AggregatedAmount struct {
+	Quantity    null.Float  `json:"quantity"`
+	QuantityMax null.Float  `json:"quantity_max"`
+	Unit        null.String `json:"unit"`
+	Amount      string      `json:"amount"`
+
+	scale unitScale
+}
+
+// AggregatedIngredient merges the ingredients with the same name on the
+// shopping list. The sources are the assigned ingredients it was made from.
+type AggregatedIngredient struct {
+	Name    string                   `json:"name"`
+	ClassId null.Int                 `json:"class_id"`
+	Class   null.String              `json:"class"`
+	Have    bool                     `json:"have"`
+	Amount  string                   `json:"amount"`
+	Amounts []*AggregatedAmount      `json:"amounts"`
+	Sources []AssignedIngredientView `json:"sources"`
+	Pantry  string                   `json:"pantry"`
+
+	// Class within the section when the shopping list groups by parent class.
+	Subclass string `json:"-"`
+}
+
+// IngredientIds lists the ids of the merged ingredients, separated by commas.
+func (item *AggregatedIngredient) IngredientIds() string {
+	ids := make([]string, len(item.Sources))
+	for i, source := range item.Sources {
+		ids[i] = strconv.FormatInt(source.IngredientId, 10)
+	}
+	return strings.Join(ids, ",")
+}
+
+// singular turns a plural English word into its singular, so that "onions"
+// and "onion" are merged.
+func singular(word string) string {
+	if len(word) <= 3 || !AsciiPattern.MatchString(word) {
+		return word
+	}
+
+	switch {
+	case strings.HasSuffix(word, "ies"):
+		return word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "oes"), strings.HasSuffix(word, "ches"),
+		strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "xes"):
+		return word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"),
+		strings.HasSuffix(word, "is"):
+		return word
+	case strings.HasSuffix(word, "s"):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+// aggregationKey normalizes the name and its last word's plural.
+func aggregationKey(name string) string {
+	words := strings.Split(normalizeName(name), " ")
+	words[len(words)-1] = singular(words[len(words)-1])
+	return strings.Join(words, " ")
+}
+
+// add adds the quantity of an assigned ingredient to the matching part, or
+// starts a new one.
+func (item *AggregatedIngredient) add(source AssignedIngredientView) {
+	if !source.Quantity.Valid {
+		text := strings.TrimSpace(source.Amount.String)
+		if text == "" {
+			return
+		}
+
+		for _, part := range item.Amounts {
+			if !part.Quantity.Valid && part.Amount == text {
+				return
+			}
+		}
+
+		item.Amounts = append(item.Amounts, &AggregatedAmount{Amount: text})
+		return
+	}
+
+	low := source.Quantity.Float64
+	high := low
+	if source.QuantityMax.Valid {
+		high = source.QuantityMax.Float64
+	}
+
+	unit := source.Unit.String
+	scale, convertible := unitScales[unit]
+	if !convertible {
+		scale = unitScale{family: "unit " + unit, factor: 1}
+	}
+
+	for _, part := range item.Amounts {
+		if !part.Quantity.Valid || part.scale.family != scale.family {
+			continue
+		}
+
+		// The total is given in the largest unit of the parts.
+		if scale.factor > part.scale.factor {
+			ratio := part.scale.factor / scale.factor
+			part.Quantity.Float64 *= ratio
+			part.QuantityMax.Float64 *= ratio
+			part.scale = scale
+			part.Unit = source.Unit
+		}
+
+		ratio := scale.factor / part.scale.factor
+		part.Quantity.Float64 += low * ratio
+		part.QuantityMax.Float64 += high * ratio
+		if high != low {
+			part.QuantityMax.Valid = true
+		}
+		return
+	}
+
+	item.Amounts = append(item.Amounts, &AggregatedAmount{
+		Quantity:    null.FloatFrom(low),
+		QuantityMax: null.NewFloat(high, high != low),
+		Unit:        source.Unit,
+		scale:       scale,
+	})
+}
+
+// formatQuantity writes numbers with up to two decimals, or with common
+// fractions like 1 1/2 if fractions is set.
+func formatQuantity(value float64, fractions bool) string {
+	whole := math.Floor(value)
+	fraction := value - whole
+
+	if fractions {
+		for _, den := range []float64{2, 3, 4, 8} {
+			num := math.Round(fraction * den)
+			if num > 0 && num < den && math.Abs(fraction-num/den) < 0.01 {
+				text := strconv.FormatFloat(num, 'f', 0, 64) + "/" + strconv.FormatFloat(den, 'f', 0, 64)
+				if whole > 0 {
+					text = strconv.FormatFloat(whole, 'f', 0, 64) + " " + text
+				}
+				return text
+			}
+		}
+	}
+
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
+
+// formatAmount writes a parsed amount, with fractions for all but metric
+// units.
+func formatAmount(quantity null.Float, max null.Float, unit null.String) string {
+	fractions := !strings.HasPrefix(unitScales[unit.String].family, "metric")
+
+	text := formatQuantity(quantity.Float64, fractions)
+	if max.Valid {
+		text += "-" + formatQuantity(max.Float64, fractions)
+	}
+
+	if unit.Valid {
+		name := unit.String
+		if plural, ok := unitPlurals[name]; ok && (quantity.Float64 > 1 || max.Valid) {
+			name = plural
+		}
+		text += " " + name
+	}
+
+	return text
+}
+
+func (part *AggregatedAmount) String() string {
+	if !part.Quantity.Valid {
+		return part.Amount
+	}
+	return formatAmount(part.Quantity, part.QuantityMax, part.Unit)
+}
+
+// aggregateIngredients merges the assigned ingredients by name, in the order
+// in which the names first appear. The first name seen and the first class
+// are kept. A merged ingredient counts as had if all of its sources are, and
+// otherwise only the sources that are not had are added up.
+func aggregateIngredients(items []AssignedIngredientView) []*AggregatedIngredient {
+	aggregated := []*AggregatedIngredient{}
+	byKey := make(map[string]*AggregatedIngredient)
+
+	for _, source := range items {
+		key := aggregationKey(source.Name)
+
+		item, ok := byKey[key]
+		if !ok {
+			item = &AggregatedIngredient{
+				Name:    source.Name,
+				Have:    true,
+				Amounts: []*AggregatedAmount{},
+				Sources: []AssignedIngredientView{},
+			}
+			byKey[key] = item
+			aggregated = append(aggregated, item)
+		}
+
+		if !item.ClassId.Valid && source.ClassId.Valid {
+			item.ClassId = source.ClassId
+			item.Class = source.Class
+		}
+
+		item.Have = item.Have && source.Have.Bool
+		item.Sources = append(item.Sources, source)
+	}
+
+	// The total is what is left to buy, or everything if nothing is.
+	for _, item := range aggregated {
+		always := true
+		for _, source := range item.Sources {
+			if item.Have || !source.Have.Bool {
+				item.add(source)
+			}
+
+			always = always && source.Pantry == PantryAlways
+			if source.Pantry != "" {
+				item.Pantry = PantryPartial
+			}
+		}
+
+		if always {
+			item.Pantry = PantryAlways
+		} else if item.Have {
+			item.Pantry = PantryCovered
+		}
+
+		parts := make([]string, len(item.Amounts))
+		for i, part := range item.Amounts {
+			parts[i] = part.String()
+		}
+		item.Amount = strings.Join(parts, " + ")
+	}
+
+	return aggregated
+}
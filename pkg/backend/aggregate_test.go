@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"testing"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestSingular(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"onions", "onion"},
+		{"onion", "onion"},
+		{"berries", "berry"},
+		{"tomatoes", "tomato"},
+		{"peaches", "peach"},
+		{"radishes", "radish"},
+		{"boxes", "box"},
+		{"cress", "cress"},
+		{"asparagus", "asparagus"},
+		{"peas", "pea"},
+		{"gas", "gas"},
+		{"jalapeños", "jalapeños"},
+	}
+
+	for _, test := range tests {
+		if got := singular(test.word); got != test.want {
+			t.Errorf("singular(%q) = %q, want %q", test.word, got, test.want)
+		}
+	}
+}
+
+// assigned returns an assigned ingredient with the amount parsed as it would
+// be when stored.
+func assigned(name string, amount string, have bool) AssignedIngredientView {
+	quantity := ParseQuantity(amount)
+	return AssignedIngredientView{
+		Name:        name,
+		Amount:      null.NewString(amount, amount != ""),
+		Have:        null.BoolFrom(have),
+		Quantity:    quantity.Value,
+		QuantityMax: quantity.Max,
+		Unit:        quantity.Unit,
+	}
+}
+
+func TestAggregateIngredients(t *testing.T) {
+	type result struct {
+		name   string
+		amount string
+		have   bool
+	}
+
+	tests := []struct {
+		about string
+		items []AssignedIngredientView
+		want  []result
+	}{
+		{
+			"plurals are merged under the first name",
+			[]AssignedIngredientView{assigned("Onion", "1", false), assigned("onions", "2", false)},
+			[]result{{"Onion", "3", false}},
+		},
+		{
+			"metric units add up in the largest unit",
+			[]AssignedIngredientView{assigned("flour", "500 g", false), assigned("flour", "1 kg", false)},
+			[]result{{"flour", "1.5 kg", false}},
+		},
+		{
+			"US volumes add up with fractions",
+			[]AssignedIngredientView{assigned("milk", "2 tbsp", false), assigned("milk", "1/2 cup", false)},
+			[]result{{"milk", "5/8 cup", false}},
+		},
+		{
+			"metric and US units are kept apart",
+			[]AssignedIngredientView{assigned("butter", "100 g", false), assigned("butter", "2 oz", false)},
+			[]result{{"butter", "100 g + 2 oz", false}},
+		},
+		{
+			"ranges add up both ends",
+			[]AssignedIngredientView{assigned("garlic", "2-3 cloves", false), assigned("garlic", "1 clove", false)},
+			[]result{{"garlic", "3-4 cloves", false}},
+		},
+		{
+			"unparsed amounts are listed once",
+			[]AssignedIngredientView{
+				assigned("salt", "to taste", false),
+				assigned("salt", "to taste", false),
+				assigned("salt", "1 tsp", false),
+			},
+			[]result{{"salt", "to taste + 1 tsp", false}},
+		},
+		{
+			"only what is left to buy is added up",
+			[]AssignedIngredientView{assigned("rice", "200 g", true), assigned("rice", "300 g", false)},
+			[]result{{"rice", "300 g", false}},
+		},
+		{
+			"everything is added up when all is had",
+			[]AssignedIngredientView{assigned("rice", "200 g", true), assigned("rice", "300 g", true)},
+			[]result{{"rice", "500 g", true}},
+		},
+		{
+			"names keep the order they first appear in",
+			[]AssignedIngredientView{
+				assigned("eggs", "2", false),
+				assigned("sugar", "1 cup", false),
+				assigned("egg", "1", false),
+			},
+			[]result{{"eggs", "3", false}, {"sugar", "1 cup", false}},
+		},
+	}
+
+	for _, test := range tests {
+		aggregated := aggregateIngredients(test.items)
+		if len(aggregated) != len(test.want) {
+			t.Errorf("%s: got %d ingredients, want %d", test.about, len(aggregated), len(test.want))
+			continue
+		}
+
+		for i, item := range aggregated {
+			got := result{item.Name, item.Amount, item.Have}
+			if got != test.want[i] {
+				t.Errorf("%s: got %+v, want %+v", test.about, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		quantity null.Float
+		max      null.Float
+		unit     null.String
+		want     string
+	}{
+		{null.FloatFrom(1.5), null.Float{}, null.StringFrom("cup"), "1 1/2 cups"},
+		{null.FloatFrom(1), null.Float{}, null.StringFrom("cup"), "1 cup"},
+		{null.FloatFrom(0.25), null.Float{}, null.StringFrom("tsp"), "1/4 tsp"},
+		{null.FloatFrom(1.25), null.Float{}, null.StringFrom("l"), "1.25 l"},
+		{null.FloatFrom(0.333), null.Float{}, null.StringFrom("kg"), "0.33 kg"},
+		{null.FloatFrom(2), null.FloatFrom(3), null.StringFrom("clove"), "2-3 cloves"},
+		{null.FloatFrom(3), null.Float{}, null.String{}, "3"},
+	}
+
+	for _, test := range tests {
+		if got := formatAmount(test.quantity, test.max, test.unit); got != test.want {
+			t.Errorf("formatAmount(%v, %v, %v) = %q, want %q",
+				test.quantity, test.max, test.unit, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+)
+
+// Personal API token scopes.
+const (
+	TokenScopeRead  = "read"
+	TokenScopeWrite = "write"
+)
+
+// Prefix for generated tokens, which makes them easy to recognize, e.g. in
+// secret scanners.
+const tokenPrefix = "mp_"
+
+type createTokenResponse struct {
+	ApiToken
+
+	// The token itself is only returned once, when it is created.
+	Token string `json:"token"`
+}
+
+// tokenSession stands in for the cookie session on requests authenticated
+// with a bearer token, so that the handlers and checkFamilyParam work the
+// same way for both.
+type tokenSession struct {
+	values map[interface{}]interface{}
+}
+
+func (s *tokenSession) Get(key interface{}) interface{} {
+	return s.values[key]
+}
+
+func (s *tokenSession) Set(key interface{}, val interface{}) {
+	s.values[key] = val
+}
+
+func (s *tokenSession) Delete(key interface{}) {
+	delete(s.values, key)
+}
+
+func (s *tokenSession) Clear() {
+	s.values = make(map[interface{}]interface{})
+}
+
+func (s *tokenSession) AddFlash(value interface{}, vars ...string) {
+}
+
+func (s *tokenSession) Flashes(vars ...string) []interface{} {
+	return nil
+}
+
+func (s *tokenSession) Options(options sessions.Options) {
+}
+
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// authenticateToken is middleware for the API routes. If the request carries
+// a bearer token, it replaces the cookie session with one derived from the
+// token. Requests without a token fall through to the cookie session.
+func authenticateToken(c martini.Context, db *gorp.DbMap, req *http.Request, res http.ResponseWriter) {
+	token := bearerToken(req)
+	if token == "" {
+		return
+	}
+
+	apiToken := ApiToken{}
+	err := db.SelectOne(&apiToken,
+		"SELECT * FROM apitokens WHERE token_hash=? AND revoked_on=0",
+		hashToken(token))
+	if err != nil {
+		logError(err)
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := db.Get(User{}, apiToken.UserId)
+	if err != nil || result == nil {
+		logError(err)
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user := result.(*User)
+
+	if apiToken.Scope != TokenScopeWrite && req.Method != "GET" {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Membership is checked on every request, so a token stops working for a
+	// family as soon as the user leaves it.
+	families, err := selectFamilyIds(db, user.Id)
+	if err != nil {
+		logError(err)
+		http.Error(res, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if apiToken.FamilyId.Valid {
+		scoped := make([]int64, 0)
+		for _, id := range families {
+			if id == apiToken.FamilyId.Int64 {
+				scoped = append(scoped, id)
+			}
+		}
+		families = scoped
+	}
+
+	session := &tokenSession{}
+	session.Clear()
+
+	// Tokens never carry admin rights.
+	session.Set("Admin", false)
+	session.Set("Families", families)
+	session.Set("FamilyId", user.DefaultFamilyId)
+	session.Set("UserId", user.Id)
+	session.Set("LoginTime", apiToken.CreatedOn)
+	session.Set("ApiTokenId", apiToken.Id)
+	session.Set("TokenScope", apiToken.Scope)
+
+	c.MapTo(session, (*sessions.Session)(nil))
+
+	_, err = db.Exec("UPDATE apitokens SET last_used_on=? WHERE id=?",
+		time.Now().Unix(), apiToken.Id)
+	if err != nil {
+		logError(err)
+	}
+}
+
+// checkCookieSession rejects requests made with an API token. Tokens cannot be
+// used to manage tokens, change the account or create families.
+func checkCookieSession(session sessions.Session) (int64, bool) {
+	if session.Get("ApiTokenId") != nil {
+		return 0, false
+	}
+
+	userId, ok := session.Get("UserId").(int64)
+	return userId, ok
+}
+
+func ListTokens(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	userId, ok := checkCookieSession(session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	tokens := []ApiToken{}
+	_, err := db.Select(&tokens,
+		"SELECT * FROM apitokens WHERE user_id=? AND revoked_on=0 ORDER BY id",
+		userId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, tokens)
+}
+
+func CreateToken(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	userId, ok := checkCookieSession(session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	apiToken := ApiToken{
+		Scope: TokenScopeRead,
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&apiToken)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	if apiToken.Name == "" || (apiToken.Scope != TokenScopeRead && apiToken.Scope != TokenScopeWrite) {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// A token can only be limited to a family the user belongs to.
+	if apiToken.FamilyId.Valid {
+		count, err := db.SelectInt(
+			"SELECT COUNT(*) FROM familymembers WHERE user_id=? AND family_id=?",
+			userId, apiToken.FamilyId.Int64)
+		if err != nil || count == 0 {
+			ren.JSON(http.StatusBadRequest, nil)
+			return
+		}
+	}
+
+	token := tokenPrefix + newToken()
+
+	// No messing around with protected fields.
+	apiToken.Id = 0
+	apiToken.UserId = userId
+	apiToken.TokenHash = hashToken(token)
+	apiToken.Prefix = token[:len(tokenPrefix)+4]
+	apiToken.CreatedOn = time.Now().Unix()
+	apiToken.LastUsedOn = 0
+	apiToken.RevokedOn = 0
+
+	err = db.Insert(&apiToken)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, createTokenResponse{
+		ApiToken: apiToken,
+		Token:    token,
+	})
+}
+
+func getOwnToken(db *gorp.DbMap, params martini.Params, userId int64) (*ApiToken, int) {
+	id, err := strconv.ParseInt(params["id"], 0, 64)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusBadRequest
+	}
+
+	result, err := db.Get(ApiToken{}, id)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusNotFound
+	} else if result == nil {
+		return nil, http.StatusNotFound
+	}
+
+	apiToken, ok := result.(*ApiToken)
+	if !ok {
+		return nil, http.StatusInternalServerError
+	}
+
+	if apiToken.UserId != userId || apiToken.RevokedOn != 0 {
+		return nil, http.StatusNotFound
+	}
+
+	return apiToken, http.StatusOK
+}
+
+// UpdateToken renames a token. The secret, scope and family cannot be changed;
+// create a new token instead.
+func UpdateToken(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	userId, ok := checkCookieSession(session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	apiToken, status := getOwnToken(db, params, userId)
+	if apiToken == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	request := ApiToken{}
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&request)
+	if err != nil || request.Name == "" {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	apiToken.Name = request.Name
+
+	_, err = db.Update(apiToken)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, apiToken)
+}
+
+func RevokeToken(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	userId, ok := checkCookieSession(session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	apiToken, status := getOwnToken(db, params, userId)
+	if apiToken == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	apiToken.RevokedOn = time.Now().Unix()
+
+	_, err := db.Update(apiToken)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, apiToken)
+}
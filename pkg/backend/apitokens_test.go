@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"gopkg.in/gorp.v2"
+)
+
+// tokenServer serves a few API routes behind the token middleware, the way
+// Run sets them up.
+func tokenServer(db *gorp.DbMap, mailer Mailer) http.Handler {
+	r := martini.NewRouter()
+	r.Get("/api/families", ListFamilies)
+	r.Post("/api/families", CreateFamily)
+	r.Post("/api/families/import", ImportFamilyArchive)
+	r.Put("/api/users/:id", UpdateUser)
+	r.Put("/api/users/:id/password", UpdateUserPassword)
+	r.Post("/api/users/:id/verification", SendEmailVerification)
+
+	m := martini.New()
+	m.Use(render.Renderer())
+	m.Use(authenticateToken)
+	m.Map(db)
+	m.Map(&Config{})
+	m.MapTo(mailer, (*Mailer)(nil))
+	m.MapTo(r, (*martini.Routes)(nil))
+	m.Action(r.Handle)
+	return m
+}
+
+func TestTokenCannotChangeAccount(t *testing.T) {
+	db, cleanup := openMigratedDatabase(t)
+	defer cleanup()
+
+	user := &User{Email: "cook@example.com", Name: "Cook"}
+	insertAll(t, db, user)
+	_, err := createFamily(db, user.Id, "Home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertAll(t, db, &ApiToken{UserId: user.Id, Name: "script", TokenHash: hashToken("mp_secret"),
+		Prefix: "mp_sec", Scope: TokenScopeWrite, CreatedOn: time.Now().Unix()})
+
+	// Nothing should be sent, but a mistake should not litter the package.
+	dir, err := ioutil.TempDir("", "mealplanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := tokenServer(db, &fileMailer{directory: dir})
+	request := func(method string, path string, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer mp_secret")
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// The token itself works.
+	if code := request("GET", "/api/families", ""); code != http.StatusOK {
+		t.Fatalf("listing families with the token gave %d, want %d", code, http.StatusOK)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PUT", "/api/users/1", `{"email": "attacker@example.com", "name": "Cook"}`},
+		{"PUT", "/api/users/1/password", `{"new_password": "hunter22hunter22"}`},
+		{"POST", "/api/users/1/verification", ""},
+		{"POST", "/api/families", `{"name": "Other"}`},
+		{"POST", "/api/families/import", `{}`},
+	}
+
+	for _, test := range tests {
+		if code := request(test.method, test.path, test.body); code != http.StatusUnauthorized {
+			t.Errorf("%s %s with a token gave %d, want %d", test.method, test.path, code,
+				http.StatusUnauthorized)
+		}
+	}
+
+	if count, _ := db.SelectInt("SELECT COUNT(*) FROM families"); count != 1 {
+		t.Errorf("the token created families, there are %d", count)
+	}
+	if email, _ := db.SelectStr("SELECT email FROM users WHERE id=?", user.Id); email != user.Email {
+		t.Errorf("the token changed the email to %q", email)
+	}
+}
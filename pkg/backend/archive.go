@@ -0,0 +1,933 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// A family archive holds all of a family's data as JSON, to move it to
+// another server or keep as a backup. The ids in it are the ones on the
+// server it came from, and only link its parts to each other; everything
+// gets new ids when it is restored. Ingredient classes are matched by name,
+// since they are not the family's own. The members are only listed: restoring
+// makes nobody but the owner a member, and the others have to be invited.
+//
+// The version goes up whenever the format changes, and older versions can
+// still be restored. Version 2 added the recipe steps, times, yield and notes,
+// and version 3 the recipe tags.
+const (
+	FamilyArchiveFormat  = "mealplanner-family"
+	FamilyArchiveVersion = 3
+)
+
+// The largest archive that is restored through the API.
+const maxArchiveSize = 32 << 20
+
+// How a restore handles recipes, stores and pantry items with the same name
+// as ones the family already has.
+const (
+	ConflictSkip    = "skip"    // Keep what the family has
+	ConflictReplace = "replace" // Overwrite it with the archive
+	ConflictKeep    = "keep"    // Keep both
+)
+
+type ArchivedFamily struct {
+	Id                int64    `json:"id"`
+	Name              string   `json:"name"`
+	PrivateClassifier bool     `json:"private_classifier"`
+	DefaultServings   null.Int `json:"default_servings"`
+}
+
+type ArchivedMember struct {
+	Email string `db:"email" json:"email"`
+	Name  string `db:"name" json:"name"`
+	Role  string `db:"role" json:"role"`
+}
+
+type FamilyArchive struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	ExportedOn int64  `json:"exported_on"`
+
+	Family      ArchivedFamily    `json:"family"`
+	Members     []ArchivedMember  `json:"members"`
+	Classes     []IngredientClass `json:"classes"`
+	Recipes     []RecipeView      `json:"recipes"`
+	Ingredients []Ingredient      `json:"ingredients"`
+	Assignments []Assignment      `json:"assignments"`
+	Stores      []StoreView       `json:"stores"`
+	Pantry      []PantryItem      `json:"pantry"`
+}
+
+// ArchiveOptions tells where and how an archive is restored.
+type ArchiveOptions struct {
+	// The family to restore into. Without it, a new family is created for
+	// the owner, given by id or email address, or else the archive's owner.
+	FamilyId   int64
+	OwnerId    int64
+	OwnerEmail string
+
+	OnConflict string
+
+	// Classes are shared by all families, so only administrators may add
+	// the ones that are missing. Otherwise their ingredients are left
+	// without a class.
+	CreateClasses bool
+}
+
+// ArchiveReport counts what was restored.
+type ArchiveReport struct {
+	FamilyId    int64 `json:"family_id"`
+	Recipes     int   `json:"recipes"`
+	Ingredients int   `json:"ingredients"`
+	Assignments int   `json:"assignments"`
+	Stores      int   `json:"stores"`
+	PantryItems int   `json:"pantry_items"`
+	Classes     int   `json:"classes"`
+
+	// Recipes, stores and pantry items with a name the family already had.
+	Skipped  int `json:"skipped"`
+	Replaced int `json:"replaced"`
+
+	MissingClasses []string `json:"missing_classes"`
+}
+
+func validConflictMode(mode string) bool {
+	return mode == ConflictSkip || mode == ConflictReplace || mode == ConflictKeep
+}
+
+// ExportFamily collects everything that belongs to the family, with the
+// classes it uses and their parents.
+func ExportFamily(db gorp.SqlExecutor, familyId int64) (*FamilyArchive, error) {
+	result, err := db.Get(Family{}, familyId)
+	if err != nil {
+		return nil, err
+	} else if result == nil {
+		return nil, fmt.Errorf("family %d does not exist", familyId)
+	}
+	family := result.(*Family)
+
+	archive := &FamilyArchive{
+		Format:     FamilyArchiveFormat,
+		Version:    FamilyArchiveVersion,
+		ExportedOn: time.Now().Unix(),
+		Family: ArchivedFamily{
+			Id:                family.Id,
+			Name:              family.Name,
+			PrivateClassifier: family.PrivateClassifier,
+			DefaultServings:   family.DefaultServings,
+		},
+		Members:     []ArchivedMember{},
+		Classes:     []IngredientClass{},
+		Recipes:     []RecipeView{},
+		Ingredients: []Ingredient{},
+		Assignments: []Assignment{},
+	}
+
+	_, err = db.Select(&archive.Members,
+		"SELECT u.email, u.name, m.role FROM familymembers AS m "+
+			"JOIN users AS u ON u.id=m.user_id "+
+			"WHERE m.family_id=? ORDER BY m.id", familyId)
+
+	recipes := []Recipe{}
+	if err == nil {
+		_, err = db.Select(&recipes,
+			"SELECT * FROM recipes WHERE owner_id=? ORDER BY id", familyId)
+	}
+
+	if err == nil {
+		_, err = db.Select(&archive.Ingredients,
+			"SELECT * FROM ingredients WHERE owner_id=? ORDER BY id", familyId)
+	}
+
+	if err == nil {
+		_, err = db.Select(&archive.Assignments,
+			"SELECT * FROM assignments WHERE owner_id=? ORDER BY id", familyId)
+	}
+
+	if err == nil {
+		archive.Stores, err = selectFamilyStores(db, familyId)
+	}
+
+	if err == nil {
+		archive.Pantry, err = selectPantry(db, familyId)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range recipes {
+		// The imports they came from stay behind.
+		recipes[i].ImportId = 0
+
+		view, err := selectRecipeView(db, &recipes[i])
+		if err != nil {
+			return nil, err
+		}
+		archive.Recipes = append(archive.Recipes, *view)
+	}
+
+	tree, err := selectClassTree(db)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[int64]bool)
+	addClass := func(id int64) {
+		for _, class := range tree.ancestors(id) {
+			used[class.Id] = true
+		}
+	}
+	for _, ingredient := range archive.Ingredients {
+		if ingredient.ClassId.Valid {
+			addClass(ingredient.ClassId.Int64)
+		}
+	}
+	for _, store := range archive.Stores {
+		for _, id := range store.Classes {
+			addClass(id)
+		}
+	}
+
+	for id := range used {
+		archive.Classes = append(archive.Classes, *tree[id])
+	}
+	sort.Slice(archive.Classes, func(i, j int) bool {
+		return archive.Classes[i].Id < archive.Classes[j].Id
+	})
+
+	return archive, nil
+}
+
+// validateArchive checks that the archive can be read and that its parts
+// only refer to each other.
+func validateArchive(archive *FamilyArchive) error {
+	if archive.Format != FamilyArchiveFormat {
+		return fmt.Errorf("not a family archive")
+	} else if archive.Version < 1 || archive.Version > FamilyArchiveVersion {
+		return fmt.Errorf("archive version %d is not supported", archive.Version)
+	}
+
+	classes := make(map[int64]bool)
+	for _, class := range archive.Classes {
+		if strings.TrimSpace(class.Name) == "" || classes[class.Id] {
+			return fmt.Errorf("class %d is invalid", class.Id)
+		}
+		classes[class.Id] = true
+	}
+	for _, class := range archive.Classes {
+		if class.ParentId.Valid && !classes[class.ParentId.Int64] {
+			return fmt.Errorf("class %d has a parent that is not in the archive", class.Id)
+		}
+	}
+
+	recipes := make(map[int64]bool)
+	for i := range archive.Recipes {
+		recipe := &archive.Recipes[i]
+		if strings.TrimSpace(recipe.Name) == "" || recipes[recipe.Id] || !validateRecipe(recipe) {
+			return fmt.Errorf("recipe %d is invalid", recipe.Id)
+		}
+		recipes[recipe.Id] = true
+	}
+
+	for _, ingredient := range archive.Ingredients {
+		if ingredient.RecipeId.Valid && !recipes[ingredient.RecipeId.Int64] {
+			return fmt.Errorf("ingredient %d is of a recipe that is not in the archive", ingredient.Id)
+		} else if ingredient.ClassId.Valid && !classes[ingredient.ClassId.Int64] {
+			return fmt.Errorf("ingredient %d has a class that is not in the archive", ingredient.Id)
+		}
+	}
+
+	for _, assignment := range archive.Assignments {
+		if assignment.RecipeId.Valid && !recipes[assignment.RecipeId.Int64] {
+			return fmt.Errorf("assignment %d is of a recipe that is not in the archive", assignment.Id)
+		}
+	}
+
+	for _, store := range archive.Stores {
+		if strings.TrimSpace(store.Name) == "" {
+			return fmt.Errorf("store %d has no name", store.Id)
+		}
+		for _, id := range store.Classes {
+			if !classes[id] {
+				return fmt.Errorf("store %d has a class that is not in the archive", store.Id)
+			}
+		}
+	}
+
+	for _, item := range archive.Pantry {
+		if strings.TrimSpace(item.Name) == "" {
+			return fmt.Errorf("pantry item %d has no name", item.Id)
+		}
+	}
+
+	for _, member := range archive.Members {
+		if !validRole(member.Role) {
+			return fmt.Errorf("member %s has an unknown role", member.Email)
+		}
+	}
+
+	return nil
+}
+
+// archiveRestore holds the state of a restore in progress.
+type archiveRestore struct {
+	tx       *gorp.Transaction
+	archive  *FamilyArchive
+	options  ArchiveOptions
+	familyId int64
+	report   *ArchiveReport
+
+	classes map[int64]int64
+	recipes map[int64]int64
+
+	// Recipes whose ingredients are not restored, because the family keeps
+	// its own recipe of the same name.
+	skipped map[int64]bool
+
+	// Ingredients as they were before and after, for the classifier.
+	removed []Ingredient
+	added   []Ingredient
+}
+
+// archiveOwner returns the user that a new family is created for.
+func (r *archiveRestore) archiveOwner() (int64, error) {
+	if r.options.OwnerId != 0 {
+		return r.options.OwnerId, nil
+	}
+
+	email := r.options.OwnerEmail
+	if email == "" {
+		for _, member := range r.archive.Members {
+			if member.Role == RoleOwner {
+				email = member.Email
+			}
+		}
+	}
+
+	ids := []int64{}
+	_, err := r.tx.Select(&ids, "SELECT id FROM users WHERE email=? LIMIT 1", email)
+	if err != nil {
+		return 0, err
+	} else if len(ids) == 0 {
+		return 0, fmt.Errorf("there is no user with the email address %q", email)
+	}
+	return ids[0], nil
+}
+
+// restoreFamily creates the family, or checks that the one to restore into
+// exists.
+func (r *archiveRestore) restoreFamily() error {
+	if r.options.FamilyId != 0 {
+		result, err := r.tx.Get(Family{}, r.options.FamilyId)
+		if err != nil {
+			return err
+		} else if result == nil {
+			return fmt.Errorf("family %d does not exist", r.options.FamilyId)
+		}
+		r.familyId = r.options.FamilyId
+		return nil
+	}
+
+	ownerId, err := r.archiveOwner()
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(r.archive.Family.Name)
+	if name == "" {
+		name = "Restored Family"
+	}
+
+	family, err := createFamily(r.tx, ownerId, name)
+	if err != nil {
+		return err
+	}
+
+	family.PrivateClassifier = r.archive.Family.PrivateClassifier
+	family.DefaultServings = r.archive.Family.DefaultServings
+	_, err = r.tx.Update(family)
+
+	r.familyId = family.Id
+	return err
+}
+
+// restoreClasses matches the archive's classes with the ones here by name,
+// adding the missing ones if allowed.
+func (r *archiveRestore) restoreClasses() error {
+	existing, err := selectClasses(r.tx)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]int64)
+	for _, class := range existing {
+		byName[strings.ToLower(class.Name)] = class.Id
+	}
+
+	archived := make(map[int64]IngredientClass)
+	for _, class := range r.archive.Classes {
+		archived[class.Id] = class
+	}
+
+	// Parents go first, so that new classes can be put under them. Classes
+	// that stay missing map to 0.
+	checked := make(map[int64]bool)
+	var restore func(id int64, depth int) (int64, error)
+	restore = func(id int64, depth int) (int64, error) {
+		if checked[id] || depth > len(archived) {
+			return r.classes[id], nil
+		}
+		checked[id] = true
+
+		class := archived[id]
+		if mapped, ok := byName[strings.ToLower(strings.TrimSpace(class.Name))]; ok {
+			r.classes[id] = mapped
+			return mapped, nil
+		}
+
+		if !r.options.CreateClasses {
+			r.report.MissingClasses = append(r.report.MissingClasses, class.Name)
+			return 0, nil
+		}
+
+		created := IngredientClass{Name: strings.TrimSpace(class.Name)}
+		if class.ParentId.Valid {
+			parent, err := restore(class.ParentId.Int64, depth+1)
+			if err != nil {
+				return 0, err
+			} else if parent != 0 {
+				created.ParentId = null.IntFrom(parent)
+			}
+		}
+
+		err := r.tx.Insert(&created)
+		if err != nil {
+			return 0, err
+		}
+
+		byName[strings.ToLower(created.Name)] = created.Id
+		r.classes[id] = created.Id
+		r.report.Classes++
+		return created.Id, nil
+	}
+
+	for _, class := range r.archive.Classes {
+		_, err := restore(class.Id, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapClass returns the class here for a class in the archive.
+func (r *archiveRestore) mapClass(id null.Int) null.Int {
+	if mapped, ok := r.classes[id.Int64]; ok && id.Valid {
+		return null.IntFrom(mapped)
+	}
+	return null.Int{}
+}
+
+func (r *archiveRestore) restoreRecipes() error {
+	existing := []Recipe{}
+	_, err := r.tx.Select(&existing,
+		"SELECT * FROM recipes WHERE owner_id=? ORDER BY id", r.familyId)
+	if err != nil {
+		return err
+	}
+
+	// Each recipe here matches at most one in the archive, so that recipes
+	// with the same name are paired up in order.
+	byName := make(map[string][]*Recipe)
+	for i := range existing {
+		key := strings.ToLower(existing[i].Name)
+		byName[key] = append(byName[key], &existing[i])
+	}
+
+	for _, recipe := range r.archive.Recipes {
+		archivedId := recipe.Id
+
+		var current *Recipe
+		key := strings.ToLower(recipe.Name)
+		if matches := byName[key]; len(matches) > 0 {
+			current = matches[0]
+			byName[key] = matches[1:]
+		}
+
+		switch {
+		case current != nil && r.options.OnConflict == ConflictSkip:
+			r.recipes[archivedId] = current.Id
+			r.skipped[archivedId] = true
+			r.report.Skipped++
+			continue
+
+		case current != nil && r.options.OnConflict == ConflictReplace:
+			ingredients := []Ingredient{}
+			_, err = r.tx.Select(&ingredients,
+				"SELECT * FROM ingredients WHERE recipe_id=? AND owner_id=?",
+				current.Id, r.familyId)
+			if err == nil {
+				_, err = r.tx.Exec("DELETE FROM ingredients WHERE recipe_id=? AND owner_id=?",
+					current.Id, r.familyId)
+			}
+			if err != nil {
+				return err
+			}
+			r.removed = append(r.removed, ingredients...)
+
+			current.Show = recipe.Show
+			current.Fixed = recipe.Fixed
+			current.Source = recipe.Source
+			current.Servings = recipe.Servings
+			current.PrepTime = recipe.PrepTime
+			current.CookTime = recipe.CookTime
+			current.TotalTime = recipe.TotalTime
+			current.Yield = recipe.Yield
+			current.Notes = recipe.Notes
+			_, err = r.tx.Update(current)
+			if err == nil {
+				err = saveRecipeSteps(r.tx, current.Id, recipe.Steps)
+			}
+			if err == nil {
+				err = saveRecipeTags(r.tx, current.Id, recipe.Tags)
+			}
+			if err != nil {
+				return err
+			}
+
+			r.recipes[archivedId] = current.Id
+			r.report.Replaced++
+			continue
+		}
+
+		recipe.Id = 0
+		recipe.OwnerId = r.familyId
+		recipe.ImportId = 0
+
+		err = r.tx.Insert(&recipe.Recipe)
+		if err == nil {
+			err = saveRecipeSteps(r.tx, recipe.Id, recipe.Steps)
+		}
+		if err == nil {
+			err = saveRecipeTags(r.tx, recipe.Id, recipe.Tags)
+		}
+		if err != nil {
+			return err
+		}
+
+		r.recipes[archivedId] = recipe.Id
+		r.report.Recipes++
+	}
+
+	return nil
+}
+
+// restoreIngredients adds the ingredients of the restored recipes, and the
+// ones without a recipe unless the family has them already.
+func (r *archiveRestore) restoreIngredients() error {
+	existing := []Ingredient{}
+	_, err := r.tx.Select(&existing,
+		"SELECT * FROM ingredients WHERE owner_id=? AND recipe_id IS NULL", r.familyId)
+	if err != nil {
+		return err
+	}
+
+	key := func(ingredient Ingredient) string {
+		return strings.ToLower(ingredient.Name) + "|" + ingredient.Amount.String
+	}
+
+	loose := make(map[string]int)
+	for _, ingredient := range existing {
+		loose[key(ingredient)]++
+	}
+
+	for _, ingredient := range r.archive.Ingredients {
+		if ingredient.RecipeId.Valid {
+			if r.skipped[ingredient.RecipeId.Int64] {
+				continue
+			}
+			ingredient.RecipeId = null.IntFrom(r.recipes[ingredient.RecipeId.Int64])
+		} else if loose[key(ingredient)] > 0 && r.options.OnConflict != ConflictKeep {
+			loose[key(ingredient)]--
+			continue
+		}
+
+		ingredient.Id = 0
+		ingredient.OwnerId = r.familyId
+		ingredient.ClassId = r.mapClass(ingredient.ClassId)
+
+		err = r.tx.Insert(&ingredient)
+		if err != nil {
+			return err
+		}
+
+		r.added = append(r.added, ingredient)
+		r.report.Ingredients++
+	}
+	return nil
+}
+
+// restoreAssignments plans the archive's meals, except for the ones that are
+// already planned.
+func (r *archiveRestore) restoreAssignments() error {
+	existing := []Assignment{}
+	_, err := r.tx.Select(&existing,
+		"SELECT * FROM assignments WHERE owner_id=?", r.familyId)
+	if err != nil {
+		return err
+	}
+
+	key := func(assignment Assignment) string {
+		return fmt.Sprintf("%d|%s|%s", assignment.RecipeId.Int64,
+			assignment.Date.String, assignment.Meal.String)
+	}
+
+	planned := make(map[string]bool)
+	for _, assignment := range existing {
+		planned[key(assignment)] = true
+	}
+
+	for _, assignment := range r.archive.Assignments {
+		if assignment.RecipeId.Valid {
+			assignment.RecipeId = null.IntFrom(r.recipes[assignment.RecipeId.Int64])
+		}
+		if planned[key(assignment)] {
+			continue
+		}
+
+		assignment.Id = 0
+		assignment.OwnerId = r.familyId
+
+		err = r.tx.Insert(&assignment)
+		if err != nil {
+			return err
+		}
+
+		planned[key(assignment)] = true
+		r.report.Assignments++
+	}
+	return nil
+}
+
+func (r *archiveRestore) restoreStores() error {
+	existing := []Store{}
+	_, err := r.tx.Select(&existing,
+		"SELECT * FROM stores WHERE family_id=?", r.familyId)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*Store)
+	for i := range existing {
+		byName[strings.ToLower(existing[i].Name)] = &existing[i]
+	}
+
+	for _, store := range r.archive.Stores {
+		classes := []int64{}
+		for _, id := range store.Classes {
+			if mapped, ok := r.classes[id]; ok {
+				classes = append(classes, mapped)
+			}
+		}
+
+		current := byName[strings.ToLower(store.Name)]
+		delete(byName, strings.ToLower(store.Name))
+		if current != nil && r.options.OnConflict == ConflictSkip {
+			r.report.Skipped++
+			continue
+		} else if current != nil && r.options.OnConflict == ConflictReplace {
+			current.UnknownPosition = store.UnknownPosition
+			_, err = r.tx.Update(current)
+			if err == nil {
+				err = saveStoreAisles(r.tx, current.Id, classes)
+			}
+			if err != nil {
+				return err
+			}
+			r.report.Replaced++
+			continue
+		}
+
+		created := store.Store
+		created.Id = 0
+		created.FamilyId = r.familyId
+
+		err = r.tx.Insert(&created)
+		if err == nil {
+			err = saveStoreAisles(r.tx, created.Id, classes)
+		}
+		if err != nil {
+			return err
+		}
+		r.report.Stores++
+	}
+	return nil
+}
+
+func (r *archiveRestore) restorePantry() error {
+	existing, err := selectPantry(r.tx, r.familyId)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*PantryItem)
+	for i := range existing {
+		byName[aggregationKey(existing[i].Name)] = &existing[i]
+	}
+
+	for _, item := range r.archive.Pantry {
+		current := byName[aggregationKey(item.Name)]
+		delete(byName, aggregationKey(item.Name))
+		if current != nil && r.options.OnConflict == ConflictSkip {
+			r.report.Skipped++
+			continue
+		} else if current != nil && r.options.OnConflict == ConflictReplace {
+			current.Quantity = item.Quantity
+			current.Unit = item.Unit
+			current.Always = item.Always
+			_, err = r.tx.Update(current)
+			if err != nil {
+				return err
+			}
+			r.report.Replaced++
+			continue
+		}
+
+		item.Id = 0
+		item.FamilyId = r.familyId
+
+		err = r.tx.Insert(&item)
+		if err != nil {
+			return err
+		}
+		r.report.PantryItems++
+	}
+	return nil
+}
+
+// RestoreFamily restores the archive in one transaction, so that nothing is
+// changed if any of it fails. The classifier, if given, learns the restored
+// ingredient classes.
+func RestoreFamily(db *gorp.DbMap, classifier IngredientClassifier, archive *FamilyArchive, options ArchiveOptions) (*ArchiveReport, error) {
+	if options.OnConflict == "" {
+		options.OnConflict = ConflictSkip
+	} else if !validConflictMode(options.OnConflict) {
+		return nil, fmt.Errorf("unknown conflict handling %q", options.OnConflict)
+	}
+
+	err := validateArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &archiveRestore{
+		tx:      tx,
+		archive: archive,
+		options: options,
+		report: &ArchiveReport{
+			MissingClasses: []string{},
+		},
+		classes: make(map[int64]int64),
+		recipes: make(map[int64]int64),
+		skipped: make(map[int64]bool),
+	}
+
+	steps := []func() error{
+		r.restoreFamily,
+		r.restoreClasses,
+		r.restoreRecipes,
+		r.restoreIngredients,
+		r.restoreAssignments,
+		r.restoreStores,
+		r.restorePantry,
+	}
+
+	for _, step := range steps {
+		err = step()
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.report.FamilyId = r.familyId
+
+	if classifier != nil {
+		if options.FamilyId == 0 && archive.Family.PrivateClassifier {
+			classifier.SetPrivate(r.familyId, true)
+		}
+
+		err = classifier.Update(db, r.removed, r.added)
+		if err != nil {
+			logError(err)
+		}
+	}
+
+	return r.report, nil
+}
+
+// readArchive reads the archive from the request body, or from an upload in
+// the file field.
+func readArchive(req *http.Request) (*FamilyArchive, error) {
+	var body io.Reader = req.Body
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := req.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		body = file
+	}
+
+	archive := &FamilyArchive{}
+	decoder := json.NewDecoder(io.LimitReader(body, maxArchiveSize))
+	err := decoder.Decode(archive)
+	return archive, err
+}
+
+// archiveOptions reads how to restore from the query.
+func archiveOptions(req *http.Request) (ArchiveOptions, bool) {
+	query := req.URL.Query()
+
+	options := ArchiveOptions{
+		OnConflict: query.Get("on_conflict"),
+	}
+	if options.OnConflict != "" && !validConflictMode(options.OnConflict) {
+		return options, false
+	}
+
+	return options, true
+}
+
+// ExportFamilyArchive sends the family's archive as a file to download.
+func ExportFamilyArchive(db *gorp.DbMap, params martini.Params, session sessions.Session, res http.ResponseWriter, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	archive, err := ExportFamily(db, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	fileName := fmt.Sprintf("family-%d-%s.json", familyId, time.Now().Format(dateFormat))
+	res.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+
+	ren.JSON(http.StatusOK, archive)
+}
+
+// ImportFamilyArchive restores an archive as a new family of the user.
+func ImportFamilyArchive(db *gorp.DbMap, session sessions.Session, req *http.Request, ren render.Render) {
+	// API tokens are limited to the families they were made for.
+	if _, ok := checkCookieSession(session); !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	user := getUser(db, session)
+	if user == nil {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	options, ok := archiveOptions(req)
+	if !ok {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+	options.OwnerId = user.Id
+	options.CreateClasses = user.Admin.Bool
+
+	archive, err := readArchive(req)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	} else if validateArchive(archive) != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	report, err := RestoreFamily(db, Classifier, archive, options)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	addSessionFamily(session, report.FamilyId)
+
+	ren.JSON(http.StatusOK, report)
+}
+
+// RestoreFamilyArchive restores an archive into an existing family.
+func RestoreFamilyArchive(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	user := getUser(db, session)
+	if user == nil {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	options, ok := archiveOptions(req)
+	if !ok {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+	options.FamilyId = familyId
+	options.CreateClasses = user.Admin.Bool
+
+	archive, err := readArchive(req)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	} else if validateArchive(archive) != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	report, err := RestoreFamily(db, Classifier, archive, options)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+func insertAll(t *testing.T, db gorp.SqlExecutor, rows ...interface{}) {
+	for _, row := range rows {
+		err := db.Insert(row)
+		if err != nil {
+			t.Fatalf("inserting %T: %v", row, err)
+		}
+	}
+}
+
+// createArchiveUsers adds the owner and a member of the archived family.
+func createArchiveUsers(t *testing.T, db *gorp.DbMap) (*User, *User) {
+	owner := &User{Email: "owner@example.com", Name: "Owner"}
+	member := &User{Email: "member@example.com", Name: "Member"}
+	insertAll(t, db, owner, member)
+	return owner, member
+}
+
+// createArchivedFamily fills a family with a bit of everything an archive
+// holds.
+func createArchivedFamily(t *testing.T, db *gorp.DbMap) int64 {
+	owner, member := createArchiveUsers(t, db)
+
+	family, err := createFamily(db, owner.Id, "Home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	family.DefaultServings = null.IntFrom(3)
+	_, err = db.Update(family)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	produce := &IngredientClass{Name: "Produce"}
+	insertAll(t, db, &FamilyMember{FamilyId: family.Id, UserId: member.Id, Role: RoleEditor}, produce)
+	onions := &IngredientClass{Name: "Onions", ParentId: null.IntFrom(produce.Id)}
+	insertAll(t, db, onions)
+
+	soup := &Recipe{OwnerId: family.Id, Name: "Soup", Show: true, Servings: null.IntFrom(4)}
+	insertAll(t, db, soup)
+
+	store := &Store{FamilyId: family.Id, Name: "Market"}
+	insertAll(t, db,
+		&RecipeStep{RecipeId: soup.Id, Position: 0, Text: "Chop the onions."},
+		&RecipeStep{RecipeId: soup.Id, Position: 1, Text: "Boil."},
+		&RecipeTag{RecipeId: soup.Id, Kind: "course", Name: "dinner"},
+		&Ingredient{OwnerId: family.Id, RecipeId: null.IntFrom(soup.Id), Name: "onions",
+			Amount: null.StringFrom("2"), ClassId: null.IntFrom(onions.Id)},
+		&Ingredient{OwnerId: family.Id, RecipeId: null.IntFrom(soup.Id), Name: "water",
+			Amount: null.StringFrom("1 l")},
+		&Assignment{OwnerId: family.Id, RecipeId: null.IntFrom(soup.Id),
+			Date: null.StringFrom("2026-10-19"), Meal: null.StringFrom("dinner")},
+		store,
+		&StoreAisle{StoreId: store.Id, ClassId: onions.Id},
+		&PantryItem{FamilyId: family.Id, Name: "rice", Quantity: null.FloatFrom(500), Unit: null.StringFrom("g")},
+	)
+
+	return family.Id
+}
+
+// archiveContent is what an archive says without the ids, which change when
+// it is restored.
+type archiveContent struct {
+	Family      string
+	Servings    int64
+	Members     []ArchivedMember
+	Recipes     []string
+	Steps       []string
+	Tags        []Tag
+	Ingredients []string
+	Assignments []string
+	Stores      []string
+	Pantry      []string
+}
+
+func contentOf(archive *FamilyArchive) archiveContent {
+	classes := make(map[int64]string)
+	for _, class := range archive.Classes {
+		classes[class.Id] = class.Name
+	}
+	recipes := make(map[int64]string)
+
+	content := archiveContent{
+		Family:   archive.Family.Name,
+		Servings: archive.Family.DefaultServings.Int64,
+		Members:  archive.Members,
+	}
+	for _, recipe := range archive.Recipes {
+		recipes[recipe.Id] = recipe.Name
+		content.Recipes = append(content.Recipes, recipe.Name)
+		content.Steps = append(content.Steps, recipe.Steps...)
+		content.Tags = append(content.Tags, recipe.Tags...)
+	}
+	for _, ingredient := range archive.Ingredients {
+		content.Ingredients = append(content.Ingredients, recipes[ingredient.RecipeId.Int64]+": "+
+			ingredient.Name+" "+ingredient.Amount.String+" "+classes[ingredient.ClassId.Int64])
+	}
+	for _, assignment := range archive.Assignments {
+		content.Assignments = append(content.Assignments,
+			assignment.Date.String+" "+assignment.Meal.String+" "+recipes[assignment.RecipeId.Int64])
+	}
+	for _, store := range archive.Stores {
+		for _, id := range store.Classes {
+			content.Stores = append(content.Stores, store.Name+": "+classes[id])
+		}
+	}
+	for _, item := range archive.Pantry {
+		content.Pantry = append(content.Pantry, item.Name+" "+formatAmount(item.Quantity, null.Float{}, item.Unit))
+	}
+	return content
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	source, cleanupSource := openMigratedDatabase(t)
+	defer cleanupSource()
+	target, cleanupTarget := openMigratedDatabase(t)
+	defer cleanupTarget()
+
+	familyId := createArchivedFamily(t, source)
+	exported, err := ExportFamily(source, familyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := &FamilyArchive{}
+	err = json.Unmarshal(data, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same people have accounts on the other server.
+	owner, _ := createArchiveUsers(t, target)
+
+	report, err := RestoreFamily(target, newBayesClassifier(), archive, ArchiveOptions{CreateClasses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Recipes != 1 || report.Ingredients != 2 || report.Assignments != 1 ||
+		report.Stores != 1 || report.PantryItems != 1 || report.Classes != 2 {
+		t.Errorf("restore report %+v", report)
+	}
+
+	restored, err := ExportFamily(target, report.FamilyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring only makes the owner a member.
+	want := contentOf(exported)
+	want.Members = []ArchivedMember{{Email: owner.Email, Name: owner.Name, Role: RoleOwner}}
+
+	if got := contentOf(restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored family differs:\n got %+v\nwant %+v", got, want)
+	}
+
+	count, err := target.SelectInt("SELECT COUNT(*) FROM classifierclasses WHERE family_id=?", report.FamilyId)
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("the classifier learned %d classes from the restored family, want 1", count)
+	}
+
+	// Restoring into the family again skips what it already has.
+	report, err = RestoreFamily(target, nil, archive, ArchiveOptions{FamilyId: report.FamilyId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Recipes != 0 || report.Stores != 0 || report.PantryItems != 0 || report.Skipped != 3 {
+		t.Errorf("restoring again gave %+v, want everything skipped", report)
+	}
+}
+
+func TestRestoreRejectsBrokenArchives(t *testing.T) {
+	db, cleanup := openMigratedDatabase(t)
+	defer cleanup()
+
+	familyId := createArchivedFamily(t, db)
+	archive, err := ExportFamily(db, familyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		about  string
+		change func(archive *FamilyArchive)
+	}{
+		{"a different format", func(archive *FamilyArchive) { archive.Format = "other" }},
+		{"a newer version", func(archive *FamilyArchive) { archive.Version = FamilyArchiveVersion + 1 }},
+		{"an ingredient of a missing recipe", func(archive *FamilyArchive) {
+			archive.Ingredients[0].RecipeId = null.IntFrom(-1)
+		}},
+	}
+
+	for _, test := range tests {
+		broken := *archive
+		broken.Ingredients = append([]Ingredient{}, archive.Ingredients...)
+		test.change(&broken)
+
+		_, err := RestoreFamily(db, nil, &broken, ArchiveOptions{FamilyId: familyId})
+		if err == nil {
+			t.Errorf("restored an archive with %s", test.about)
+		}
+	}
+}
@@ -57,8 +57,15 @@ func CreateAssignment(session sessions.Session, db *gorp.DbMap, params martini.P
 		return
 	}
 
-	// No messing around with protected fields.
+	// No messing around with protected fields. Meals are marked as cooked
+	// with CookAssignment.
 	assignment.OwnerId = familyId
+	assignment.Cooked = false
+
+	if assignment.Servings.Valid && assignment.Servings.Int64 <= 0 {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
 
 	err = db.Insert(&assignment)
 	if err != nil {
@@ -140,6 +147,8 @@ func UpdateAssignment(session sessions.Session, db *gorp.DbMap, params martini.P
 		return
 	}
 
+	cooked := assignment.Cooked
+
 	decoder := json.NewDecoder(req.Body)
 	err = decoder.Decode(&assignment)
 	if err != nil {
@@ -149,6 +158,12 @@ func UpdateAssignment(session sessions.Session, db *gorp.DbMap, params martini.P
 
 	// No messing around with protected fields.
 	assignment.OwnerId = familyId
+	assignment.Cooked = cooked
+
+	if assignment.Servings.Valid && assignment.Servings.Int64 <= 0 {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
 
 	_, err = db.Update(assignment)
 	if err != nil {
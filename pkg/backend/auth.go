@@ -1,12 +1,16 @@
 package backend
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
 )
 
 type AuthResponse struct {
@@ -14,6 +18,9 @@ type AuthResponse struct {
 	Token    string        `json:"token"`
 	UserId   int64         `json:"user_id"`
 	Families []int64       `json:"families"`
+
+	// Family to open first, e.g. the one whose invitation was just accepted.
+	FamilyId int64 `json:"family_id,omitempty"`
 }
 
 type FamilyAccess struct {
@@ -24,6 +31,125 @@ func logError(err error) {
 	fmt.Printf("Error: %v\n", err)
 }
 
+// TokenBytes is the length of the random part of a token, 256 bits.
+const TokenBytes = 32
+
+// newToken returns a random token, e.g. for an emailed link.
+func newToken() string {
+	return randomHex(TokenBytes)
+}
+
+// hashToken returns the form in which emailed links and API tokens are stored,
+// so a leaked database cannot be used to redeem them. The tokens are long
+// random strings, so a plain hash is enough, and unlike a keyed hash it stays
+// valid when the session secret changes.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func startSession(session sessions.Session, user *User, families []int64) {
+	session.Set("Admin", user.Admin.Bool)
+	session.Set("Families", families)
+	session.Set("FamilyId", user.DefaultFamilyId)
+	session.Set("UserId", user.Id)
+	session.Set("LoginTime", time.Now().UnixNano())
+}
+
+// addSessionFamily gives the session access to a family the user just joined,
+// so they do not have to sign in again. Families is kept sorted for
+// checkFamilyParam.
+func addSessionFamily(session sessions.Session, familyId int64) []int64 {
+	families, _ := session.Get("Families").([]int64)
+
+	index := sort.Search(len(families), func(i int) bool { return families[i] >= familyId })
+	if index < len(families) && families[index] == familyId {
+		return families
+	}
+
+	updated := make([]int64, 0, len(families)+1)
+	updated = append(updated, families[:index]...)
+	updated = append(updated, familyId)
+	updated = append(updated, families[index:]...)
+
+	session.Set("Families", updated)
+	return updated
+}
+
+func removeSessionFamily(session sessions.Session, familyId int64) {
+	families, _ := session.Get("Families").([]int64)
+
+	updated := make([]int64, 0, len(families))
+	for _, id := range families {
+		if id != familyId {
+			updated = append(updated, id)
+		}
+	}
+
+	session.Set("Families", updated)
+}
+
+// sessionIsCurrent reports whether the session was started after the user's
+// sessions were last invalidated, e.g. by a password reset.
+func sessionIsCurrent(session sessions.Session, user *User) bool {
+	// Sessions derived from an API token are checked against the token in
+	// authenticateToken.
+	if session.Get("ApiTokenId") != nil {
+		return true
+	}
+
+	loginTime, _ := session.Get("LoginTime").(int64)
+	return loginTime > user.SessionsValidAfter
+}
+
+func sameIds(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// refreshSession brings the session up to date with the database, so that
+// membership and admin changes take effect on the next request rather than
+// the next sign in. This is a single indexed query per request, which is
+// cheaper than keeping a cache consistent with every place that changes
+// memberships. Values are only written when they change, to avoid sending a
+// new cookie with every response.
+func refreshSession(db gorp.SqlExecutor, session sessions.Session, user *User) error {
+	// Token sessions are resolved fresh in authenticateToken.
+	if session.Get("ApiTokenId") != nil {
+		return nil
+	}
+
+	families, err := selectFamilyIds(db, user.Id)
+	if err != nil {
+		return err
+	}
+
+	if admin, _ := session.Get("Admin").(bool); admin != user.Admin.Bool {
+		session.Set("Admin", user.Admin.Bool)
+	}
+
+	if current, _ := session.Get("Families").([]int64); !sameIds(current, families) {
+		session.Set("Families", families)
+	}
+
+	familyId, _ := session.Get("FamilyId").(int64)
+	index := sort.Search(len(families), func(i int) bool { return families[i] >= familyId })
+	if (index == len(families) || families[index] != familyId) && familyId != user.DefaultFamilyId {
+		session.Set("FamilyId", user.DefaultFamilyId)
+	}
+
+	return nil
+}
+
 func checkFamilyParam(params martini.Params, session sessions.Session) (int64, bool) {
 	family_id, err := strconv.ParseInt(params["family_id"], 0, 64)
 	if err != nil {
@@ -41,6 +167,6 @@ func checkFamilyParam(params martini.Params, session sessions.Session) (int64, b
 		return family_id, false
 	}
 
-	index := sort.Search(len(families), func(i int) bool { return families[i] == family_id })
+	index := sort.Search(len(families), func(i int) bool { return families[i] >= family_id })
 	return family_id, (index < len(families) && families[index] == family_id)
 }
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestCheckFamilyParam(t *testing.T) {
+	tests := []struct {
+		param    string
+		admin    bool
+		families []int64
+		ok       bool
+	}{
+		{"1", false, []int64{1, 4, 5}, true},
+		{"4", false, []int64{1, 4, 5}, true},
+		{"5", false, []int64{1, 4, 5}, true},
+		{"2", false, []int64{1, 4, 5}, false},
+		{"6", false, []int64{1, 4, 5}, false},
+		{"0", false, []int64{1, 4, 5}, false},
+		{"1", false, []int64{}, false},
+		{"1", false, nil, false},
+		{"3", true, []int64{1}, true},
+		{"x", true, []int64{1}, false},
+	}
+
+	for _, test := range tests {
+		session := &tokenSession{}
+		session.Clear()
+		session.Set("Admin", test.admin)
+		if test.families != nil {
+			session.Set("Families", test.families)
+		}
+
+		_, ok := checkFamilyParam(martini.Params{"family_id": test.param}, session)
+		if ok != test.ok {
+			t.Errorf("checkFamilyParam(%q) with families %v = %v, want %v",
+				test.param, test.families, ok, test.ok)
+		}
+	}
+}
+
+func TestSessionIsCurrent(t *testing.T) {
+	user := &User{Id: 1}
+
+	before := &tokenSession{}
+	before.Clear()
+	startSession(before, user, nil)
+
+	// Signing out everywhere right after, within the same second, still ends
+	// the earlier session.
+	user.SessionsValidAfter = time.Now().UnixNano()
+	if sessionIsCurrent(before, user) {
+		t.Error("a session started before signing out everywhere is still current")
+	}
+	before.Set("LoginTime", user.SessionsValidAfter)
+	if sessionIsCurrent(before, user) {
+		t.Error("a session started at the same time as signing out everywhere is still current")
+	}
+
+	after := &tokenSession{}
+	after.Clear()
+	startSession(after, user, nil)
+	if !sessionIsCurrent(after, user) {
+		t.Error("a session started after signing out everywhere is not current")
+	}
+}
@@ -0,0 +1,591 @@
+package backend
+
+import (
+	"math"
+	"sync"
+
+	"gopkg.in/gorp.v2"
+)
+
+// bayesCounts are the sufficient statistics of a naive Bayes model over
+// the features of an ingredient's name and amount. Keeping counts rather than
+// probabilities lets the model be updated one ingredient at a time.
+type bayesCounts struct {
+	// Number of labeled ingredients, in total and per class.
+	total       int64
+	classCounts map[int64]int64
+
+	// Occurrences of each feature per class, the sum over all features per
+	// class, and the sum over all classes per feature. The keys of
+	// featureTotals make up the vocabulary.
+	featureCounts map[int64]map[string]int64
+	classFeatures map[int64]int64
+	featureTotals map[string]int64
+}
+
+// bayesClassifier keeps a naive Bayes model for every family and a shared
+// model made of the families that did not opt out with
+// Family.PrivateClassifier. A family's ingredients are classified with its
+// own model, using the shared model as the prior (see Classify). The
+// per-family counts are mirrored in the classifierclasses and
+// classifierfeatures tables; the shared model is their sum and only lives in
+// memory.
+type bayesClassifier struct {
+	lock sync.RWMutex
+
+	global   *bayesCounts
+	families map[int64]*bayesCounts
+	private  map[int64]bool
+}
+
+func newBayesCounts() *bayesCounts {
+	return &bayesCounts{
+		classCounts:   make(map[int64]int64),
+		featureCounts: make(map[int64]map[string]int64),
+		classFeatures: make(map[int64]int64),
+		featureTotals: make(map[string]int64),
+	}
+}
+
+func newBayesClassifier() *bayesClassifier {
+	return &bayesClassifier{
+		global:   newBayesCounts(),
+		families: make(map[int64]*bayesCounts),
+		private:  make(map[int64]bool),
+	}
+}
+
+// countsDelta is a change to the counts of one model, e.g. from relabeling an
+// ingredient.
+type countsDelta struct {
+	classCounts   map[int64]int64
+	featureCounts map[int64]map[string]int64
+}
+
+func newCountsDelta() *countsDelta {
+	return &countsDelta{
+		classCounts:   make(map[int64]int64),
+		featureCounts: make(map[int64]map[string]int64),
+	}
+}
+
+func (d *countsDelta) add(ingredient *Ingredient, sign int64) {
+	if !ingredient.ClassId.Valid {
+		return
+	}
+
+	class_id := ingredient.ClassId.Int64
+	d.classCounts[class_id] += sign
+
+	if d.featureCounts[class_id] == nil {
+		d.featureCounts[class_id] = make(map[string]int64)
+	}
+	for _, feature := range extractFeatures(ingredient.Name, ingredient.Amount.String) {
+		d.featureCounts[class_id][feature] += sign
+	}
+}
+
+// delta returns the change that adds (sign 1) or removes (sign -1) all of
+// the counts to or from another model.
+func (m *bayesCounts) delta(sign int64) *countsDelta {
+	d := newCountsDelta()
+	for class_id, count := range m.classCounts {
+		d.classCounts[class_id] = sign * count
+	}
+	for class_id, features := range m.featureCounts {
+		d.featureCounts[class_id] = make(map[string]int64)
+		for feature, count := range features {
+			d.featureCounts[class_id][feature] = sign * count
+		}
+	}
+	return d
+}
+
+func (m *bayesCounts) apply(d *countsDelta) {
+	for class_id, count := range d.classCounts {
+		m.total += count
+		m.classCounts[class_id] += count
+		if m.classCounts[class_id] <= 0 {
+			delete(m.classCounts, class_id)
+		}
+	}
+
+	for class_id, features := range d.featureCounts {
+		for feature, count := range features {
+			if count == 0 {
+				continue
+			}
+
+			if m.featureCounts[class_id] == nil {
+				m.featureCounts[class_id] = make(map[string]int64)
+			}
+
+			m.featureCounts[class_id][feature] += count
+			if m.featureCounts[class_id][feature] <= 0 {
+				delete(m.featureCounts[class_id], feature)
+			}
+
+			m.classFeatures[class_id] += count
+			if m.classFeatures[class_id] <= 0 {
+				delete(m.classFeatures, class_id)
+			}
+
+			m.featureTotals[feature] += count
+			if m.featureTotals[feature] <= 0 {
+				delete(m.featureTotals, feature)
+			}
+		}
+
+		if len(m.featureCounts[class_id]) == 0 {
+			delete(m.featureCounts, class_id)
+		}
+	}
+}
+
+// save adds the delta to the family's counts stored in the database.
+func (d *countsDelta) save(db gorp.SqlExecutor, familyId int64) error {
+	for class_id, count := range d.classCounts {
+		if count == 0 {
+			continue
+		}
+
+		_, err := db.Exec(
+			"INSERT INTO classifierclasses (family_id, class_id, count) VALUES (?, ?, ?) "+
+				"ON CONFLICT (family_id, class_id) DO UPDATE SET count=classifierclasses.count+excluded.count",
+			familyId, class_id, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	for class_id, features := range d.featureCounts {
+		for feature, count := range features {
+			if count == 0 {
+				continue
+			}
+
+			_, err := db.Exec(
+				"INSERT INTO classifierfeatures (family_id, class_id, feature, count) VALUES (?, ?, ?, ?) "+
+					"ON CONFLICT (family_id, class_id, feature) DO UPDATE SET count=classifierfeatures.count+excluded.count",
+				familyId, class_id, feature, count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func deleteEmptyCounts(db gorp.SqlExecutor) error {
+	_, err := db.Exec("DELETE FROM classifierclasses WHERE count<=0")
+	if err == nil {
+		_, err = db.Exec("DELETE FROM classifierfeatures WHERE count<=0")
+	}
+	return err
+}
+
+// apply adds per-family deltas to the family models and to the shared model.
+// The caller must hold the write lock.
+func (c *bayesClassifier) apply(deltas map[int64]*countsDelta) {
+	for familyId, d := range deltas {
+		if c.families[familyId] == nil {
+			c.families[familyId] = newBayesCounts()
+		}
+		c.families[familyId].apply(d)
+
+		if !c.private[familyId] {
+			c.global.apply(d)
+		}
+	}
+}
+
+// reset clears the counts and sets which families keep their labels out of
+// the shared model. The caller must hold the write lock.
+func (c *bayesClassifier) reset(private []int64) {
+	c.global = newBayesCounts()
+	c.families = make(map[int64]*bayesCounts)
+	c.private = make(map[int64]bool)
+	for _, familyId := range private {
+		c.private[familyId] = true
+	}
+}
+
+// Load reads the counts stored in the database. If there are none yet, but
+// there are labeled ingredients, e.g. right after upgrading, the models are
+// built from the ingredients.
+func (c *bayesClassifier) Load(db *gorp.DbMap) error {
+	classes := []ClassifierClass{}
+	_, err := db.Select(&classes, "SELECT * FROM classifierclasses")
+	if err != nil {
+		return err
+	}
+
+	if len(classes) == 0 {
+		labeled, err := db.SelectInt("SELECT COUNT(*) FROM ingredients WHERE class_id IS NOT NULL")
+		if err != nil {
+			return err
+		}
+
+		if labeled > 0 {
+			return c.Rebuild(db)
+		}
+	}
+
+	features := []ClassifierFeature{}
+	_, err = db.Select(&features, "SELECT * FROM classifierfeatures")
+	if err != nil {
+		return err
+	}
+
+	private, err := selectPrivateFamilies(db)
+	if err != nil {
+		return err
+	}
+
+	deltas := make(map[int64]*countsDelta)
+	delta := func(familyId int64) *countsDelta {
+		if deltas[familyId] == nil {
+			deltas[familyId] = newCountsDelta()
+		}
+		return deltas[familyId]
+	}
+
+	for _, class := range classes {
+		delta(class.FamilyId).classCounts[class.ClassId] += class.Count
+	}
+	for _, feature := range features {
+		d := delta(feature.FamilyId)
+		if d.featureCounts[feature.ClassId] == nil {
+			d.featureCounts[feature.ClassId] = make(map[string]int64)
+		}
+		d.featureCounts[feature.ClassId][feature.Feature] += feature.Count
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reset(private)
+	c.apply(deltas)
+
+	return nil
+}
+
+// ingredientDeltas groups the changes by the family owning the ingredients.
+func ingredientDeltas(removed []Ingredient, added []Ingredient) map[int64]*countsDelta {
+	deltas := make(map[int64]*countsDelta)
+
+	add := func(ingredients []Ingredient, sign int64) {
+		for i := range ingredients {
+			familyId := ingredients[i].OwnerId
+			if deltas[familyId] == nil {
+				deltas[familyId] = newCountsDelta()
+			}
+			deltas[familyId].add(&ingredients[i], sign)
+		}
+	}
+
+	add(removed, -1)
+	add(added, 1)
+
+	return deltas
+}
+
+// Rebuild recounts everything from the labeled ingredients and replaces the
+// stored counts.
+func (c *bayesClassifier) Rebuild(db *gorp.DbMap) error {
+	ingredients, err := selectLabeledIngredients(db)
+	if err != nil {
+		return err
+	}
+
+	private, err := selectPrivateFamilies(db)
+	if err != nil {
+		return err
+	}
+
+	deltas := ingredientDeltas(nil, ingredients)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM classifierclasses")
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM classifierfeatures")
+	}
+	for familyId, d := range deltas {
+		if err == nil {
+			err = d.save(tx, familyId)
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.reset(private)
+	c.apply(deltas)
+
+	return nil
+}
+
+// Update brings the models up to date after ingredients were labeled,
+// relabeled, renamed or deleted. removed holds the ingredients as they were
+// before the change and added as they are now; unlabeled ingredients are
+// ignored.
+func (c *bayesClassifier) Update(db *gorp.DbMap, removed []Ingredient, added []Ingredient) error {
+	deltas := ingredientDeltas(removed, added)
+
+	// Holding the lock while writing keeps the stored counts in the same
+	// order of updates as the in-memory ones.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for familyId, d := range deltas {
+		if err == nil {
+			err = d.save(tx, familyId)
+		}
+	}
+	if err == nil {
+		err = deleteEmptyCounts(tx)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.apply(deltas)
+
+	return nil
+}
+
+// SetPrivate takes a family's labels out of the shared model, or puts them
+// back in. The family's own model is not affected.
+func (c *bayesClassifier) SetPrivate(familyId int64, private bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.private[familyId] == private {
+		return
+	}
+
+	if private {
+		c.private[familyId] = true
+	} else {
+		delete(c.private, familyId)
+	}
+
+	if counts := c.families[familyId]; counts != nil {
+		if private {
+			c.global.apply(counts.delta(-1))
+		} else {
+			c.global.apply(counts.delta(1))
+		}
+	}
+}
+
+// Forget removes the family's model and its stored counts, which Update
+// already brought down to zero.
+func (c *bayesClassifier) Forget(db *gorp.DbMap, familyId int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, err := db.Exec("DELETE FROM classifierclasses WHERE family_id=?", familyId)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM classifierfeatures WHERE family_id=?", familyId)
+	}
+	if err != nil {
+		return err
+	}
+
+	delete(c.families, familyId)
+	delete(c.private, familyId)
+	return nil
+}
+
+// Classify returns the most likely class of the ingredient for the family, or
+// -1 if no class stands out.
+//
+// The family's model is smoothed towards the shared one: the shared model's
+// probabilities count as FamilyPriorWeight observations added to the
+// family's own counts,
+//
+//	P(c)   = (n(c) + W Pg(c)) / (n + W)
+//	P(f|c) = (n(f,c) + W Pg(f|c)) / (m(c) + W)
+//
+// where n counts the family's labeled ingredients, n(c) those of class c,
+// n(f,c) the occurrences of feature f under class c and m(c) all feature
+// occurrences under c. Pg(f|c) gives every feature in the vocabulary of
+// either model a small count under every class to prevent zero
+// probabilities. A family without labels of its own gets the shared model
+// unchanged.
+func (c *bayesClassifier) Classify(familyId int64, name string, amount string) int64 {
+	best, margin := c.rank(familyId, name, amount)
+	return certain(best, margin, c.threshold())
+}
+
+func (c *bayesClassifier) rank(familyId int64, name string, amount string) (int64, float64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return bestClass(logProbs(c.score(familyId, extractFeatures(name, amount))))
+}
+
+func (c *bayesClassifier) threshold() float64 {
+	return CertaintyThreshold
+}
+
+func (c *bayesClassifier) train(private []int64, ingredients []Ingredient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reset(private)
+	c.apply(ingredientDeltas(nil, ingredients))
+}
+
+// classScore is the log-probability of a class for an ingredient, split into
+// the prior and the term each feature contributed.
+type classScore struct {
+	LogProb  float64
+	Prior    float64
+	Features map[string]float64
+}
+
+func logProbs(scores map[int64]*classScore) map[int64]float64 {
+	result := make(map[int64]float64)
+	for class_id, score := range scores {
+		result[class_id] = score.LogProb
+	}
+	return result
+}
+
+// score evaluates the model for every known class. The caller must hold the
+// read lock.
+func (c *bayesClassifier) score(familyId int64, features []string) map[int64]*classScore {
+	global := c.global
+	family := c.families[familyId]
+	if family == nil {
+		family = newBayesCounts()
+	}
+
+	vocabulary := float64(len(global.featureTotals))
+	for feature := range family.featureTotals {
+		if global.featureTotals[feature] == 0 {
+			vocabulary++
+		}
+	}
+
+	classes := make(map[int64]bool)
+	for class_id := range global.classCounts {
+		classes[class_id] = true
+	}
+	for class_id := range family.classCounts {
+		classes[class_id] = true
+	}
+
+	// Features that were never seen carry no information and are skipped.
+	known := []string{}
+	for _, feature := range features {
+		if global.featureTotals[feature] > 0 || family.featureTotals[feature] > 0 {
+			known = append(known, feature)
+		}
+	}
+
+	scores := make(map[int64]*classScore)
+	for class_id := range classes {
+		prior := 0.0
+		if global.total > 0 {
+			prior = float64(global.classCounts[class_id]) / float64(global.total)
+		}
+		prior = (float64(family.classCounts[class_id]) + FamilyPriorWeight*prior) /
+			(float64(family.total) + FamilyPriorWeight)
+
+		score := &classScore{
+			LogProb:  math.Log(prior),
+			Prior:    math.Log(prior),
+			Features: make(map[string]float64),
+		}
+
+		globalDenominator := float64(global.classFeatures[class_id]) + RegularizationTerm*vocabulary
+		familyDenominator := float64(family.classFeatures[class_id]) + FamilyPriorWeight
+		for _, feature := range known {
+			p := (float64(global.featureCounts[class_id][feature]) + RegularizationTerm) / globalDenominator
+			p = (float64(family.featureCounts[class_id][feature]) + FamilyPriorWeight*p) / familyDenominator
+
+			score.LogProb += math.Log(p)
+			score.Features[feature] += math.Log(p)
+		}
+
+		scores[class_id] = score
+	}
+
+	return scores
+}
+
+// Explain scores the ingredient like Classify and returns the top classes
+// with their log-probabilities. A feature's contribution to a class is its
+// log-probability under the class minus the average over all classes.
+func (c *bayesClassifier) Explain(familyId int64, name string, amount string, top int) *Explanation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	features := extractFeatures(name, amount)
+	scores := c.score(familyId, features)
+
+	explanation := newExplanation(ClassifierBayes, features)
+
+	best, margin := bestClass(logProbs(scores))
+	explanation.ClassId = certain(best, margin, c.threshold())
+
+	average := make(map[string]float64)
+	for _, score := range scores {
+		for feature, logp := range score.Features {
+			average[feature] += logp / float64(len(scores))
+		}
+	}
+
+	for class_id, score := range scores {
+		class := ClassExplanation{
+			ClassId:  class_id,
+			Score:    score.LogProb,
+			LogProb:  score.LogProb,
+			Prior:    score.Prior,
+			Features: []FeatureContribution{},
+		}
+
+		for feature, logp := range score.Features {
+			class.Features = append(class.Features, FeatureContribution{
+				Feature:      feature,
+				LogProb:      logp,
+				Contribution: logp - average[feature],
+			})
+		}
+
+		explanation.Classes = append(explanation.Classes, class)
+	}
+
+	explanation.finish(top)
+	return explanation
+}
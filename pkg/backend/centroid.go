@@ -0,0 +1,350 @@
+package backend
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/gorp.v2"
+)
+
+// centroidCounts sums the vectors of each class's ingredients, which is all
+// that is needed for their centroids.
+type centroidCounts struct {
+	docs  map[int64]int64
+	terms map[int64]map[string]float64
+}
+
+func newCentroidCounts() *centroidCounts {
+	return &centroidCounts{
+		docs:  make(map[int64]int64),
+		terms: make(map[int64]map[string]float64),
+	}
+}
+
+// add adds (sign 1) or removes (sign -1) the sum of docs vectors.
+func (m *centroidCounts) add(class_id int64, vector map[string]float64, docs int64, sign int64) {
+	m.docs[class_id] += sign * docs
+	if m.docs[class_id] <= 0 {
+		delete(m.docs, class_id)
+		delete(m.terms, class_id)
+		return
+	}
+
+	if m.terms[class_id] == nil {
+		m.terms[class_id] = make(map[string]float64)
+	}
+
+	terms := m.terms[class_id]
+	for term, value := range vector {
+		terms[term] += float64(sign) * value
+
+		// Removing a vector again leaves rounding errors behind.
+		if math.Abs(terms[term]) < 1e-9 {
+			delete(terms, term)
+		}
+	}
+}
+
+// centroidClassifier compares an ingredient's character n-grams, weighted by
+// TF-IDF, with the centroid of each class and picks the most similar one.
+// N-grams need no word boundaries or stemming, which suits names in any
+// language.
+//
+// Each class's centroid for a family combines the shared and the family's
+// own ingredients, with the shared mean counting as FamilyPriorWeight
+// ingredients. The counts are built from the ingredients on startup and kept
+// up to date in memory.
+type centroidClassifier struct {
+	lock sync.RWMutex
+
+	shared   *centroidCounts
+	families map[int64]*centroidCounts
+	private  map[int64]bool
+
+	// Document frequency of every n-gram, over all labeled ingredients.
+	total int64
+	df    map[string]int64
+}
+
+func newCentroidClassifier() *centroidClassifier {
+	return &centroidClassifier{
+		shared:   newCentroidCounts(),
+		families: make(map[int64]*centroidCounts),
+		private:  make(map[int64]bool),
+		df:       make(map[string]int64),
+	}
+}
+
+// termVector counts the n-grams of the name and the unit of the amount,
+// scaled to unit length.
+func termVector(name string, amount string) map[string]float64 {
+	vector := make(map[string]float64)
+	for _, gram := range characterNgrams(name) {
+		vector[gram]++
+	}
+
+	if amount != "" {
+		unit := TextPattern.FindString(strings.ToLower(amount))
+		if unit != "" {
+			vector["unit:"+unit]++
+		}
+	}
+
+	norm := 0.0
+	for _, value := range vector {
+		norm += value * value
+	}
+	norm = math.Sqrt(norm)
+
+	for term := range vector {
+		vector[term] /= norm
+	}
+	return vector
+}
+
+// reset clears the counts. The caller must hold the write lock.
+func (c *centroidClassifier) reset(private []int64) {
+	c.shared = newCentroidCounts()
+	c.families = make(map[int64]*centroidCounts)
+	c.private = make(map[int64]bool)
+	for _, familyId := range private {
+		c.private[familyId] = true
+	}
+	c.total = 0
+	c.df = make(map[string]int64)
+}
+
+// add adds (sign 1) or removes (sign -1) the labeled ingredients. The caller
+// must hold the write lock.
+func (c *centroidClassifier) add(ingredients []Ingredient, sign int64) {
+	for _, ingredient := range ingredients {
+		if !ingredient.ClassId.Valid {
+			continue
+		}
+
+		vector := termVector(ingredient.Name, ingredient.Amount.String)
+		if len(vector) == 0 {
+			continue
+		}
+
+		familyId := ingredient.OwnerId
+		if c.families[familyId] == nil {
+			c.families[familyId] = newCentroidCounts()
+		}
+		c.families[familyId].add(ingredient.ClassId.Int64, vector, 1, sign)
+
+		if !c.private[familyId] {
+			c.shared.add(ingredient.ClassId.Int64, vector, 1, sign)
+		}
+
+		c.total += sign
+		for term := range vector {
+			c.df[term] += sign
+			if c.df[term] <= 0 {
+				delete(c.df, term)
+			}
+		}
+	}
+}
+
+func (c *centroidClassifier) Load(db *gorp.DbMap) error {
+	ingredients, err := selectLabeledIngredients(db)
+	if err != nil {
+		return err
+	}
+
+	private, err := selectPrivateFamilies(db)
+	if err != nil {
+		return err
+	}
+
+	c.train(private, ingredients)
+	return nil
+}
+
+func (c *centroidClassifier) train(private []int64, ingredients []Ingredient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reset(private)
+	c.add(ingredients, 1)
+}
+
+func (c *centroidClassifier) Update(db *gorp.DbMap, removed []Ingredient, added []Ingredient) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.add(removed, -1)
+	c.add(added, 1)
+	return nil
+}
+
+func (c *centroidClassifier) SetPrivate(familyId int64, private bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.private[familyId] == private {
+		return
+	}
+
+	sign := int64(1)
+	if private {
+		c.private[familyId] = true
+		sign = -1
+	} else {
+		delete(c.private, familyId)
+	}
+
+	counts := c.families[familyId]
+	if counts == nil {
+		return
+	}
+
+	for class_id, docs := range counts.docs {
+		c.shared.add(class_id, counts.terms[class_id], docs, sign)
+	}
+}
+
+func (c *centroidClassifier) Forget(db *gorp.DbMap, familyId int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.families, familyId)
+	delete(c.private, familyId)
+	return nil
+}
+
+func (c *centroidClassifier) idf(term string) float64 {
+	return math.Log(float64(1+c.total)/float64(1+c.df[term])) + 1
+}
+
+// score returns the cosine similarity of the ingredient with each class's
+// centroid, and what each n-gram contributed to it. The caller must hold the
+// read lock.
+func (c *centroidClassifier) score(familyId int64, name string, amount string) ([]string, map[int64]float64, map[int64]map[string]float64) {
+	family := c.families[familyId]
+	if family == nil {
+		family = newCentroidCounts()
+	}
+
+	// N-grams that were never seen carry no information and are skipped.
+	query := make(map[string]float64)
+	terms := []string{}
+	norm := 0.0
+	for term, value := range termVector(name, amount) {
+		if c.df[term] > 0 {
+			query[term] = value * c.idf(term)
+			terms = append(terms, term)
+			norm += query[term] * query[term]
+		}
+	}
+	norm = math.Sqrt(norm)
+	sort.Strings(terms)
+
+	classes := make(map[int64]bool)
+	for class_id := range c.shared.docs {
+		classes[class_id] = true
+	}
+	for class_id := range family.docs {
+		classes[class_id] = true
+	}
+
+	scores := make(map[int64]float64)
+	contributions := make(map[int64]map[string]float64)
+	if norm == 0 {
+		return terms, scores, contributions
+	}
+
+	for class_id := range classes {
+		weight := 0.0
+		if c.shared.docs[class_id] > 0 {
+			weight = FamilyPriorWeight / float64(c.shared.docs[class_id])
+		}
+
+		shared := c.shared.terms[class_id]
+		own := family.terms[class_id]
+
+		centroid := func(term string) float64 {
+			return c.idf(term) * (weight*shared[term] + own[term])
+		}
+
+		length := 0.0
+		for term := range shared {
+			length += centroid(term) * centroid(term)
+		}
+		for term := range own {
+			if _, ok := shared[term]; !ok {
+				length += centroid(term) * centroid(term)
+			}
+		}
+		length = math.Sqrt(length)
+
+		if length == 0 {
+			continue
+		}
+
+		contributions[class_id] = make(map[string]float64)
+		for term, value := range query {
+			contribution := value * centroid(term) / (norm * length)
+			contributions[class_id][term] = contribution
+			scores[class_id] += contribution
+		}
+	}
+
+	return terms, scores, contributions
+}
+
+func (c *centroidClassifier) Classify(familyId int64, name string, amount string) int64 {
+	best, margin := c.rank(familyId, name, amount)
+	return certain(best, margin, c.threshold())
+}
+
+func (c *centroidClassifier) rank(familyId int64, name string, amount string) (int64, float64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, scores, _ := c.score(familyId, name, amount)
+	return bestClass(scores)
+}
+
+func (c *centroidClassifier) threshold() float64 {
+	return CentroidThreshold
+}
+
+// Explain gives the cosine similarity with each class's centroid and the
+// share of it that each n-gram contributed.
+func (c *centroidClassifier) Explain(familyId int64, name string, amount string, top int) *Explanation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	terms, scores, contributions := c.score(familyId, name, amount)
+
+	explanation := newExplanation(ClassifierCentroid, terms)
+
+	best, margin := bestClass(scores)
+	explanation.ClassId = certain(best, margin, c.threshold())
+
+	for class_id, score := range scores {
+		class := ClassExplanation{
+			ClassId:  class_id,
+			Score:    score,
+			Features: []FeatureContribution{},
+		}
+
+		for term, contribution := range contributions[class_id] {
+			if contribution > 0 {
+				class.Features = append(class.Features, FeatureContribution{
+					Feature:      term,
+					Contribution: contribution,
+				})
+			}
+		}
+
+		explanation.Classes = append(explanation.Classes, class)
+	}
+
+	explanation.finish(top)
+	return explanation
+}
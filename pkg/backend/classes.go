@@ -0,0 +1,408 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Ingredient classes are shared by all families, so only administrators can
+// change them. Classes form a hierarchy through ParentId, for example
+// Produce > Fruit.
+
+type mergeClassRequest struct {
+	Into int64 `json:"into"`
+}
+
+// classTree indexes the classes by id for walking the hierarchy.
+type classTree map[int64]*IngredientClass
+
+func selectClasses(db gorp.SqlExecutor) ([]IngredientClass, error) {
+	classes := []IngredientClass{}
+	_, err := db.Select(&classes, "SELECT * FROM ingclasses ORDER BY name")
+	return classes, err
+}
+
+func selectClassTree(db gorp.SqlExecutor) (classTree, error) {
+	classes, err := selectClasses(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make(classTree)
+	for i := range classes {
+		tree[classes[i].Id] = &classes[i]
+	}
+	return tree, nil
+}
+
+// ancestors returns the class and its ancestors, starting with the class.
+// A broken chain stops at the last class that exists.
+func (tree classTree) ancestors(id int64) []*IngredientClass {
+	chain := []*IngredientClass{}
+	seen := make(map[int64]bool)
+	for {
+		class, ok := tree[id]
+		if !ok || seen[id] {
+			return chain
+		}
+
+		seen[id] = true
+		chain = append(chain, class)
+
+		if !class.ParentId.Valid {
+			return chain
+		}
+		id = class.ParentId.Int64
+	}
+}
+
+// topLevel returns the class's top-level ancestor, or the class itself.
+func (tree classTree) topLevel(id int64) *IngredientClass {
+	chain := tree.ancestors(id)
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[len(chain)-1]
+}
+
+// path names the class with all its ancestors, as in "Produce > Fruit".
+func (tree classTree) path(id int64) string {
+	chain := tree.ancestors(id)
+	names := make([]string, len(chain))
+	for i, class := range chain {
+		names[len(chain)-1-i] = class.Name
+	}
+	return strings.Join(names, " > ")
+}
+
+// isDescendant tells whether the class is the ancestor itself or below it.
+func (tree classTree) isDescendant(id int64, ancestor int64) bool {
+	for _, class := range tree.ancestors(id) {
+		if class.Id == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+func getClassParam(db gorp.SqlExecutor, params martini.Params) (*IngredientClass, int) {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+
+	result, err := db.Get(IngredientClass{}, id)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusInternalServerError
+	} else if result == nil {
+		return nil, http.StatusNotFound
+	}
+
+	return result.(*IngredientClass), http.StatusOK
+}
+
+// validateClass checks that the name is given and unused and that the parent
+// exists and would not make a cycle.
+func validateClass(db gorp.SqlExecutor, class *IngredientClass) (int, error) {
+	class.Name = strings.TrimSpace(class.Name)
+	if class.Name == "" {
+		return http.StatusBadRequest, nil
+	}
+
+	count, err := db.SelectInt(
+		"SELECT COUNT(*) FROM ingclasses WHERE LOWER(name)=LOWER(?) AND id!=?",
+		class.Name, class.Id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if count > 0 {
+		return http.StatusConflict, nil
+	}
+
+	if class.ParentId.Valid {
+		tree, err := selectClassTree(db)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		_, ok := tree[class.ParentId.Int64]
+		if !ok || (class.Id != 0 && tree.isDescendant(class.ParentId.Int64, class.Id)) {
+			return http.StatusBadRequest, nil
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// reassignClass moves all ingredients and store aisles of the class to
+// another class (or none) and the class's children to a new parent, then
+// deletes the class.
+// The classifier is retrained with the moved ingredients.
+func reassignClass(db *gorp.DbMap, class *IngredientClass, target null.Int, parent null.Int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	moved := []Ingredient{}
+	_, err = tx.Select(&moved, "SELECT * FROM ingredients WHERE class_id=?", class.Id)
+
+	var tree classTree
+	if err == nil {
+		tree, err = selectClassTree(tx)
+	}
+
+	// A target below the class moves up first, so that it does not end up
+	// below itself.
+	if err == nil && target.Valid && tree.isDescendant(target.Int64, class.Id) {
+		_, err = tx.Exec("UPDATE ingclasses SET parent_id=? WHERE id=?",
+			class.ParentId, target)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("UPDATE ingredients SET class_id=? WHERE class_id=?", target, class.Id)
+	}
+
+	// The target, if it is a child, does not become its own parent.
+	if err == nil && target.Valid {
+		_, err = tx.Exec("UPDATE ingclasses SET parent_id=? WHERE parent_id=? AND id<>?",
+			parent, class.Id, target)
+	} else if err == nil {
+		_, err = tx.Exec("UPDATE ingclasses SET parent_id=? WHERE parent_id=?",
+			parent, class.Id)
+	}
+
+	// Stores keep the class's aisle for the target, unless they have one for
+	// it already.
+	if err == nil && target.Valid {
+		_, err = tx.Exec(
+			"UPDATE storeaisles SET class_id=? WHERE class_id=? AND "+
+				"store_id NOT IN (SELECT store_id FROM storeaisles WHERE class_id=?)",
+			target, class.Id, target)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM storeaisles WHERE class_id=?", class.Id)
+	}
+
+	if err == nil {
+		_, err = tx.Delete(class)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	added := make([]Ingredient, len(moved))
+	for i, ingredient := range moved {
+		ingredient.ClassId = target
+		added[i] = ingredient
+	}
+
+	err = Classifier.Update(db, moved, added)
+	if err != nil {
+		logError(err)
+	}
+
+	return nil
+}
+
+func ListClasses(db *gorp.DbMap, ren render.Render) {
+	classes, err := selectClasses(db)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, classes)
+}
+
+func GetClass(db *gorp.DbMap, params martini.Params, ren render.Render) {
+	class, status := getClassParam(db, params)
+	if class == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, class)
+}
+
+func CreateClass(db *gorp.DbMap, req *http.Request, ren render.Render) {
+	class := IngredientClass{}
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&class)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// No messing around with protected fields.
+	class.Id = 0
+
+	status, err := validateClass(db, &class)
+	if err != nil {
+		logError(err)
+	}
+	if status != http.StatusOK {
+		ren.JSON(status, nil)
+		return
+	}
+
+	err = db.Insert(&class)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, class)
+}
+
+// UpdateClass renames the class or moves it to another parent.
+func UpdateClass(db *gorp.DbMap, params martini.Params, req *http.Request, ren render.Render) {
+	class, status := getClassParam(db, params)
+	if class == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	id := class.Id
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(class)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// No messing around with protected fields.
+	class.Id = id
+
+	status, err = validateClass(db, class)
+	if err != nil {
+		logError(err)
+	}
+	if status != http.StatusOK {
+		ren.JSON(status, nil)
+		return
+	}
+
+	_, err = db.Update(class)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, class)
+}
+
+// MergeClasses moves the ingredients and children of the class into another
+// class and deletes it.
+func MergeClasses(db *gorp.DbMap, params martini.Params, req *http.Request, ren render.Render) {
+	class, status := getClassParam(db, params)
+	if class == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	request := mergeClassRequest{}
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&request)
+	if err != nil || request.Into == class.Id {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	result, err := db.Get(IngredientClass{}, request.Into)
+	if err != nil || result == nil {
+		logError(err)
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	into := result.(*IngredientClass)
+
+	err = reassignClass(db, class, null.IntFrom(into.Id), null.IntFrom(into.Id))
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	result, err = db.Get(IngredientClass{}, into.Id)
+	if err != nil || result == nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, result)
+}
+
+// DeleteClass deletes the class and moves its children up to its parent. If
+// any ingredients have the class, the class to give them instead must be
+// passed as the target query parameter, or "none" to leave them without one.
+func DeleteClass(db *gorp.DbMap, params martini.Params, req *http.Request, ren render.Render) {
+	class, status := getClassParam(db, params)
+	if class == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	target := null.Int{}
+
+	switch value := req.URL.Query().Get("target"); value {
+	case "":
+		count, err := db.SelectInt(
+			"SELECT COUNT(*) FROM ingredients WHERE class_id=?", class.Id)
+		if err != nil {
+			logError(err)
+			ren.JSON(http.StatusInternalServerError, nil)
+			return
+		} else if count > 0 {
+			ren.JSON(http.StatusConflict, nil)
+			return
+		}
+	case "none":
+	default:
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id == class.Id {
+			ren.JSON(http.StatusBadRequest, nil)
+			return
+		}
+
+		result, err := db.Get(IngredientClass{}, id)
+		if err != nil || result == nil {
+			logError(err)
+			ren.JSON(http.StatusBadRequest, nil)
+			return
+		}
+
+		target = null.IntFrom(id)
+	}
+
+	err := reassignClass(db, class, target, class.ParentId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, nil)
+}
@@ -1,23 +1,121 @@
 package backend
 
 import (
+	"fmt"
 	"math"
 	"regexp"
+	"sort"
 	"strings"
 
 	"gopkg.in/gorp.v2"
 )
 
-type classifier struct {
-	classes      []int64
-	classProbs   map[int64]float64
-	featureProbs map[int64]map[string]float64
+// Classifier strategies, selected with the classifier.strategy setting.
+const (
+	ClassifierBayes      = "bayes"
+	ClassifierCentroid   = "centroid"
+	ClassifierDictionary = "dictionary"
+	ClassifierEnsemble   = "ensemble"
+)
+
+// IngredientClassifier suggests a class for ingredients that have none yet.
+// Implementations keep a model for every family on top of a shared model of
+// the families that did not set Family.PrivateClassifier, and must be safe
+// for concurrent use.
+type IngredientClassifier interface {
+	// Load builds the model on startup.
+	Load(db *gorp.DbMap) error
+
+	// Update learns from ingredients being labeled, relabeled, renamed or
+	// deleted. removed holds the ingredients as they were before the change
+	// and added as they are now; unlabeled ingredients are ignored.
+	Update(db *gorp.DbMap, removed []Ingredient, added []Ingredient) error
+
+	// SetPrivate takes a family's labels out of the shared model, or puts
+	// them back in.
+	SetPrivate(familyId int64, private bool)
+
+	// Forget drops what is left of a deleted family's model. Its labeled
+	// ingredients must have been removed with Update before.
+	Forget(db *gorp.DbMap, familyId int64) error
+
+	// Classify returns the class for the family's ingredient, or -1 if no
+	// class is likely enough.
+	Classify(familyId int64, name string, amount string) int64
+
+	// Explain shows how Classify arrives at its answer, with the top classes.
+	Explain(familyId int64, name string, amount string, top int) *Explanation
+
+	// train builds the model from the given ingredients in memory, for the
+	// evaluation.
+	train(private []int64, ingredients []Ingredient)
+
+	// rank returns the best class and its margin over the runner-up, which
+	// Classify compares with threshold.
+	rank(familyId int64, name string, amount string) (int64, float64)
+	threshold() float64
 }
 
-const (
+func NewIngredientClassifier(strategy string) (IngredientClassifier, error) {
+	switch strategy {
+	case ClassifierBayes:
+		return newBayesClassifier(), nil
+	case ClassifierCentroid:
+		return newCentroidClassifier(), nil
+	case ClassifierDictionary:
+		return newDictionaryClassifier(), nil
+	case ClassifierEnsemble:
+		return newEnsembleClassifier(), nil
+	default:
+		return nil, fmt.Errorf("unknown classifier strategy %q", strategy)
+	}
+}
+
+// LoadClassifier creates the classifier for the strategy and loads it.
+func LoadClassifier(db *gorp.DbMap, strategy string) (IngredientClassifier, error) {
+	classifier, err := NewIngredientClassifier(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the naive Bayes model keeps its counts in the database, and the
+	// other strategies do not update them. Dropping them has them rebuilt
+	// when switching back.
+	if strategy == ClassifierCentroid || strategy == ClassifierDictionary {
+		_, err = db.Exec("DELETE FROM classifierclasses")
+		if err == nil {
+			_, err = db.Exec("DELETE FROM classifierfeatures")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = classifier.Load(db)
+	return classifier, err
+}
+
+// These are variables so that the evaluate-classifier command can try other
+// values. The stored counts depend on SplitThreshold, so the server always
+// runs with the defaults.
+var (
 	CertaintyThreshold float64 = 0.25
 	SplitThreshold     int     = 6
 	RegularizationTerm float64 = 0.01
+
+	// Margins that the best class needs over the runner-up with the centroid
+	// (in cosine similarity) and dictionary (in similarity-weighted share of
+	// labels) classifiers.
+	CentroidThreshold   float64 = 0.05
+	DictionaryThreshold float64 = 0.2
+
+	// Names less similar than this are not considered by the dictionary.
+	DictionaryMinSimilarity float64 = 0.5
+
+	// FamilyPriorWeight is how many observations the shared model is worth
+	// when it is combined with a family's own counts. Once a family has
+	// labeled a few ingredients of a class, its own labels dominate.
+	FamilyPriorWeight float64 = 10
 )
 
 var SplitPattern = regexp.MustCompile(`[\t\n\v\f\r /\-\(\)]+`)
@@ -60,93 +158,156 @@ func extractFeatures(name string, amount string) []string {
 	return result
 }
 
-func NewClassifier() *classifier {
-	return &classifier{
-		classes:      make([]int64, 0),
-		classProbs:   make(map[int64]float64),
-		featureProbs: make(map[int64]map[string]float64),
+// normalizeName makes names that differ only in case and spacing equal.
+func normalizeName(name string) string {
+	words := []string{}
+	for _, w := range SplitPattern.Split(strings.ToLower(name), -1) {
+		if w != "" {
+			words = append(words, w)
+		}
 	}
+	return strings.Join(words, " ")
 }
 
-func (c *classifier) Train(db *gorp.DbMap) {
-	ingredients := []Ingredient{}
+// characterNgrams returns the sequences of two and three characters in the
+// normalized name, including the start and end. Working on characters rather
+// than words copes with compound words, typos and scripts that do not
+// separate words.
+func characterNgrams(name string) []string {
+	runes := []rune(" " + normalizeName(name) + " ")
 
-	_, err := db.Select(&ingredients, "SELECT * FROM ingredients WHERE class_id IS NOT NULL")
-	if err != nil {
-		panic(err)
+	grams := []string{}
+	for n := 2; n <= 3; n++ {
+		for i := 0; i+n <= len(runes); i++ {
+			gram := string(runes[i : i+n])
+			if strings.TrimSpace(gram) != "" {
+				grams = append(grams, gram)
+			}
+		}
 	}
+	return grams
+}
 
-	allFeatures := make(map[string]int64)
-	classCounts := make(map[int64]int64)
-	classFeatures := make(map[int64]map[string]float64)
-	classNumFeatures := make(map[int64]float64)
-
-	// Count the occurence of features under different classes.
-	for _, ingredient := range ingredients {
-		words := extractFeatures(ingredient.Name, ingredient.Amount.String)
-		class_id := ingredient.ClassId.Int64
-
-		classCounts[class_id] += 1
+func selectPrivateFamilies(db gorp.SqlExecutor) ([]int64, error) {
+	private := []int64{}
+	_, err := db.Select(&private, "SELECT id FROM families WHERE private_classifier=?", true)
+	return private, err
+}
 
-		for _, feature := range words {
-			if classFeatures[class_id] == nil {
-				classFeatures[class_id] = make(map[string]float64)
-			}
-			classFeatures[class_id][feature] += 1
-			classNumFeatures[class_id] += 1
+func selectLabeledIngredients(db gorp.SqlExecutor) ([]Ingredient, error) {
+	ingredients := []Ingredient{}
+	_, err := db.Select(&ingredients, "SELECT * FROM ingredients WHERE class_id IS NOT NULL")
+	return ingredients, err
+}
 
-			allFeatures[feature] += 1
+// bestClass returns the class with the highest score and the margin to the
+// runner-up. The margin is infinite if there is only one class. Ties go to
+// the lower class id, so that the result does not depend on map order.
+func bestClass(scores map[int64]float64) (int64, float64) {
+	var best int64 = -1
+	alpha := math.Inf(-1)
+	beta := math.Inf(-1)
+	for class_id, score := range scores {
+		if score > alpha || (score == alpha && class_id < best) {
+			beta = alpha
+			alpha = score
+			best = class_id
+		} else if score >= beta {
+			beta = score
 		}
 	}
 
-	// Add 1 for every feature to prevent zero probabilities.
-	for feature, _ := range allFeatures {
-		for class_id, _ := range classFeatures {
-			classFeatures[class_id][feature] += RegularizationTerm
-			classNumFeatures[class_id] += RegularizationTerm
-		}
+	return best, alpha - beta
+}
+
+// certain returns the class if its margin reaches the threshold, and -1
+// otherwise.
+func certain(class_id int64, margin float64, threshold float64) int64 {
+	if class_id == -1 || margin < threshold {
+		return -1
 	}
+	return class_id
+}
 
-	// Now calculate the log probabilities.
-	for class_id, count := range classCounts {
-		c.classProbs[class_id] = math.Log(float64(count) / float64(len(ingredients)))
+// maxExplainedFeatures limits the features and matches listed per class by
+// Explain.
+const maxExplainedFeatures = 10
 
-		c.featureProbs[class_id] = make(map[string]float64)
-		for feature, fcount := range classFeatures[class_id] {
-			c.featureProbs[class_id][feature] = math.Log(float64(fcount) / float64(classNumFeatures[class_id]))
-		}
+// FeatureContribution is how much a feature speaks for a class. The naive
+// Bayes classifier also gives the feature's log-probability under the class.
+type FeatureContribution struct {
+	Feature      string  `json:"feature"`
+	Contribution float64 `json:"contribution"`
+	LogProb      float64 `json:"log_prob,omitempty"`
+}
+
+// DictionaryMatch is a previously labeled name that the dictionary matched.
+type DictionaryMatch struct {
+	Name       string  `json:"name"`
+	Similarity float64 `json:"similarity"`
+	Family     bool    `json:"family"` // Labeled by the family itself
+}
+
+// ClassExplanation holds a class's score, which is a log-probability for the
+// naive Bayes classifier, a cosine similarity for the centroid classifier
+// and a similarity-weighted share of the labels for the dictionary.
+type ClassExplanation struct {
+	ClassId  int64                 `json:"class_id"`
+	Class    string                `json:"class"`
+	Score    float64               `json:"score"`
+	LogProb  float64               `json:"log_prob,omitempty"`
+	Prior    float64               `json:"prior,omitempty"`
+	Features []FeatureContribution `json:"features"`
+	Matches  []DictionaryMatch     `json:"matches,omitempty"`
+}
+
+// Explanation shows how Classify arrives at its answer. ClassId is what
+// Classify returns, and Classes holds the most likely classes, best first.
+type Explanation struct {
+	Classifier string             `json:"classifier"`
+	Features   []string           `json:"features"`
+	ClassId    int64              `json:"class_id"`
+	Classes    []ClassExplanation `json:"classes"`
+}
+
+func newExplanation(classifier string, features []string) *Explanation {
+	return &Explanation{
+		Classifier: classifier,
+		Features:   features,
+		ClassId:    -1,
+		Classes:    []ClassExplanation{},
 	}
 }
 
-func (c *classifier) Classify(name string, amount string) int64 {
-	probs := make(map[int64]float64)
-	for k, v := range c.classProbs {
-		probs[k] = v
+// finish sorts the classes and their features and matches, strongest first,
+// and keeps the top ones.
+func (e *Explanation) finish(top int) {
+	for _, class := range e.Classes {
+		features := class.Features
+		sort.Slice(features, func(i, j int) bool {
+			return features[i].Contribution > features[j].Contribution
+		})
 	}
 
-	features := extractFeatures(name, amount)
-	for _, feature := range features {
-		for class_id, _ := range probs {
-			probs[class_id] += c.featureProbs[class_id][feature]
-		}
+	sort.Slice(e.Classes, func(i, j int) bool {
+		return e.Classes[i].Score > e.Classes[j].Score
+	})
+
+	if len(e.Classes) > top {
+		e.Classes = e.Classes[:top]
 	}
 
-	var best int64
-	probAlpha := math.Inf(-1)
-	probBeta := math.Inf(-1)
-	for class_id, logp := range probs {
-		if logp >= probAlpha {
-			probBeta = probAlpha
-			probAlpha = logp
-			best = class_id
-		} else if logp >= probBeta {
-			probBeta = logp
+	for i := range e.Classes {
+		if len(e.Classes[i].Features) > maxExplainedFeatures {
+			e.Classes[i].Features = e.Classes[i].Features[:maxExplainedFeatures]
 		}
-	}
 
-	if probAlpha-probBeta < CertaintyThreshold {
-		return -1
-	} else {
-		return best
+		matches := e.Classes[i].Matches
+		sort.Slice(matches, func(i, j int) bool {
+			return matches[i].Similarity > matches[j].Similarity
+		})
+		if len(matches) > maxExplainedFeatures {
+			e.Classes[i].Matches = matches[:maxExplainedFeatures]
+		}
 	}
 }
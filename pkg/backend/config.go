@@ -0,0 +1,286 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type DatabaseConfig struct {
+	Driver string `json:"driver"`
+	Source string `json:"source"`
+}
+
+type ServerConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	// BaseURL is used to build links in emails, e.g. https://example.com.
+	BaseURL string `json:"base_url"`
+
+	// SessionSecret signs the session cookies. If it is left empty, the
+	// secret is read from SessionSecretFile, which is created with a random
+	// secret on the first start.
+	SessionSecret     string `json:"session_secret"`
+	SessionSecretFile string `json:"session_secret_file"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type EmailConfig struct {
+	// Backend is one of "ses", "smtp" or "file".
+	Backend string `json:"backend"`
+	Sender  string `json:"sender"`
+
+	// Region is the AWS region used by the SES backend.
+	Region string `json:"region"`
+
+	SMTP SMTPConfig `json:"smtp"`
+
+	// Directory receives the .eml files written by the file backend.
+	Directory string `json:"directory"`
+}
+
+type ClassifierConfig struct {
+	// Strategy is one of "bayes", "centroid", "dictionary" or "ensemble".
+	Strategy string `json:"strategy"`
+}
+
+type ImportConfig struct {
+	// FetchURLs lets the server download recipe pages by their URL. It is
+	// off by default, because every editor can then make the server send
+	// requests. Addresses that are not public, like localhost, private
+	// networks and 169.254.169.254, are refused even after a redirect, but
+	// anything the server can reach on the internet is not.
+	FetchURLs bool `json:"fetch_urls"`
+}
+
+type Config struct {
+	Database   DatabaseConfig   `json:"database"`
+	Server     ServerConfig     `json:"server"`
+	Email      EmailConfig      `json:"email"`
+	Classifier ClassifierConfig `json:"classifier"`
+	Import     ImportConfig     `json:"import"`
+}
+
+const minSessionSecretLength = 32
+
+func DefaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Driver: DriverSqlite,
+			Source: "mealplanner.db",
+		},
+		Server: ServerConfig{
+			Port:              3000,
+			BaseURL:           "http://localhost:3000",
+			SessionSecretFile: "session_secret",
+		},
+		Email: EmailConfig{
+			Backend:   MailerSES,
+			Sender:    "no-reply@example.com",
+			Region:    "us-east-1",
+			SMTP:      SMTPConfig{Port: 587},
+			Directory: "mail",
+		},
+		Classifier: ClassifierConfig{
+			Strategy: ClassifierBayes,
+		},
+	}
+}
+
+// LoadConfig reads the JSON configuration file at path, if path is not empty,
+// applies MEALPLANNER_* environment variable overrides on top of it and
+// validates the result.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return config, err
+		}
+		defer file.Close()
+
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+		if err != nil {
+			return config, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	err := config.applyEnv()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.Validate()
+	return config, err
+}
+
+func (config *Config) applyEnv() error {
+	overrides := map[string]*string{
+		"MEALPLANNER_DB_DRIVER":           &config.Database.Driver,
+		"MEALPLANNER_DB_SOURCE":           &config.Database.Source,
+		"MEALPLANNER_HOST":                &config.Server.Host,
+		"MEALPLANNER_BASE_URL":            &config.Server.BaseURL,
+		"MEALPLANNER_SESSION_SECRET":      &config.Server.SessionSecret,
+		"MEALPLANNER_SESSION_SECRET_FILE": &config.Server.SessionSecretFile,
+		"MEALPLANNER_EMAIL_BACKEND":       &config.Email.Backend,
+		"MEALPLANNER_EMAIL_SENDER":        &config.Email.Sender,
+		"MEALPLANNER_EMAIL_REGION":        &config.Email.Region,
+		"MEALPLANNER_EMAIL_DIRECTORY":     &config.Email.Directory,
+		"MEALPLANNER_SMTP_HOST":           &config.Email.SMTP.Host,
+		"MEALPLANNER_SMTP_USERNAME":       &config.Email.SMTP.Username,
+		"MEALPLANNER_SMTP_PASSWORD":       &config.Email.SMTP.Password,
+		"MEALPLANNER_CLASSIFIER":          &config.Classifier.Strategy,
+	}
+
+	for key, field := range overrides {
+		if value, ok := os.LookupEnv(key); ok {
+			*field = value
+		}
+	}
+
+	ports := map[string]*int{
+		"MEALPLANNER_PORT":      &config.Server.Port,
+		"MEALPLANNER_SMTP_PORT": &config.Email.SMTP.Port,
+	}
+
+	for key, field := range ports {
+		if value, ok := os.LookupEnv(key); ok {
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			*field = port
+		}
+	}
+
+	flags := map[string]*bool{
+		"MEALPLANNER_IMPORT_FETCH_URLS": &config.Import.FetchURLs,
+	}
+
+	for key, field := range flags {
+		if value, ok := os.LookupEnv(key); ok {
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			*field = flag
+		}
+	}
+
+	return nil
+}
+
+func (config *Config) Validate() error {
+	switch config.Database.Driver {
+	case DriverSqlite, DriverPostgres:
+	default:
+		return fmt.Errorf("database.driver must be %q or %q, not %q",
+			DriverSqlite, DriverPostgres, config.Database.Driver)
+	}
+
+	if config.Database.Source == "" {
+		return fmt.Errorf("database.source must not be empty")
+	}
+
+	if config.Server.Port <= 0 || config.Server.Port > 65535 {
+		return fmt.Errorf("server.port %d is out of range", config.Server.Port)
+	}
+
+	base, err := url.Parse(config.Server.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("server.base_url %q must be an absolute http or https URL", config.Server.BaseURL)
+	}
+	config.Server.BaseURL = strings.TrimRight(config.Server.BaseURL, "/")
+
+	if config.Server.SessionSecret != "" && len(config.Server.SessionSecret) < minSessionSecretLength {
+		return fmt.Errorf("server.session_secret must be at least %d characters", minSessionSecretLength)
+	}
+
+	if config.Server.SessionSecret == "" && config.Server.SessionSecretFile == "" {
+		return fmt.Errorf("server.session_secret_file must not be empty without server.session_secret")
+	}
+
+	if config.Email.Sender == "" {
+		return fmt.Errorf("email.sender must not be empty")
+	}
+
+	switch config.Email.Backend {
+	case MailerSES:
+		if config.Email.Region == "" {
+			return fmt.Errorf("email.region must not be empty for the ses backend")
+		}
+	case MailerSMTP:
+		if config.Email.SMTP.Host == "" {
+			return fmt.Errorf("email.smtp.host must not be empty for the smtp backend")
+		}
+		if config.Email.SMTP.Port <= 0 || config.Email.SMTP.Port > 65535 {
+			return fmt.Errorf("email.smtp.port %d is out of range", config.Email.SMTP.Port)
+		}
+	case MailerFile:
+		if config.Email.Directory == "" {
+			return fmt.Errorf("email.directory must not be empty for the file backend")
+		}
+	default:
+		return fmt.Errorf("email.backend must be %q, %q or %q, not %q",
+			MailerSES, MailerSMTP, MailerFile, config.Email.Backend)
+	}
+
+	switch config.Classifier.Strategy {
+	case ClassifierBayes, ClassifierCentroid, ClassifierDictionary, ClassifierEnsemble:
+	default:
+		return fmt.Errorf("classifier.strategy must be %q, %q, %q or %q, not %q",
+			ClassifierBayes, ClassifierCentroid, ClassifierDictionary, ClassifierEnsemble,
+			config.Classifier.Strategy)
+	}
+
+	return nil
+}
+
+// Addr returns the listen address in host:port form.
+func (config *ServerConfig) Addr() string {
+	return fmt.Sprintf("%s:%d", config.Host, config.Port)
+}
+
+// sessionKey returns the secret that signs the session cookies. Without a
+// configured secret, the one stored in SessionSecretFile is used, so that
+// sessions survive a restart. The file is created on the first start.
+func (config *ServerConfig) sessionKey() ([]byte, error) {
+	if config.SessionSecret != "" {
+		return []byte(config.SessionSecret), nil
+	}
+
+	data, err := ioutil.ReadFile(config.SessionSecretFile)
+	if os.IsNotExist(err) {
+		secret := randomHex(minSessionSecretLength)
+		err = ioutil.WriteFile(config.SessionSecretFile, []byte(secret+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Println("Generated a session secret in " + config.SessionSecretFile)
+		return []byte(secret), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if len(secret) < minSessionSecretLength {
+		return nil, fmt.Errorf("%s: the session secret must be at least %d characters",
+			config.SessionSecretFile, minSessionSecretLength)
+	}
+	return []byte(secret), nil
+}
@@ -0,0 +1,304 @@
+package backend
+
+import (
+	"sync"
+
+	"gopkg.in/gorp.v2"
+)
+
+// dictionaryEntries counts how often each normalized name was labeled with
+// each class.
+type dictionaryEntries map[string]map[int64]int64
+
+func (e dictionaryEntries) add(name string, class_id int64, count int64) {
+	if e[name] == nil {
+		e[name] = make(map[int64]int64)
+	}
+
+	e[name][class_id] += count
+	if e[name][class_id] <= 0 {
+		delete(e[name], class_id)
+	}
+	if len(e[name]) == 0 {
+		delete(e, name)
+	}
+}
+
+// dictionaryClassifier looks up the classes that ingredients with the same
+// name were given before. Without an exact match, it falls back to the most
+// similar names, comparing their sets of character n-grams. The family's
+// own labels are searched before the shared ones.
+//
+// The dictionary is built from the ingredients on startup and kept up to
+// date in memory.
+type dictionaryClassifier struct {
+	lock sync.RWMutex
+
+	shared   dictionaryEntries
+	families map[int64]dictionaryEntries
+	private  map[int64]bool
+}
+
+func newDictionaryClassifier() *dictionaryClassifier {
+	return &dictionaryClassifier{
+		shared:   make(dictionaryEntries),
+		families: make(map[int64]dictionaryEntries),
+		private:  make(map[int64]bool),
+	}
+}
+
+// reset clears the dictionary. The caller must hold the write lock.
+func (d *dictionaryClassifier) reset(private []int64) {
+	d.shared = make(dictionaryEntries)
+	d.families = make(map[int64]dictionaryEntries)
+	d.private = make(map[int64]bool)
+	for _, familyId := range private {
+		d.private[familyId] = true
+	}
+}
+
+// add adds (sign 1) or removes (sign -1) the labeled ingredients. The caller
+// must hold the write lock.
+func (d *dictionaryClassifier) add(ingredients []Ingredient, sign int64) {
+	for _, ingredient := range ingredients {
+		name := normalizeName(ingredient.Name)
+		if !ingredient.ClassId.Valid || name == "" {
+			continue
+		}
+
+		familyId := ingredient.OwnerId
+		if d.families[familyId] == nil {
+			d.families[familyId] = make(dictionaryEntries)
+		}
+		d.families[familyId].add(name, ingredient.ClassId.Int64, sign)
+
+		if !d.private[familyId] {
+			d.shared.add(name, ingredient.ClassId.Int64, sign)
+		}
+	}
+}
+
+func (d *dictionaryClassifier) Load(db *gorp.DbMap) error {
+	ingredients, err := selectLabeledIngredients(db)
+	if err != nil {
+		return err
+	}
+
+	private, err := selectPrivateFamilies(db)
+	if err != nil {
+		return err
+	}
+
+	d.train(private, ingredients)
+	return nil
+}
+
+func (d *dictionaryClassifier) train(private []int64, ingredients []Ingredient) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.reset(private)
+	d.add(ingredients, 1)
+}
+
+func (d *dictionaryClassifier) Update(db *gorp.DbMap, removed []Ingredient, added []Ingredient) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.add(removed, -1)
+	d.add(added, 1)
+	return nil
+}
+
+func (d *dictionaryClassifier) SetPrivate(familyId int64, private bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.private[familyId] == private {
+		return
+	}
+
+	sign := int64(1)
+	if private {
+		d.private[familyId] = true
+		sign = -1
+	} else {
+		delete(d.private, familyId)
+	}
+
+	for name, classes := range d.families[familyId] {
+		for class_id, count := range classes {
+			d.shared.add(name, class_id, sign*count)
+		}
+	}
+}
+
+func (d *dictionaryClassifier) Forget(db *gorp.DbMap, familyId int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.families, familyId)
+	delete(d.private, familyId)
+	return nil
+}
+
+// dictionaryResult is what the dictionary found for a name: a score for each
+// class and the entries that support it.
+type dictionaryResult struct {
+	exact   bool
+	scores  map[int64]float64
+	matches map[int64][]DictionaryMatch
+}
+
+func (r *dictionaryResult) match(entry string, classes map[int64]int64, similarity float64, family bool) {
+	var total int64
+	for _, count := range classes {
+		total += count
+	}
+
+	for class_id, count := range classes {
+		score := similarity * float64(count) / float64(total)
+		if score > r.scores[class_id] {
+			r.scores[class_id] = score
+		}
+
+		r.matches[class_id] = append(r.matches[class_id], DictionaryMatch{
+			Name:       entry,
+			Similarity: similarity,
+			Family:     family,
+		})
+	}
+}
+
+// best returns the best class and its margin over the runner-up. Unlike the
+// models, a single candidate is only as certain as its score.
+func (r *dictionaryResult) best() (int64, float64) {
+	best, margin := bestClass(r.scores)
+	if len(r.scores) == 1 {
+		margin = r.scores[best]
+	}
+	return best, margin
+}
+
+func ngramSet(name string) map[string]bool {
+	set := make(map[string]bool)
+	for _, gram := range characterNgrams(name) {
+		set[gram] = true
+	}
+	return set
+}
+
+// similarity is the Dice coefficient of two n-gram sets.
+func similarity(a map[string]bool, b map[string]bool) float64 {
+	if len(a)+len(b) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for gram := range a {
+		if b[gram] {
+			shared++
+		}
+	}
+	return 2 * float64(shared) / float64(len(a)+len(b))
+}
+
+// lookup searches the family's entries and then the shared ones, first for
+// the exact name and then for similar names. The caller must hold the read
+// lock.
+func (d *dictionaryClassifier) lookup(familyId int64, name string) *dictionaryResult {
+	result := &dictionaryResult{
+		scores:  make(map[int64]float64),
+		matches: make(map[int64][]DictionaryMatch),
+	}
+
+	key := normalizeName(name)
+	if key == "" {
+		return result
+	}
+
+	layers := []dictionaryEntries{d.families[familyId], d.shared}
+
+	for i, entries := range layers {
+		if classes, ok := entries[key]; ok {
+			result.exact = true
+			result.match(key, classes, 1, i == 0)
+			return result
+		}
+	}
+
+	grams := ngramSet(key)
+	for i, entries := range layers {
+		for entry, classes := range entries {
+			s := similarity(grams, ngramSet(entry))
+			if s >= DictionaryMinSimilarity {
+				result.match(entry, classes, s, i == 0)
+			}
+		}
+
+		if len(result.scores) > 0 {
+			break
+		}
+	}
+
+	return result
+}
+
+// exactMatch returns the class of a previously labeled ingredient with the
+// same name, if the labels agree well enough.
+func (d *dictionaryClassifier) exactMatch(familyId int64, name string) (int64, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	result := d.lookup(familyId, name)
+	if !result.exact {
+		return -1, false
+	}
+
+	best, margin := result.best()
+	class_id := certain(best, margin, d.threshold())
+	return class_id, class_id != -1
+}
+
+func (d *dictionaryClassifier) Classify(familyId int64, name string, amount string) int64 {
+	best, margin := d.rank(familyId, name, amount)
+	return certain(best, margin, d.threshold())
+}
+
+func (d *dictionaryClassifier) rank(familyId int64, name string, amount string) (int64, float64) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.lookup(familyId, name).best()
+}
+
+func (d *dictionaryClassifier) threshold() float64 {
+	return DictionaryThreshold
+}
+
+// Explain lists the matching names for each class. A class's score is the
+// highest similarity of a matching name times the share of that name's
+// labels that went to the class.
+func (d *dictionaryClassifier) Explain(familyId int64, name string, amount string, top int) *Explanation {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	result := d.lookup(familyId, name)
+
+	explanation := newExplanation(ClassifierDictionary, []string{normalizeName(name)})
+
+	best, margin := result.best()
+	explanation.ClassId = certain(best, margin, d.threshold())
+
+	for class_id, score := range result.scores {
+		explanation.Classes = append(explanation.Classes, ClassExplanation{
+			ClassId:  class_id,
+			Score:    score,
+			Features: []FeatureContribution{},
+			Matches:  result.matches[class_id],
+		})
+	}
+
+	explanation.finish(top)
+	return explanation
+}
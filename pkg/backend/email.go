@@ -1,7 +1,21 @@
 package backend
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	//go get -u github.com/aws/aws-sdk-go
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,16 +25,58 @@ import (
 )
 
 const (
-	Sender  = "no-reply@example.com"
 	CharSet = "UTF-8"
+)
 
-	Region = "us-east-1"
+// Supported mailer backends.
+const (
+	MailerSES  = "ses"
+	MailerSMTP = "smtp"
+	MailerFile = "file"
 )
 
-func SendEmail(recipient string, subject string, htmlBody string, textBody string) error {
+type Email struct {
+	Recipient string
+	Subject   string
+	HtmlBody  string
+	TextBody  string
+}
+
+// Mailer sends emails on behalf of the application. The implementation is
+// chosen by the email.backend setting.
+type Mailer interface {
+	Send(email *Email) error
+}
+
+func NewMailer(config *EmailConfig) (Mailer, error) {
+	switch config.Backend {
+	case MailerSES:
+		return &sesMailer{sender: config.Sender, region: config.Region}, nil
+	case MailerSMTP:
+		return &smtpMailer{sender: config.Sender, config: config.SMTP}, nil
+	case MailerFile:
+		err := os.MkdirAll(config.Directory, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return &fileMailer{sender: config.Sender, directory: config.Directory}, nil
+	default:
+		return nil, fmt.Errorf("unsupported email backend %q", config.Backend)
+	}
+}
+
+type sesMailer struct {
+	sender string
+	region string
+}
+
+func (mailer *sesMailer) Send(email *Email) error {
 	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(Region)},
+		Region: aws.String(mailer.region)},
 	)
+	if err != nil {
+		return err
+	}
 
 	svc := ses.New(sess)
 
@@ -28,26 +84,26 @@ func SendEmail(recipient string, subject string, htmlBody string, textBody strin
 		Destination: &ses.Destination{
 			CcAddresses: []*string{},
 			ToAddresses: []*string{
-				aws.String(recipient),
+				aws.String(email.Recipient),
 			},
 		},
 		Message: &ses.Message{
 			Body: &ses.Body{
 				Html: &ses.Content{
 					Charset: aws.String(CharSet),
-					Data:    aws.String(htmlBody),
+					Data:    aws.String(email.HtmlBody),
 				},
 				Text: &ses.Content{
 					Charset: aws.String(CharSet),
-					Data:    aws.String(textBody),
+					Data:    aws.String(email.TextBody),
 				},
 			},
 			Subject: &ses.Content{
 				Charset: aws.String(CharSet),
-				Data:    aws.String(subject),
+				Data:    aws.String(email.Subject),
 			},
 		},
-		Source: aws.String(Sender),
+		Source: aws.String(mailer.sender),
 		// Uncomment to use a configuration set
 		//ConfigurationSetName: aws.String(ConfigurationSet),
 	}
@@ -76,7 +132,124 @@ func SendEmail(recipient string, subject string, htmlBody string, textBody strin
 		return err
 	}
 
-	fmt.Println("Email Sent to address: " + recipient)
+	fmt.Println("Email Sent to address: " + email.Recipient)
 	fmt.Println(result)
 	return nil
 }
+
+type smtpMailer struct {
+	sender string
+	config SMTPConfig
+}
+
+// Send delivers the email through the configured SMTP server. The connection
+// is upgraded with STARTTLS when the server supports it.
+func (mailer *smtpMailer) Send(email *Email) error {
+	message, err := composeEmail(mailer.sender, email)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if mailer.config.Username != "" {
+		auth = smtp.PlainAuth("", mailer.config.Username, mailer.config.Password, mailer.config.Host)
+	}
+
+	addr := mailer.config.Host + ":" + strconv.Itoa(mailer.config.Port)
+	err = smtp.SendMail(addr, auth, mailer.sender, []string{email.Recipient}, message)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Email Sent to address: " + email.Recipient)
+	return nil
+}
+
+// fileMailer writes every email as an .eml file into a directory instead of
+// sending it, which is useful for development and tests.
+type fileMailer struct {
+	sender    string
+	directory string
+}
+
+func (mailer *fileMailer) Send(email *Email) error {
+	message, err := composeEmail(mailer.sender, email)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), randomHex(4))
+	path := filepath.Join(mailer.directory, name)
+
+	err = ioutil.WriteFile(path, message, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Email to " + email.Recipient + " written to " + path)
+	return nil
+}
+
+func randomHex(n int) string {
+	buffer := make([]byte, n)
+	_, err := rand.Read(buffer)
+	panicOnErr(err)
+	return hex.EncodeToString(buffer)
+}
+
+// composeEmail renders the email as a multipart/alternative MIME message with
+// a plain text and an HTML part. Line breaks in the addresses or the subject
+// are rejected so that they cannot add headers to the message.
+func composeEmail(sender string, email *Email) ([]byte, error) {
+	for _, value := range []string{sender, email.Recipient, email.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("line break in email header %q", value)
+		}
+	}
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+
+	headers := []string{
+		"From: " + sender,
+		"To: " + email.Recipient,
+		"Subject: " + mime.QEncoding.Encode(CharSet, email.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + randomHex(16) + "@mealplanner>",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + writer.Boundary(),
+	}
+	for _, header := range headers {
+		buffer.WriteString(header + "\r\n")
+	}
+	buffer.WriteString("\r\n")
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", email.TextBody},
+		{"text/html", email.HtmlBody},
+	}
+
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+"; charset="+CharSet)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := quotedprintable.NewWriter(partWriter)
+		_, err = encoder.Write([]byte(part.body))
+		if err != nil {
+			return nil, err
+		}
+		encoder.Close()
+	}
+
+	err := writer.Close()
+	return buffer.Bytes(), err
+}
@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"math"
+
+	"gopkg.in/gorp.v2"
+)
+
+// ensembleClassifier trusts an exact dictionary match, where the name was
+// labeled consistently before, and asks the naive Bayes model otherwise.
+type ensembleClassifier struct {
+	dictionary *dictionaryClassifier
+	model      *bayesClassifier
+}
+
+func newEnsembleClassifier() *ensembleClassifier {
+	return &ensembleClassifier{
+		dictionary: newDictionaryClassifier(),
+		model:      newBayesClassifier(),
+	}
+}
+
+func (e *ensembleClassifier) Load(db *gorp.DbMap) error {
+	err := e.dictionary.Load(db)
+	if err != nil {
+		return err
+	}
+	return e.model.Load(db)
+}
+
+func (e *ensembleClassifier) train(private []int64, ingredients []Ingredient) {
+	e.dictionary.train(private, ingredients)
+	e.model.train(private, ingredients)
+}
+
+func (e *ensembleClassifier) Update(db *gorp.DbMap, removed []Ingredient, added []Ingredient) error {
+	err := e.dictionary.Update(db, removed, added)
+	if err != nil {
+		return err
+	}
+	return e.model.Update(db, removed, added)
+}
+
+func (e *ensembleClassifier) SetPrivate(familyId int64, private bool) {
+	e.dictionary.SetPrivate(familyId, private)
+	e.model.SetPrivate(familyId, private)
+}
+
+func (e *ensembleClassifier) Forget(db *gorp.DbMap, familyId int64) error {
+	err := e.dictionary.Forget(db, familyId)
+	if err != nil {
+		return err
+	}
+	return e.model.Forget(db, familyId)
+}
+
+func (e *ensembleClassifier) Classify(familyId int64, name string, amount string) int64 {
+	best, margin := e.rank(familyId, name, amount)
+	return certain(best, margin, e.threshold())
+}
+
+// rank gives exact matches an infinite margin, so that they pass any
+// threshold.
+func (e *ensembleClassifier) rank(familyId int64, name string, amount string) (int64, float64) {
+	if class_id, ok := e.dictionary.exactMatch(familyId, name); ok {
+		return class_id, math.Inf(1)
+	}
+	return e.model.rank(familyId, name, amount)
+}
+
+func (e *ensembleClassifier) threshold() float64 {
+	return e.model.threshold()
+}
+
+func (e *ensembleClassifier) Explain(familyId int64, name string, amount string, top int) *Explanation {
+	if _, ok := e.dictionary.exactMatch(familyId, name); ok {
+		return e.dictionary.Explain(familyId, name, amount, top)
+	}
+	return e.model.Explain(familyId, name, amount, top)
+}
@@ -0,0 +1,255 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"text/tabwriter"
+
+	"gopkg.in/gorp.v2"
+)
+
+// Thresholds compared by the evaluation, as multiples of the classifier's
+// own.
+var evaluationThresholds = []float64{0, 0.25, 0.5, 1, 2, 4, 8}
+
+type evaluationResult struct {
+	actual int64
+	best   int64
+	margin float64
+}
+
+// ClassifierEvaluation is the outcome of cross-validating the classifier on
+// the labeled ingredients.
+type ClassifierEvaluation struct {
+	Strategy  string
+	Threshold float64
+	Folds     int
+	Classes   map[int64]string
+
+	results []evaluationResult
+}
+
+// EvaluateClassifier runs k-fold cross-validation: the labeled ingredients
+// are shuffled into folds, and the ingredients of each fold are classified by
+// models trained on all other folds. The models are built in memory the same
+// way as the server's, including the per-family layering, so the strategies
+// can be compared on the same data.
+func EvaluateClassifier(db *gorp.DbMap, strategy string, folds int, seed int64) (*ClassifierEvaluation, error) {
+	if folds < 2 {
+		return nil, errors.New("at least two folds are needed")
+	}
+
+	model, err := NewIngredientClassifier(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	ingredients, err := selectLabeledIngredients(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ingredients) < folds {
+		return nil, fmt.Errorf("only %d labeled ingredients for %d folds", len(ingredients), folds)
+	}
+
+	private, err := selectPrivateFamilies(db)
+	if err != nil {
+		return nil, err
+	}
+
+	classes, err := selectClassNames(db)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluation := &ClassifierEvaluation{
+		Strategy:  strategy,
+		Threshold: model.threshold(),
+		Folds:     folds,
+		Classes:   classes,
+	}
+
+	order := rand.New(rand.NewSource(seed)).Perm(len(ingredients))
+
+	for fold := 0; fold < folds; fold++ {
+		training := []Ingredient{}
+		testing := []Ingredient{}
+		for i, j := range order {
+			if i%folds == fold {
+				testing = append(testing, ingredients[j])
+			} else {
+				training = append(training, ingredients[j])
+			}
+		}
+
+		model.train(private, training)
+
+		for _, ingredient := range testing {
+			best, margin := model.rank(ingredient.OwnerId, ingredient.Name, ingredient.Amount.String)
+
+			evaluation.results = append(evaluation.results, evaluationResult{
+				actual: ingredient.ClassId.Int64,
+				best:   best,
+				margin: margin,
+			})
+		}
+	}
+
+	return evaluation, nil
+}
+
+func selectClassNames(db gorp.SqlExecutor) (map[int64]string, error) {
+	classes := []IngredientClass{}
+	_, err := db.Select(&classes, "SELECT * FROM ingclasses")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string)
+	for _, class := range classes {
+		names[class.Id] = class.Name
+	}
+	return names, nil
+}
+
+// Accuracy is the share of ingredients whose best class was right, as if
+// there were no certainty threshold.
+func (e *ClassifierEvaluation) Accuracy() float64 {
+	correct := 0
+	for _, result := range e.results {
+		if result.best == result.actual {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(e.results))
+}
+
+// AtThreshold returns the share of ingredients that get a class at all with
+// the given certainty threshold, how many of those are right, and the share
+// of all ingredients that get a wrong class.
+func (e *ClassifierEvaluation) AtThreshold(threshold float64) (coverage float64, accuracy float64, wrong float64) {
+	covered := 0
+	correct := 0
+	for _, result := range e.results {
+		if certain(result.best, result.margin, threshold) != -1 {
+			covered++
+			if result.best == result.actual {
+				correct++
+			}
+		}
+	}
+
+	total := float64(len(e.results))
+	coverage = float64(covered) / total
+	if covered > 0 {
+		accuracy = float64(correct) / float64(covered)
+	}
+	wrong = float64(covered-correct) / total
+	return
+}
+
+// Confusion counts the actual classes (first key) against the classes
+// suggested with the classifier's threshold (second key, -1 for no
+// suggestion).
+func (e *ClassifierEvaluation) Confusion() map[int64]map[int64]int {
+	confusion := make(map[int64]map[int64]int)
+	for _, result := range e.results {
+		predicted := certain(result.best, result.margin, e.Threshold)
+
+		if confusion[result.actual] == nil {
+			confusion[result.actual] = make(map[int64]int)
+		}
+		confusion[result.actual][predicted]++
+	}
+	return confusion
+}
+
+func (e *ClassifierEvaluation) className(id int64) string {
+	if name, ok := e.Classes[id]; ok {
+		return fmt.Sprintf("%s (%d)", name, id)
+	}
+	return fmt.Sprintf("(%d)", id)
+}
+
+// WriteReport prints the evaluation as plain text tables.
+func (e *ClassifierEvaluation) WriteReport(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Classifier:\t%s\n", e.Strategy)
+	fmt.Fprintf(w, "Ingredients:\t%d\n", len(e.results))
+	fmt.Fprintf(w, "Folds:\t%d\n", e.Folds)
+	switch e.Strategy {
+	case ClassifierBayes, ClassifierEnsemble:
+		fmt.Fprintf(w, "SplitThreshold:\t%d\n", SplitThreshold)
+		fmt.Fprintf(w, "RegularizationTerm:\t%g\n", RegularizationTerm)
+	}
+	switch e.Strategy {
+	case ClassifierDictionary, ClassifierEnsemble:
+		fmt.Fprintf(w, "DictionaryMinSimilarity:\t%g\n", DictionaryMinSimilarity)
+	}
+	fmt.Fprintf(w, "Accuracy of the best class:\t%.1f%%\n", 100*e.Accuracy())
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "Threshold\tCoverage\tAccuracy\tWrong")
+	for _, factor := range evaluationThresholds {
+		threshold := factor * e.Threshold
+		coverage, accuracy, wrong := e.AtThreshold(threshold)
+
+		marker := ""
+		if factor == 1 {
+			marker = " *"
+		}
+
+		fmt.Fprintf(w, "%g%s\t%.1f%%\t%.1f%%\t%.1f%%\n",
+			threshold, marker, 100*coverage, 100*accuracy, 100*wrong)
+	}
+	fmt.Fprintln(w)
+
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	confusion := e.Confusion()
+
+	actual := []int64{}
+	predictedSet := make(map[int64]bool)
+	for class_id, row := range confusion {
+		actual = append(actual, class_id)
+		for predicted := range row {
+			predictedSet[predicted] = true
+		}
+	}
+	sort.Slice(actual, func(i, j int) bool { return actual[i] < actual[j] })
+
+	predicted := []int64{}
+	for class_id := range predictedSet {
+		if class_id != -1 {
+			predicted = append(predicted, class_id)
+		}
+	}
+	sort.Slice(predicted, func(i, j int) bool { return predicted[i] < predicted[j] })
+
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Confusion matrix with threshold %g (rows are the actual classes, columns the suggested class ids):\n", e.Threshold)
+
+	fmt.Fprint(w, "\t")
+	for _, class_id := range predicted {
+		fmt.Fprintf(w, "%d\t", class_id)
+	}
+	fmt.Fprintln(w, "none")
+
+	for _, class_id := range actual {
+		fmt.Fprintf(w, "%s\t", e.className(class_id))
+		for _, p := range predicted {
+			fmt.Fprintf(w, "%d\t", confusion[class_id][p])
+		}
+		fmt.Fprintf(w, "%d\n", confusion[class_id][-1])
+	}
+
+	return w.Flush()
+}
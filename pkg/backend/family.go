@@ -3,6 +3,7 @@ package backend
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
@@ -24,6 +25,85 @@ func userOwnsFamily(db *gorp.DbMap, user_id int64, family_id int64) bool {
 	return (family.UserId == user_id)
 }
 
+type transferFamilyRequest struct {
+	UserId int64 `json:"user_id"`
+}
+
+// createFamily adds a family owned by the user. New families start with a
+// free trial, just like new accounts.
+func createFamily(db gorp.SqlExecutor, userId int64, name string) (*Family, error) {
+	today := time.Now()
+	family := Family{
+		UserId:          userId,
+		Name:            name,
+		CreatedOn:       today.Format(dateFormat),
+		AccountStatus:   "trial",
+		StatusExpiresOn: today.AddDate(0, 0, 30).Format(dateFormat),
+	}
+
+	err := db.Insert(&family)
+	if err != nil {
+		return nil, err
+	}
+
+	member := FamilyMember{
+		FamilyId: family.Id,
+		UserId:   userId,
+		CanEdit:  true,
+		Role:     RoleOwner,
+	}
+
+	err = db.Insert(&member)
+	if err != nil {
+		return nil, err
+	}
+
+	return &family, nil
+}
+
+// Statements that remove everything belonging to a family, in an order that
+// leaves no dangling references.
+var deleteFamilyStatements = []string{
+	"DELETE FROM ingredients WHERE owner_id=?",
+	"DELETE FROM assignments WHERE owner_id=?",
+	"DELETE FROM recipesteps WHERE recipe_id IN (SELECT id FROM recipes WHERE owner_id=?)",
+	"DELETE FROM recipetags WHERE recipe_id IN (SELECT id FROM recipes WHERE owner_id=?)",
+	"DELETE FROM recipes WHERE owner_id=?",
+	"DELETE FROM invitations WHERE family_id=?",
+	"DELETE FROM storeaisles WHERE store_id IN (SELECT id FROM stores WHERE family_id=?)",
+	"DELETE FROM stores WHERE family_id=?",
+	"DELETE FROM pantryitems WHERE family_id=?",
+	"DELETE FROM imports WHERE family_id=?",
+	"DELETE FROM familymembers WHERE family_id=?",
+	"DELETE FROM families WHERE id=?",
+}
+
+func deleteFamily(db gorp.SqlExecutor, familyId int64) error {
+	// Tokens limited to the family would otherwise silently stop working.
+	_, err := db.Exec(
+		"UPDATE apitokens SET revoked_on=? WHERE family_id=? AND revoked_on=0",
+		time.Now().Unix(), familyId)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range deleteFamilyStatements {
+		_, err = db.Exec(statement, familyId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Former members fall back to another family they belong to.
+	_, err = db.Exec(
+		"UPDATE users "+
+			"SET default_family_id=COALESCE("+
+			"(SELECT MIN(family_id) FROM familymembers WHERE user_id=users.id), 0) "+
+			"WHERE default_family_id=?",
+		familyId)
+	return err
+}
+
 func ListFamilies(session sessions.Session, db *gorp.DbMap, params martini.Params, req *http.Request, ren render.Render) {
 	userId := session.Get("UserId")
     if userId == nil {
@@ -31,9 +111,7 @@ func ListFamilies(session sessions.Session, db *gorp.DbMap, params martini.Param
         return
     }
 
-	families := []Family{}
-
-	_, err := db.Select(&families, "SELECT families.* FROM families JOIN familymembers ON families.id=familymembers.family_id WHERE familymembers.user_id=?", userId)
+	families, err := selectUserFamilies(db, userId)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusBadRequest, nil)
@@ -97,15 +175,25 @@ func UpdateFamily(session sessions.Session, db *gorp.DbMap, params martini.Param
 		return
 	}
 
+	request := *family
 	decoder := json.NewDecoder(req.Body)
-	err = decoder.Decode(&family)
+	err = decoder.Decode(&request)
 	if err != nil {
 		ren.JSON(http.StatusBadRequest, nil)
 		return
 	}
 
-	// No messing around with protected fields.
-	family.UserId = userId.(int64)
+	// Only the name and settings can be changed here. Ownership is
+	// transferred with TransferFamily, and the account status is not up to
+	// the user.
+	family.Name = request.Name
+	family.PrivateClassifier = request.PrivateClassifier
+	family.DefaultServings = request.DefaultServings
+
+	if family.DefaultServings.Valid && family.DefaultServings.Int64 <= 0 {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
 
 	_, err = db.Update(family)
 	if err != nil {
@@ -114,5 +202,208 @@ func UpdateFamily(session sessions.Session, db *gorp.DbMap, params martini.Param
 		return
 	}
 
+	Classifier.SetPrivate(familyId, family.PrivateClassifier)
+
+	ren.JSON(http.StatusOK, family)
+}
+
+func CreateFamily(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	// API tokens are limited to the families they were made for.
+	userId, ok := checkCookieSession(session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	request := Family{}
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&request)
+	if err != nil || request.Name == "" {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	family, err := createFamily(tx, userId, request.Name)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	addSessionFamily(session, family.Id)
+
+	ren.JSON(http.StatusOK, family)
+}
+
+// DeleteFamily removes a family with its recipes, ingredients, plan and
+// memberships. Owners cannot delete their only family.
+func DeleteFamily(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	result, err := db.Get(Family{}, familyId)
+	if err != nil || result == nil {
+		logError(err)
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	family, ok := result.(*Family)
+	if !ok {
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	count, err := db.SelectInt(
+		"SELECT COUNT(*) FROM familymembers WHERE user_id=? AND family_id!=?",
+		family.UserId, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if count == 0 {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	// The family's labeled ingredients have to be taken out of the
+	// classifier once they are gone.
+	labeled := []Ingredient{}
+	_, err = tx.Select(&labeled,
+		"SELECT * FROM ingredients WHERE owner_id=? AND class_id IS NOT NULL",
+		familyId)
+	if err == nil {
+		err = deleteFamily(tx, familyId)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	err = Classifier.Update(db, labeled, nil)
+	if err == nil {
+		err = Classifier.Forget(db, familyId)
+	}
+	if err != nil {
+		logError(err)
+	}
+
+	removeSessionFamily(session, familyId)
+
+	// The session follows the user's new default family.
+	if current, _ := session.Get("FamilyId").(int64); current == familyId {
+		user := getUser(db, session)
+		if user != nil {
+			session.Set("FamilyId", user.DefaultFamilyId)
+		}
+	}
+
+	ren.JSON(http.StatusOK, family)
+}
+
+// TransferFamily makes another member the owner. The previous owner stays in
+// the family as an editor.
+func TransferFamily(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	request := transferFamilyRequest{}
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&request)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	result, err := db.Get(Family{}, familyId)
+	if err != nil || result == nil {
+		logError(err)
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	family, ok := result.(*Family)
+	if !ok {
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	role, err := selectMemberRole(db, request.UserId, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if role == "" || request.UserId == family.UserId {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE familymembers SET role=?, can_edit=? WHERE family_id=? AND user_id=?",
+		RoleEditor, true, familyId, family.UserId)
+
+	if err == nil {
+		_, err = tx.Exec(
+			"UPDATE familymembers SET role=?, can_edit=? WHERE family_id=? AND user_id=?",
+			RoleOwner, true, familyId, request.UserId)
+	}
+
+	if err == nil {
+		family.UserId = request.UserId
+		_, err = tx.Update(family)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
 	ren.JSON(http.StatusOK, family)
 }
@@ -37,7 +37,9 @@ func CreateMember(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		return
 	}
 
-	member := FamilyMember{}
+	member := FamilyMember{
+		Role: RoleEditor,
+	}
 
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&member)
@@ -46,8 +48,26 @@ func CreateMember(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		return
 	}
 
+	// A family has exactly one owner.
+	if member.Role != RoleEditor && member.Role != RoleViewer {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	role, err := selectMemberRole(db, member.UserId, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if role != "" {
+		ren.JSON(http.StatusConflict, nil)
+		return
+	}
+
 	// No messing around with protected fields.
+	member.Id = 0
 	member.FamilyId = familyId
+	member.CanEdit = roleAtLeast(member.Role, RoleEditor)
 
 	err = db.Insert(&member)
 	if err != nil {
@@ -59,53 +79,96 @@ func CreateMember(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 	ren.JSON(http.StatusOK, member)
 }
 
-func DeleteMember(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
-	id, err := strconv.Atoi(params["id"])
+// getFamilyMember loads the member given by the id parameter, making sure that
+// it belongs to the family.
+func getFamilyMember(db *gorp.DbMap, params martini.Params, familyId int64) (*FamilyMember, int) {
+	id, err := strconv.ParseInt(params["id"], 0, 64)
 	if err != nil {
 		logError(err)
-		ren.JSON(http.StatusBadRequest, nil)
-		return
+		return nil, http.StatusBadRequest
+	}
+
+	result, err := db.Get(FamilyMember{}, id)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusNotFound
+	} else if result == nil {
+		return nil, http.StatusNotFound
+	}
+
+	member, ok := result.(*FamilyMember)
+	if !ok {
+		return nil, http.StatusInternalServerError
 	}
 
+	if member.FamilyId != familyId {
+		return nil, http.StatusNotFound
+	}
+
+	return member, http.StatusOK
+}
+
+// UpdateMember changes the role of a member. Ownership cannot be given away
+// this way, and the owner's own role cannot be changed.
+func UpdateMember(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
 	familyId, ok := checkFamilyParam(params, session)
 	if !ok {
 		ren.JSON(http.StatusUnauthorized, nil)
 		return
 	}
 
-	result, err := db.Get(FamilyMember{}, id)
+	member, status := getFamilyMember(db, params, familyId)
+	if member == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	if member.Role == RoleOwner {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	request := FamilyMember{}
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&request)
+	if err != nil || (request.Role != RoleEditor && request.Role != RoleViewer) {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	member.Role = request.Role
+	member.CanEdit = roleAtLeast(member.Role, RoleEditor)
+
+	_, err = db.Update(member)
 	if err != nil {
 		logError(err)
-		ren.JSON(http.StatusNotFound, nil)
+		ren.JSON(http.StatusInternalServerError, nil)
 		return
 	}
 
-	member, ok := result.(*FamilyMember)
+	ren.JSON(http.StatusOK, member)
+}
+
+func DeleteMember(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
 	if !ok {
-		ren.JSON(http.StatusInternalServerError, nil)
+		ren.JSON(http.StatusUnauthorized, nil)
 		return
 	}
 
-    result, err = db.Get(Family{}, familyId)
-    if err != nil {
-        logError(err)
-        ren.JSON(http.StatusNotFound, nil)
-        return
-    }
-
-	family, ok := result.(*Family)
-    if !ok {
-        ren.JSON(http.StatusInternalServerError, nil)
-        return
-    }
+	member, status := getFamilyMember(db, params, familyId)
+	if member == nil {
+		ren.JSON(status, nil)
+		return
+	}
 
 	// Family owner cannot be removed.
-	if member.UserId == family.UserId {
+	if member.Role == RoleOwner {
 		ren.JSON(http.StatusBadRequest, nil)
 		return
 	}
 
-	_, err = db.Delete(member)
+	_, err := db.Delete(member)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusInternalServerError, nil)
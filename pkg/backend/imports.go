@@ -0,0 +1,498 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Recipes are imported from a CSV file with a header row naming the columns:
+//
+//	name,source,servings,ingredients
+//	Pancakes,https://example.com/pancakes?a=1,4,flour (200 g):milk (300 ml):egg (2)
+//
+// Only the name is required. The ingredients are separated by colons, each
+// with its amount in parentheses. Fields with commas have to be quoted.
+// A file is imported as a whole or not at all, and can be previewed first.
+
+// The largest file that is imported.
+const maxImportSize = 1 << 20
+
+var importColumns = map[string]bool{
+	"name":        true,
+	"source":      true,
+	"servings":    true,
+	"ingredients": true,
+}
+
+// An ingredient with its amount in the last parentheses, as in
+// "tomatoes (canned) (400 g)".
+var importIngredientPattern = regexp.MustCompile(`^(.*)\(([^()]*)\)\s*$`)
+
+// ImportedRecipe is a recipe read from a row of the file. For a web page, Row
+// is the position of the recipe on the page.
+type ImportedRecipe struct {
+	Row         int          `json:"row"`
+	Recipe      Recipe       `json:"recipe"`
+	Ingredients []Ingredient `json:"ingredients"`
+}
+
+// ImportError is a problem with a row of the file. The header is row 1. For a
+// web page, row 0 is the page as a whole.
+type ImportError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ImportReport tells what was or would be imported. Import is only set once
+// the recipes are saved.
+type ImportReport struct {
+	Import  *Import          `json:"import"`
+	DryRun  bool             `json:"dry_run"`
+	Recipes []ImportedRecipe `json:"recipes"`
+	Errors  []ImportError    `json:"errors"`
+}
+
+// readImportFile returns the uploaded file, or the content form field that
+// the preview page sends it back in.
+func readImportFile(req *http.Request) (string, []byte, error) {
+	err := req.ParseMultipartForm(maxImportSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return "", nil, err
+	}
+
+	if content := req.FormValue("content"); content != "" {
+		return req.FormValue("file_name"), []byte(content), nil
+	}
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	data, err := readImportData(file)
+	return header.Filename, data, err
+}
+
+// readImportData reads a file of at most maxImportSize bytes.
+func readImportData(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxImportSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxImportSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxImportSize)
+	}
+	return data, nil
+}
+
+// parseImportIngredients reads the colon separated ingredients.
+func parseImportIngredients(text string, familyId int64) ([]Ingredient, error) {
+	ingredients := []Ingredient{}
+	for i, part := range strings.Split(text, ":") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		ingredient := Ingredient{
+			OwnerId: familyId,
+			Name:    part,
+		}
+
+		if m := importIngredientPattern.FindStringSubmatch(part); m != nil {
+			ingredient.Name = strings.TrimSpace(m[1])
+			if amount := strings.TrimSpace(m[2]); amount != "" {
+				ingredient.Amount = null.StringFrom(amount)
+			}
+		}
+
+		if ingredient.Name == "" {
+			return nil, fmt.Errorf("ingredient %d has no name", i+1)
+		}
+
+		ingredients = append(ingredients, ingredient)
+	}
+	return ingredients, nil
+}
+
+// parseImportRow reads the recipe in a row, by the columns in the header.
+func parseImportRow(columns []string, record []string, familyId int64) (ImportedRecipe, error) {
+	imported := ImportedRecipe{
+		Recipe: Recipe{
+			OwnerId: familyId,
+			Show:    true,
+		},
+		Ingredients: []Ingredient{},
+	}
+
+	if len(record) != len(columns) {
+		return imported, fmt.Errorf("expected %d fields, found %d", len(columns), len(record))
+	}
+
+	for i, column := range columns {
+		value := strings.TrimSpace(record[i])
+
+		switch column {
+		case "name":
+			imported.Recipe.Name = value
+		case "source":
+			if value != "" {
+				imported.Recipe.Source = null.StringFrom(value)
+			}
+		case "servings":
+			if value == "" {
+				continue
+			}
+
+			servings, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || servings <= 0 {
+				return imported, fmt.Errorf("servings must be a positive whole number, not %q", value)
+			}
+			imported.Recipe.Servings = null.IntFrom(servings)
+		case "ingredients":
+			ingredients, err := parseImportIngredients(value, familyId)
+			if err != nil {
+				return imported, err
+			}
+			imported.Ingredients = ingredients
+		}
+	}
+
+	if imported.Recipe.Name == "" {
+		return imported, fmt.Errorf("the name is missing")
+	}
+
+	return imported, nil
+}
+
+// parseImport reads all recipes in the file and every problem with it.
+func parseImport(data []byte, familyId int64) ([]ImportedRecipe, []ImportError) {
+	recipes := []ImportedRecipe{}
+	errors := []ImportError{}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return recipes, append(errors, ImportError{Row: 1, Message: "the file is empty"})
+	} else if err != nil {
+		return recipes, append(errors, ImportError{Row: 1, Message: err.Error()})
+	}
+
+	columns := make([]string, len(header))
+	seen := make(map[string]bool)
+	for i, name := range header {
+		column := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !importColumns[column] {
+			errors = append(errors, ImportError{Row: 1, Message: fmt.Sprintf("unknown column %q", name)})
+		} else if seen[column] {
+			errors = append(errors, ImportError{Row: 1, Message: fmt.Sprintf("column %q is repeated", name)})
+		}
+		seen[column] = true
+		columns[i] = column
+	}
+
+	if !seen["name"] {
+		errors = append(errors, ImportError{Row: 1, Message: "the header has no name column"})
+	}
+	if len(errors) > 0 {
+		return recipes, errors
+	}
+
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(*csv.ParseError); ok {
+			errors = append(errors, ImportError{Row: row, Message: err.Error()})
+			continue
+		} else if err != nil {
+			errors = append(errors, ImportError{Row: row, Message: err.Error()})
+			break
+		}
+
+		imported, err := parseImportRow(columns, record, familyId)
+		if err != nil {
+			errors = append(errors, ImportError{Row: row, Message: err.Error()})
+			continue
+		}
+
+		imported.Row = row
+		recipes = append(recipes, imported)
+	}
+
+	if len(recipes) == 0 && len(errors) == 0 {
+		errors = append(errors, ImportError{Row: 1, Message: "the file has no recipes"})
+	}
+
+	return recipes, errors
+}
+
+// runImport reads the file and, unless it is a dry run or there are any
+// errors, saves all of its recipes in one transaction.
+func runImport(db *gorp.DbMap, familyId int64, userId int64, fileName string, data []byte, dryRun bool) (*ImportReport, error) {
+	recipes, errors := parseImport(data, familyId)
+	return saveImport(db, familyId, userId, fileName, recipes, errors, dryRun)
+}
+
+// saveImport saves the recipes as one import, unless it is a dry run or
+// there are any errors.
+func saveImport(db *gorp.DbMap, familyId int64, userId int64, fileName string, recipes []ImportedRecipe, errors []ImportError, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{
+		DryRun:  dryRun,
+		Recipes: recipes,
+		Errors:  errors,
+	}
+
+	if dryRun || len(errors) > 0 {
+		return report, nil
+	}
+
+	batch := Import{
+		FamilyId:  familyId,
+		UserId:    userId,
+		FileName:  fileName,
+		Recipes:   int64(len(recipes)),
+		CreatedOn: time.Now().Unix(),
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Insert(&batch)
+
+	for i := range recipes {
+		if err != nil {
+			break
+		}
+
+		recipe := &recipes[i].Recipe
+		recipe.ImportId = batch.Id
+
+		err = tx.Insert(recipe)
+
+		for j := range recipes[i].Ingredients {
+			if err != nil {
+				break
+			}
+
+			ingredient := &recipes[i].Ingredients[j]
+			ingredient.RecipeId = null.IntFrom(recipe.Id)
+
+			err = tx.Insert(ingredient)
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.Import = &batch
+	return report, nil
+}
+
+// undoImport deletes the recipes of the import with their ingredients, steps,
+// tags and the meals they were planned for. The classifier forgets the
+// classes that were given to the ingredients since. It returns false if the
+// import was already undone.
+func undoImport(db *gorp.DbMap, batch *Import) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	// Mark the import as undone first. Checking the affected row count makes
+	// sure that two concurrent requests cannot both undo it.
+	now := time.Now().Unix()
+	claimed, err := tx.Exec(
+		"UPDATE imports SET undone_on=? WHERE id=? AND undone_on=0",
+		now, batch.Id)
+	if err == nil {
+		var count int64
+		count, err = claimed.RowsAffected()
+		if err == nil && count != 1 {
+			tx.Rollback()
+			return false, nil
+		}
+	}
+
+	recipes := "SELECT id FROM recipes WHERE import_id=? AND owner_id=?"
+
+	labeled := []Ingredient{}
+	if err == nil {
+		_, err = tx.Select(&labeled,
+			"SELECT * FROM ingredients WHERE recipe_id IN ("+recipes+") AND class_id IS NOT NULL",
+			batch.Id, batch.FamilyId)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM assignments WHERE recipe_id IN ("+recipes+")",
+			batch.Id, batch.FamilyId)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM ingredients WHERE recipe_id IN ("+recipes+")",
+			batch.Id, batch.FamilyId)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recipesteps WHERE recipe_id IN ("+recipes+")",
+			batch.Id, batch.FamilyId)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recipetags WHERE recipe_id IN ("+recipes+")",
+			batch.Id, batch.FamilyId)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recipes WHERE import_id=? AND owner_id=?",
+			batch.Id, batch.FamilyId)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	batch.UndoneOn = now
+
+	err = Classifier.Update(db, labeled, nil)
+	if err != nil {
+		logError(err)
+	}
+
+	return true, nil
+}
+
+func selectImport(db gorp.SqlExecutor, familyId int64, id int64) (*Import, error) {
+	imports := []Import{}
+	_, err := db.Select(&imports,
+		"SELECT * FROM imports WHERE id=? AND family_id=?", id, familyId)
+	if err != nil || len(imports) == 0 {
+		return nil, err
+	}
+	return &imports[0], nil
+}
+
+// ImportRecipes imports the recipes in the uploaded file. With the dry_run
+// query parameter, it only reports what would be imported. Nothing is
+// imported if any row has an error.
+func ImportRecipes(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	userId, _ := session.Get("UserId").(int64)
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run"))
+
+	fileName, data, err := readImportFile(req)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	report, err := runImport(db, familyId, userId, fileName, data, dryRun)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if len(report.Errors) > 0 {
+		ren.JSON(http.StatusBadRequest, report)
+		return
+	}
+
+	ren.JSON(http.StatusOK, report)
+}
+
+func ListImports(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	imports := []Import{}
+	_, err := db.Select(&imports,
+		"SELECT * FROM imports WHERE family_id=? ORDER BY created_on DESC, id DESC",
+		familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, imports)
+}
+
+// UndoImport deletes all recipes of an import, with the meals they were
+// planned for.
+func UndoImport(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	batch, err := selectImport(db, familyId, id)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if batch == nil {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	} else if batch.UndoneOn != 0 {
+		ren.JSON(http.StatusConflict, nil)
+		return
+	}
+
+	undone, err := undoImport(db, batch)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if !undone {
+		ren.JSON(http.StatusConflict, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, batch)
+}
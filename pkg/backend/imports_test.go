@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestParseImport(t *testing.T) {
+	tests := []struct {
+		about   string
+		data    string
+		recipes []string
+		errors  []int
+	}{
+		{
+			"a file with all columns",
+			"name,source,servings,ingredients\n" +
+				"Soup,Grandma,4,onions (2): water (1 l): salt\n" +
+				"\"Bread, white\",,,flour (500 g)\n",
+			[]string{"Soup", "Bread, white"},
+			nil,
+		},
+		{
+			"columns in any order and case, with a byte order mark",
+			"\ufeffIngredients, NAME\nrice (200 g),Rice\n",
+			[]string{"Rice"},
+			nil,
+		},
+		{
+			"an empty file",
+			"",
+			nil,
+			[]int{1},
+		},
+		{
+			"a header without recipes",
+			"name,ingredients\n",
+			nil,
+			[]int{1},
+		},
+		{
+			"an unknown and a repeated column",
+			"name,name,rating\nSoup,Soup,5\n",
+			nil,
+			[]int{1, 1},
+		},
+		{
+			"no name column",
+			"source\nGrandma\n",
+			nil,
+			[]int{1},
+		},
+		{
+			"bad rows are reported with their row numbers",
+			"name,servings,ingredients\n" +
+				"Soup,4,\n" +
+				",2,\n" +
+				"Stew,many,\n" +
+				"Salad,2\n" +
+				"Curry,2,rice (1 cup): (2 tbsp)\n",
+			[]string{"Soup"},
+			[]int{3, 4, 5, 6},
+		},
+	}
+
+	for _, test := range tests {
+		recipes, errors := parseImport([]byte(test.data), 7)
+
+		names := []string{}
+		for _, imported := range recipes {
+			names = append(names, imported.Recipe.Name)
+			if imported.Recipe.OwnerId != 7 {
+				t.Errorf("%s: recipe %q belongs to family %d, want 7", test.about,
+					imported.Recipe.Name, imported.Recipe.OwnerId)
+			}
+		}
+		rows := []int{}
+		for _, e := range errors {
+			rows = append(rows, e.Row)
+		}
+
+		if strings.Join(names, "|") != strings.Join(test.recipes, "|") {
+			t.Errorf("%s: recipes %q, want %q", test.about, names, test.recipes)
+		}
+		if len(rows) != len(test.errors) {
+			t.Errorf("%s: errors %v, want them in rows %v", test.about, errors, test.errors)
+			continue
+		}
+		for i := range rows {
+			if rows[i] != test.errors[i] {
+				t.Errorf("%s: errors %v, want them in rows %v", test.about, errors, test.errors)
+				break
+			}
+		}
+	}
+}
+
+func TestParseImportIngredients(t *testing.T) {
+	ingredients, err := parseImportIngredients("tomatoes (canned) (400 g): basil : pepper ()", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		name   string
+		amount string
+	}{
+		{"tomatoes (canned)", "400 g"},
+		{"basil", ""},
+		{"pepper", ""},
+	}
+
+	if len(ingredients) != len(want) {
+		t.Fatalf("got %d ingredients, want %d", len(ingredients), len(want))
+	}
+	for i, ingredient := range ingredients {
+		if ingredient.Name != want[i].name || ingredient.Amount.String != want[i].amount ||
+			ingredient.OwnerId != 3 {
+			t.Errorf("ingredient %d is %q (%q) of family %d, want %q (%q) of family 3", i+1,
+				ingredient.Name, ingredient.Amount.String, ingredient.OwnerId, want[i].name, want[i].amount)
+		}
+	}
+}
+
+func TestImportAndUndo(t *testing.T) {
+	db, cleanup := openMigratedDatabase(t)
+	defer cleanup()
+	Classifier = newBayesClassifier()
+
+	data := []byte("name,ingredients\nSoup,onions (2): water (1 l)\nStew,beef (500 g)\n")
+
+	report, err := runImport(db, 1, 1, "recipes.csv", data, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Import != nil || len(report.Recipes) != 2 {
+		t.Fatalf("dry run saved %v with %d recipes", report.Import, len(report.Recipes))
+	}
+	if count, _ := db.SelectInt("SELECT COUNT(*) FROM recipes"); count != 0 {
+		t.Fatalf("dry run stored %d recipes", count)
+	}
+
+	report, err = runImport(db, 1, 1, "recipes.csv", data, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Import == nil {
+		t.Fatal("import was not saved")
+	}
+	if count, _ := db.SelectInt("SELECT COUNT(*) FROM recipes WHERE import_id=?", report.Import.Id); count != 2 {
+		t.Fatalf("stored %d recipes, want 2", count)
+	}
+	if count, _ := db.SelectInt("SELECT COUNT(*) FROM ingredients WHERE unit=?", "l"); count != 1 {
+		t.Fatalf("stored %d ingredients in liters, want 1", count)
+	}
+
+	// Labeling an imported ingredient teaches the classifier, and undoing
+	// the import has to take it back out.
+	onions := Ingredient{}
+	err = db.SelectOne(&onions, "SELECT * FROM ingredients WHERE name=?", "onions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	class := IngredientClass{Name: "Vegetables"}
+	err = db.Insert(&class)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onions.ClassId = null.IntFrom(class.Id)
+	_, err = db.Update(&onions)
+	if err == nil {
+		err = Classifier.Update(db, nil, []Ingredient{onions})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file with an error imports nothing.
+	report, err = runImport(db, 1, 1, "bad.csv", []byte("name\nPie\n\"\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Import != nil {
+		t.Fatal("a file with errors was saved")
+	}
+
+	batch, err := selectImport(db, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undone, err := undoImport(db, batch)
+	if err != nil {
+		t.Fatal(err)
+	} else if !undone {
+		t.Fatal("the import was not undone")
+	}
+
+	for _, table := range []string{"recipes", "ingredients"} {
+		if count, _ := db.SelectInt("SELECT COUNT(*) FROM " + table); count != 0 {
+			t.Errorf("%d %s left after undoing the import", count, table)
+		}
+	}
+	if count, _ := db.SelectInt("SELECT COUNT(*) FROM classifierclasses"); count != 0 {
+		t.Errorf("the classifier still counts %d classes after undoing the import", count)
+	}
+	if batch.UndoneOn == 0 {
+		t.Error("the import is not marked as undone")
+	}
+	if stored, _ := selectImport(db, 1, batch.Id); stored == nil || stored.UndoneOn != batch.UndoneOn {
+		t.Error("the import is not stored as undone")
+	}
+
+	// Undoing it again, as a second request that read the import before the
+	// first one finished would, does nothing.
+	batch.UndoneOn = 0
+	undone, err = undoImport(db, batch)
+	if err != nil {
+		t.Fatal(err)
+	} else if undone {
+		t.Error("the import was undone twice")
+	}
+}
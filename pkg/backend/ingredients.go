@@ -26,9 +26,30 @@ type AssignedIngredientView struct {
 	Name         string      `db:"name" json:"name"`
 	Amount       null.String `db:"amount" json:"amount"`
 	Have         null.Bool   `db:"have" json:"have"`
+	Quantity     null.Float  `db:"quantity" json:"quantity"`
+	QuantityMax  null.Float  `db:"quantity_max" json:"quantity_max"`
+	Unit         null.String `db:"unit" json:"unit"`
 
 	// IngredientClass table
 	Class null.String `db:"class" json:"class"`
+
+	// Recipe table
+	Recipe         string   `db:"recipe" json:"recipe"`
+	RecipeServings null.Int `db:"recipe_servings" json:"recipe_servings"`
+
+	// Assignment table
+	Servings null.Int `db:"servings" json:"servings"`
+
+	// How much the amount was scaled by for the servings, and what it was.
+	Scale          float64     `db:"-" json:"scale"`
+	OriginalAmount null.String `db:"-" json:"original_amount"`
+
+	// How much of it the pantry has: PantryAlways, PantryCovered,
+	// PantryPartial or nothing. The amount is what is left to buy.
+	Pantry string `db:"-" json:"pantry"`
+
+	// Class within the section when the shopping list groups by parent class.
+	Subclass string `db:"-" json:"-"`
 }
 
 // Extended Ingredient structure to accept update requests.
@@ -127,6 +148,11 @@ func CreateIngredient(db *gorp.DbMap, params martini.Params, session sessions.Se
 		return
 	}
 
+	err = Classifier.Update(db, nil, []Ingredient{ingredient})
+	if err != nil {
+		logError(err)
+	}
+
 	ren.JSON(http.StatusOK, ingredient)
 }
 
@@ -151,16 +177,13 @@ func ListAssignedIngredients(db *gorp.DbMap, params martini.Params, session sess
 		toDate = t.Format("2006-01-02")
 	}
 
-	assignments := []AssignedIngredientView{}
-	_, err = db.Select(&assignments,
-		"SELECT a.id, a.recipe_id, a.date, a.meal, "+
-			"i.id AS ingredient_id, i.class_id, i.name, i.amount, i.have, "+
-			"c.name AS class "+
-			"FROM assignments a, ingredients i "+
-			"LEFT OUTER JOIN ingclasses c ON (c.id=i.class_id) "+
-			"WHERE a.date>=? AND a.date<? AND a.recipe_id=i.recipe_id AND a.owner_id=? "+
-			"ORDER BY a.date",
-		fromDate, toDate, familyId)
+	store, status := getStoreQuery(db, familyId, req)
+	if status != http.StatusOK {
+		ren.JSON(status, nil)
+		return
+	}
+
+	assignments, err := selectAssignedIngredients(db, familyId, fromDate, toDate)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusNotFound, nil)
@@ -169,15 +192,93 @@ func ListAssignedIngredients(db *gorp.DbMap, params martini.Params, session sess
 
 	for i, item := range assignments {
 		if !item.ClassId.Valid {
-			class_id := Classifier.Classify(item.Name, item.Amount.String)
+			class_id := Classifier.Classify(familyId, item.Name, item.Amount.String)
 			item.setClassLocal(db, class_id)
 			assignments[i] = item
 		}
 	}
 
+	// Amounts are for the servings of each assignment.
+	err = scaleAssignedIngredients(db, familyId, assignments)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	// What is in the pantry does not need to be bought.
+	err = subtractPantry(db, familyId, assignments)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	// With a store, the ingredients follow its aisles.
+	if store != nil {
+		tree, err := selectClassTree(db)
+		if err != nil {
+			logError(err)
+			ren.JSON(http.StatusInternalServerError, nil)
+			return
+		}
+
+		newStoreOrder(tree, store).sortIngredients(assignments)
+	}
+
+	// Merge the ingredients with the same name, across all dates.
+	aggregate, _ := strconv.ParseBool(query.Get("aggregate"))
+	if aggregate {
+		ren.JSON(http.StatusOK, aggregateIngredients(assignments))
+		return
+	}
+
 	ren.JSON(http.StatusOK, assignments)
 }
 
+// ExplainClassification shows how the classifier would class an ingredient
+// with the given name and amount, with the top n classes (default 5).
+func ExplainClassification(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	query := req.URL.Query()
+
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	name := query.Get("name")
+	if name == "" {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	top := 5
+	if query.Get("n") != "" {
+		n, err := strconv.Atoi(query.Get("n"))
+		if err != nil || n < 1 {
+			ren.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		top = n
+	}
+
+	explanation := Classifier.Explain(familyId, name, query.Get("amount"), top)
+
+	classes, err := selectClassNames(db)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	for i := range explanation.Classes {
+		explanation.Classes[i].Class = classes[explanation.Classes[i].ClassId]
+	}
+
+	ren.JSON(http.StatusOK, explanation)
+}
+
 func GetIngredient(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
@@ -286,6 +387,11 @@ func UpdateIngredient(db *gorp.DbMap, params martini.Params, session sessions.Se
 		return
 	}
 
+	err = Classifier.Update(db, []Ingredient{*orig_ingredient}, []Ingredient{ingredient.Ingredient})
+	if err != nil {
+		logError(err)
+	}
+
 	ren.JSON(http.StatusOK, ingredient)
 }
 
@@ -331,5 +437,10 @@ func DeleteIngredient(db *gorp.DbMap, params martini.Params, session sessions.Se
 		return
 	}
 
+	err = Classifier.Update(db, []Ingredient{*ingredient}, nil)
+	if err != nil {
+		logError(err)
+	}
+
 	ren.JSON(http.StatusOK, ingredient)
 }
@@ -0,0 +1,441 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+)
+
+const (
+	InvitationExpiry = 7 * 24 * time.Hour
+
+	// A family sends at most InvitationLimit invitations within
+	// InvitationWindow, so that it cannot be used to send mass email.
+	InvitationLimit  = 20
+	InvitationWindow = 24 * time.Hour
+)
+
+// Invitation states. Pending invitations past their expiry time are reported
+// as expired.
+const (
+	InvitationPending   = "pending"
+	InvitationAccepted  = "accepted"
+	InvitationDeclined  = "declined"
+	InvitationExpired   = "expired"
+	InvitationCancelled = "cancelled"
+)
+
+type invitationResponse struct {
+	Message  string  `json:"message"`
+	FamilyId int64   `json:"family_id,omitempty"`
+	Families []int64 `json:"families,omitempty"`
+}
+
+func invitationStatus(invitation *Invitation, now int64) string {
+	if invitation.Status == InvitationPending && now > invitation.ExpiresOn {
+		return InvitationExpired
+	}
+	return invitation.Status
+}
+
+func findInvitation(db gorp.SqlExecutor, token string) (*Invitation, error) {
+	invitation := Invitation{}
+	err := db.SelectOne(&invitation,
+		"SELECT * FROM invitations WHERE token_hash=?",
+		hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// acceptInvitation adds the user to the invited family. The user does not need
+// to have the address the invitation was sent to; having the link is enough.
+// Users who are already members keep their current role.
+func acceptInvitation(db *gorp.DbMap, user *User, token string) (*Invitation, int) {
+	invitation, err := findInvitation(db, token)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusNotFound
+	}
+
+	now := time.Now().Unix()
+	if invitationStatus(invitation, now) != InvitationPending {
+		return invitation, http.StatusGone
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		return nil, http.StatusInternalServerError
+	}
+
+	// Claim the invitation, so that it cannot be used twice.
+	claimed, err := tx.Exec(
+		"UPDATE invitations SET status=?, user_id=?, responded_on=? WHERE id=? AND status=?",
+		InvitationAccepted, user.Id, now, invitation.Id, InvitationPending)
+	if err == nil {
+		var count int64
+		count, err = claimed.RowsAffected()
+		if err == nil && count != 1 {
+			tx.Rollback()
+			return invitation, http.StatusGone
+		}
+	}
+
+	var role string
+	if err == nil {
+		role, err = selectMemberRole(tx, user.Id, invitation.FamilyId)
+	}
+
+	if err == nil && role == "" {
+		member := FamilyMember{
+			FamilyId: invitation.FamilyId,
+			UserId:   user.Id,
+			CanEdit:  roleAtLeast(invitation.Role, RoleEditor),
+			Role:     invitation.Role,
+		}
+		err = tx.Insert(&member)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		return nil, http.StatusInternalServerError
+	}
+
+	invitation.Status = InvitationAccepted
+	invitation.UserId = user.Id
+	invitation.RespondedOn = now
+
+	return invitation, http.StatusOK
+}
+
+// acceptLoginInvitation accepts the invitation passed along when signing in or
+// signing up from an invitation link. A stale invitation does not stop the
+// user from signing in.
+func acceptLoginInvitation(db *gorp.DbMap, session sessions.Session, user *User, token string, response *AuthResponse) {
+	if token == "" {
+		return
+	}
+
+	invitation, status := acceptInvitation(db, user, token)
+	if status != http.StatusOK {
+		return
+	}
+
+	response.Families = addSessionFamily(session, invitation.FamilyId)
+	response.FamilyId = invitation.FamilyId
+}
+
+func sendInvitation(db *gorp.DbMap, config *Config, mailer Mailer, invitation *Invitation, token string) error {
+	result, err := db.Get(Family{}, invitation.FamilyId)
+	if err != nil || result == nil {
+		return fmt.Errorf("family %d not found: %v", invitation.FamilyId, err)
+	}
+	family := result.(*Family)
+
+	result, err = db.Get(User{}, invitation.InviterId)
+	if err != nil || result == nil {
+		return fmt.Errorf("user %d not found: %v", invitation.InviterId, err)
+	}
+	inviter := result.(*User)
+
+	url := fmt.Sprintf("%s/invitation.html?token=%s", config.Server.BaseURL, token)
+
+	htmlBody := fmt.Sprintf(
+		"<h1>Meal Planner</h1>"+
+			"<p>%s has invited you to plan meals together with the family %s. "+
+			"Click the link below to accept or decline. "+
+			"If you do not have an account yet, you can create one there.</p>"+
+			"<p><a href='%s'>%s</a></p>"+
+			"<p>The invitation expires in seven days.</p>",
+		html.EscapeString(inviter.Name), html.EscapeString(family.Name), url, url)
+
+	textBody := "Meal Planner\r\n" +
+		inviter.Name + " has invited you to plan meals together with the family " + family.Name + ". " +
+		"Open the link below in a web browser to accept or decline. " +
+		"If you do not have an account yet, you can create one there.\r\n" +
+		url + "\r\n" +
+		"The invitation expires in seven days.\r\n"
+
+	return mailer.Send(&Email{
+		Recipient: invitation.Email,
+		Subject:   "Meal Planner - Invitation to " + family.Name,
+		HtmlBody:  htmlBody,
+		TextBody:  textBody,
+	})
+}
+
+func ListInvitations(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	invitations := []Invitation{}
+	_, err := db.Select(&invitations,
+		"SELECT * FROM invitations WHERE family_id=? ORDER BY id",
+		familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	now := time.Now().Unix()
+	for i := range invitations {
+		invitations[i].Status = invitationStatus(&invitations[i], now)
+	}
+
+	ren.JSON(http.StatusOK, invitations)
+}
+
+func CreateInvitation(db *gorp.DbMap, config *Config, mailer Mailer, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	userId, ok := session.Get("UserId").(int64)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	invitation := Invitation{
+		Role: RoleEditor,
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&invitation)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	address, err := mail.ParseAddress(invitation.Email)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+	invitation.Email = address.Address
+
+	// Ownership is not handed out through invitations.
+	if invitation.Role != RoleEditor && invitation.Role != RoleViewer {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	count, err := db.SelectInt(
+		"SELECT COUNT(*) "+
+			"FROM familymembers m JOIN users u ON m.user_id=u.id "+
+			"WHERE m.family_id=? AND u.email=?",
+		familyId, invitation.Email)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if count > 0 {
+		ren.JSON(http.StatusConflict, nil)
+		return
+	}
+
+	now := time.Now()
+
+	sent, err := db.SelectInt(
+		"SELECT COUNT(*) FROM invitations WHERE family_id=? AND created_on>?",
+		familyId, now.Add(-InvitationWindow).Unix())
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if sent >= InvitationLimit {
+		logError(fmt.Errorf("invitation limit reached for family %d", familyId))
+		ren.JSON(http.StatusTooManyRequests, nil)
+		return
+	}
+
+	// Inviting somebody again replaces the earlier invitation.
+	_, err = db.Exec(
+		"UPDATE invitations SET status=?, responded_on=? WHERE family_id=? AND email=? AND status=?",
+		InvitationCancelled, now.Unix(), familyId, invitation.Email, InvitationPending)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	token := newToken()
+
+	// No messing around with protected fields.
+	invitation.Id = 0
+	invitation.FamilyId = familyId
+	invitation.InviterId = userId
+	invitation.TokenHash = hashToken(token)
+	invitation.Status = InvitationPending
+	invitation.UserId = 0
+	invitation.CreatedOn = now.Unix()
+	invitation.ExpiresOn = now.Add(InvitationExpiry).Unix()
+	invitation.RespondedOn = 0
+
+	err = db.Insert(&invitation)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	err = sendInvitation(db, config, mailer, &invitation, token)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, invitation)
+}
+
+func CancelInvitation(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	id, err := strconv.ParseInt(params["id"], 0, 64)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	result, err := db.Get(Invitation{}, id)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	} else if result == nil {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	invitation, ok := result.(*Invitation)
+	if !ok {
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	if invitation.FamilyId != familyId {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	now := time.Now().Unix()
+	if invitationStatus(invitation, now) != InvitationPending {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	invitation.Status = InvitationCancelled
+	invitation.RespondedOn = now
+
+	_, err = db.Update(invitation)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, invitation)
+}
+
+func AcceptInvitation(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	response := invitationResponse{}
+
+	// Accepting changes the cookie session, which an API token cannot do.
+	if _, ok := checkCookieSession(session); !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	user := getUser(db, session)
+	if user == nil {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	invitation, status := acceptInvitation(db, user, req.FormValue("token"))
+	switch status {
+	case http.StatusOK:
+		response.Message = "You have joined the family."
+		response.FamilyId = invitation.FamilyId
+		response.Families = addSessionFamily(session, invitation.FamilyId)
+	case http.StatusNotFound:
+		response.Message = "The invitation link is not valid."
+	case http.StatusGone:
+		response.Message = "The invitation is no longer valid. Please ask for a new one."
+	default:
+		response.Message = "Server error - please try again later."
+	}
+
+	ren.JSON(status, &response)
+}
+
+// DeclineInvitation does not require signing in, so that people without an
+// account can decline too.
+func DeclineInvitation(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	response := invitationResponse{}
+
+	invitation, err := findInvitation(db, req.FormValue("token"))
+	if err != nil {
+		logError(err)
+		response.Message = "The invitation link is not valid."
+		ren.JSON(http.StatusNotFound, &response)
+		return
+	}
+
+	now := time.Now().Unix()
+	if invitationStatus(invitation, now) != InvitationPending {
+		response.Message = "The invitation is no longer valid."
+		ren.JSON(http.StatusGone, &response)
+		return
+	}
+
+	userId, _ := session.Get("UserId").(int64)
+
+	declined, err := db.Exec(
+		"UPDATE invitations SET status=?, user_id=?, responded_on=? WHERE id=? AND status=?",
+		InvitationDeclined, userId, now, invitation.Id, InvitationPending)
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	if count, err := declined.RowsAffected(); err != nil || count != 1 {
+		response.Message = "The invitation is no longer valid."
+		ren.JSON(http.StatusGone, &response)
+		return
+	}
+
+	response.Message = "You have declined the invitation."
+	ren.JSON(http.StatusOK, &response)
+}
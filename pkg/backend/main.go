@@ -1,14 +1,12 @@
 package backend
 
 import (
-	"database/sql"
 	"net/http"
 	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
 	"github.com/martini-contrib/sessions"
-	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/gorp.v2"
 )
 
@@ -18,47 +16,24 @@ func panicOnErr(err error) {
 	}
 }
 
-var Classifier *classifier
-
-func configureDB(db *sql.DB) {
-	// synchronous=OFF increases the risk for data loss if the server crashes,
-	// but it was the easiest way to get the write performance up to an
-	// acceptable level.
-	commands := `
-		PRAGMA synchronous = NORMAL;
-	`
-
-	_, err := db.Exec(commands)
-	panicOnErr(err)
-}
+var Classifier IngredientClassifier
 
 func expiresHeader() string {
 	return time.Now().Add(time.Hour * 24).Format(http.TimeFormat)
 }
 
-func Run() {
-	db, err := sql.Open("sqlite3", "mealplanner.db")
-	panicOnErr(err)
-	defer db.Close()
-
-	configureDB(db)
-
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
-	dbmap.AddTableWithName(Migration{}, "migrations").SetKeys(true, "Id")
-	dbmap.AddTableWithName(Family{}, "families").SetKeys(true, "Id")
-	dbmap.AddTableWithName(FamilyMember{}, "familymembers").SetKeys(true, "Id")
-	dbmap.AddTableWithName(User{}, "users").SetKeys(true, "Id")
-	dbmap.AddTableWithName(Recipe{}, "recipes").SetKeys(true, "Id")
-	dbmap.AddTableWithName(Ingredient{}, "ingredients").SetKeys(true, "Id")
-	dbmap.AddTableWithName(IngredientClass{}, "ingclasses").SetKeys(true, "Id")
-	dbmap.AddTableWithName(Assignment{}, "assignments").SetKeys(true, "Id")
-	err = dbmap.CreateTablesIfNotExists()
+func Run(config Config) {
+	dbmap, err := OpenDatabase(config.Database.Driver, config.Database.Source)
 	panicOnErr(err)
+	defer dbmap.Db.Close()
 
-    MigrateDatabase(dbmap)
+	MigrateDatabase(dbmap)
 
-	Classifier = NewClassifier()
-	Classifier.Train(dbmap)
+	mailer, err := NewMailer(&config.Email)
+	panicOnErr(err)
+
+	Classifier, err = LoadClassifier(dbmap, config.Classifier.Strategy)
+	panicOnErr(err)
 
 	mainRouter := martini.NewRouter()
 	m := martini.New()
@@ -84,19 +59,22 @@ func Run() {
 		res.Header().Set("Cache-Control", "private, no-store, max-age=0")
 	})
 
-	store := sessions.NewCookieStore([]byte("wieth5cie2sheuRieTi5lahh3aih4aerugh5faelaim8shi2nophis2iekuth7Ae"))
+	sessionKey, err := config.Server.sessionKey()
+	panicOnErr(err)
+
+	store := sessions.NewCookieStore(sessionKey)
 	m.Use(sessions.Sessions("session", store))
 
-	checkUser := func(session sessions.Session, w http.ResponseWriter, r *http.Request) {
-		userId := session.Get("UserId")
-		if userId == nil {
+	checkUser := func(db *gorp.DbMap, session sessions.Session, w http.ResponseWriter, r *http.Request) {
+		user := getUser(db, session)
+		if user == nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		}
 	}
 
-	checkAdmin := func(session sessions.Session, w http.ResponseWriter, r *http.Request) {
-		admin := session.Get("Admin")
-		if admin != true {
+	checkAdmin := func(db *gorp.DbMap, session sessions.Session, w http.ResponseWriter, r *http.Request) {
+		user := getUser(db, session)
+		if user == nil || !user.Admin.Bool {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		}
 	}
@@ -107,14 +85,18 @@ func Run() {
 	mainRouter.Get("/landing.html", ViewLandingPage)
 	mainRouter.Get("/sign-up.html", ViewSignUpPage)
 	mainRouter.Get("/sign-out.html", ViewSignOutPage)
+	mainRouter.Get("/forgot-password.html", ViewForgotPasswordPage)
+	mainRouter.Get("/reset-password.html", ViewResetPasswordPage)
 	mainRouter.Get("/family/:family_id/view.html", ViewAssignedRecipes)
 	mainRouter.Get("/family/:family_id/edit.html", ViewEditPage)
 	mainRouter.Get("/family/:family_id/shopping.html", ViewShoppingPage)
+	mainRouter.Get("/family/:family_id/pantry.html", ViewPantryPage)
 	mainRouter.Get("/family/:family_id/recipes.html", ViewRecipesPage)
 	mainRouter.Post("/family/:family_id/recipes.html", ImportAndViewRecipesPage)
 	mainRouter.Get("/family/:family_id/recipe/:recipe_id/edit.html", ViewRecipePage)
 	mainRouter.Get("/user/:user_id/profile.html", ViewProfilePage)
-	mainRouter.Get("/user/:user_id/verify.html", ViewVerifiedPage)
+	mainRouter.Get("/verify-email.html", ViewVerifyEmailPage)
+	mainRouter.Get("/invitation.html", ViewInvitationPage)
 
 	// Admin pages
 	mainRouter.Group("/admin", func(r martini.Router) {
@@ -126,49 +108,105 @@ func Run() {
 		r.Post("/login", GetToken)
 		r.Post("/logout", ClearToken)
 		r.Post("/register", CreateAccount)
+		r.Post("/password-reset", RequestPasswordReset)
+		r.Post("/password-reset/confirm", ResetPassword)
+		r.Post("/invitations/decline", DeclineInvitation)
 	})
 
 	// Authenticated routes
 	mainRouter.Group("/api", func(r martini.Router) {
 		r.Get("/families", ListFamilies)
-		r.Get("/families/:family_id", GetFamily)
-		r.Put("/families/:family_id", UpdateFamily)
+		r.Post("/families", CreateFamily)
+		r.Post("/families/import", ImportFamilyArchive)
+		r.Get("/families/:family_id", authorizeFamily, GetFamily)
+		r.Put("/families/:family_id", authorizeFamily, requireFamilyRole(RoleOwner), UpdateFamily)
+		r.Delete("/families/:family_id", authorizeFamily, requireFamilyRole(RoleOwner), DeleteFamily)
+		r.Post("/families/:family_id/transfer", authorizeFamily, requireFamilyRole(RoleOwner), TransferFamily)
+
+		r.Post("/logout-all", ClearAllSessions)
 
 		r.Get("/users/:id", GetUser)
 		r.Put("/users/:id", UpdateUser)
 		r.Put("/users/:id/password", UpdateUserPassword)
 		r.Post("/users/:id/verification", SendEmailVerification)
 
+		r.Get("/tokens", ListTokens)
+		r.Post("/tokens", CreateToken)
+		r.Put("/tokens/:id", UpdateToken)
+		r.Delete("/tokens/:id", RevokeToken)
+
+		r.Post("/invitations/accept", AcceptInvitation)
+
+		// Ingredient classes are shared, so only admins can change them.
+		r.Get("/classes", ListClasses)
+		r.Post("/classes", checkAdmin, CreateClass)
+		r.Get("/classes/:id", GetClass)
+		r.Put("/classes/:id", checkAdmin, UpdateClass)
+		r.Delete("/classes/:id", checkAdmin, DeleteClass)
+		r.Post("/classes/:id/merge", checkAdmin, MergeClasses)
+
+		// Roles are checked for every family route in authorizeFamily.
 		r.Group("/family/:family_id", func(family martini.Router) {
+			family.Get("/permissions", GetFamilyPermissions)
+			family.Get("/export", ExportFamilyArchive)
+			family.Post("/restore", requireFamilyRole(RoleOwner), RestoreFamilyArchive)
+
 			family.Get("/members", ListMembers)
-			family.Post("/members", CreateMember)
-			family.Delete("/members/:id", DeleteMember)
+			family.Post("/members", requireFamilyRole(RoleOwner), CreateMember)
+			family.Put("/members/:id", requireFamilyRole(RoleOwner), UpdateMember)
+			family.Delete("/members/:id", requireFamilyRole(RoleOwner), DeleteMember)
+
+			family.Get("/invitations", requireFamilyRole(RoleOwner), ListInvitations)
+			family.Post("/invitations", requireFamilyRole(RoleOwner), CreateInvitation)
+			family.Delete("/invitations/:id", requireFamilyRole(RoleOwner), CancelInvitation)
 
 			family.Get("/recipes", ListRecipes)
 			family.Post("/recipes", CreateRecipe)
 			family.Get("/recipes/assigned", ListAssignedRecipes)
+			family.Get("/recipes/search", SearchRecipes)
 			family.Get("/recipes/:id", GetRecipe)
 			family.Put("/recipes/:id", UpdateRecipe)
 			family.Delete("/recipes/:id", DeleteRecipe)
 			family.Post("/recipes/import", ImportRecipes)
+			family.Post("/recipes/import/page", ImportWebRecipes)
+
+			family.Get("/imports", ListImports)
+			family.Delete("/imports/:id", UndoImport)
 
 			family.Get("/ingredients", ListIngredients)
 			family.Post("/ingredients", CreateIngredient)
 			family.Get("/ingredients/assigned", ListAssignedIngredients)
+			family.Get("/ingredients/classify", ExplainClassification)
 			family.Get("/ingredients/:id", GetIngredient)
 			family.Put("/ingredients/:id", UpdateIngredient)
 			family.Delete("/ingredients/:id", DeleteIngredient)
 
+			family.Get("/stores", ListStores)
+			family.Post("/stores", CreateStore)
+			family.Get("/stores/:id", GetStore)
+			family.Put("/stores/:id", UpdateStore)
+			family.Delete("/stores/:id", DeleteStore)
+
+			family.Get("/pantry", ListPantry)
+			family.Post("/pantry", CreatePantryItem)
+			family.Post("/pantry/stock", AddPantryStock)
+			family.Get("/pantry/:id", GetPantryItem)
+			family.Put("/pantry/:id", UpdatePantryItem)
+			family.Delete("/pantry/:id", DeletePantryItem)
+
 			family.Get("/assignments", ListAssignments)
 			family.Post("/assignments", CreateAssignment)
 			family.Get("/assignments/:id", GetAssignment)
 			family.Put("/assignments/:id", UpdateAssignment)
 			family.Delete("/assignments/:id", DeleteAssignment)
-		})
-	}, checkUser)
+			family.Post("/assignments/:id/cook", CookAssignment)
+		}, authorizeFamily)
+	}, authenticateToken, checkUser)
 
-	// Make db available to handlers.
+	// Make db, config and mailer available to handlers.
 	m.Map(dbmap)
+	m.Map(&config)
+	m.MapTo(mailer, (*Mailer)(nil))
 
-	m.Run()
+	m.RunOnAddr(config.Server.Addr())
 }
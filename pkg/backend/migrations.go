@@ -2,12 +2,13 @@ package backend
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"gopkg.in/gorp.v2"
 )
 
-var migrations []string{
+var migrations = []string{
     // Version 1: Add migration table.
     `
     CREATE TABLE migrations (
@@ -152,6 +153,291 @@ var migrations []string{
     `
     UPDATE users SET email_token = "aeWieheuz3eidohpuataishool0Op8sh" WHERE email_token IS NULL
     `,
+
+    // Version 26: Add the 'sessions_valid_after' field to users.
+    `
+    ALTER TABLE users ADD COLUMN sessions_valid_after INTEGER
+    `,
+
+    // Version 27: Populate the 'sessions_valid_after' field.
+    `
+    UPDATE users SET sessions_valid_after = 0 WHERE sessions_valid_after IS NULL
+    `,
+
+    // Version 28: Added 'passwordresets' table.
+    `
+    CREATE TABLE passwordresets (
+        id         integer not null primary key autoincrement,
+        user_id    integer,
+        token_hash text,
+        created_on integer,
+        expires_on integer,
+        used_on    integer
+    )
+    `,
+
+    // Version 29: Add the 'email_token_expires_on' field to users.
+    `
+    ALTER TABLE users ADD COLUMN email_token_expires_on INTEGER
+    `,
+
+    // Version 30: Add the 'email_token_address' field to users.
+    `
+    ALTER TABLE users ADD COLUMN email_token_address TEXT
+    `,
+
+    // Version 31: Discard the shared token set by version 25.
+    `
+    UPDATE users SET email_token = '', email_token_expires_on = 0, email_token_address = ''
+    `,
+
+    // Version 32: Added 'apitokens' table.
+    `
+    CREATE TABLE apitokens (
+        id           integer not null primary key autoincrement,
+        user_id      integer,
+        name         text,
+        token_hash   text,
+        prefix       text,
+        family_id    integer,
+        scope        text,
+        created_on   integer,
+        last_used_on integer,
+        revoked_on   integer
+    )
+    `,
+
+    // Version 33: Add 'role' field to familymembers table.
+    `
+    ALTER TABLE familymembers ADD COLUMN role TEXT
+    `,
+
+    // Version 34: Populate the role field. The user who created the family
+    // owns it, and the others keep the access that can_edit gave them.
+    `
+    UPDATE familymembers
+    SET role = CASE
+        WHEN user_id = (SELECT user_id FROM families WHERE families.id = familymembers.family_id) THEN 'owner'
+        WHEN can_edit THEN 'editor'
+        ELSE 'viewer'
+    END
+    `,
+
+    // Version 35: Added 'invitations' table.
+    `
+    CREATE TABLE invitations (
+        id           integer not null primary key autoincrement,
+        family_id    integer,
+        inviter_id   integer,
+        email        text,
+        role         text,
+        token_hash   text,
+        status       text,
+        user_id      integer,
+        created_on   integer,
+        expires_on   integer,
+        responded_on integer
+    )
+    `,
+
+    // Version 36: Added 'classifierclasses' table.
+    `
+    CREATE TABLE classifierclasses (
+        id       integer not null primary key autoincrement,
+        class_id integer not null unique,
+        count    integer
+    )
+    `,
+
+    // Version 37: Added 'classifierfeatures' table.
+    `
+    CREATE TABLE classifierfeatures (
+        id       integer not null primary key autoincrement,
+        class_id integer not null,
+        feature  text not null,
+        count    integer,
+        unique (class_id, feature)
+    )
+    `,
+
+    // Version 38: Drop the global 'classifierfeatures' table. The counts are
+    // rebuilt per family from the ingredients on startup.
+    `
+    DROP TABLE classifierfeatures
+    `,
+
+    // Version 39: Drop the global 'classifierclasses' table.
+    `
+    DROP TABLE classifierclasses
+    `,
+
+    // Version 40: Added 'classifierclasses' table with counts per family.
+    `
+    CREATE TABLE classifierclasses (
+        id        integer not null primary key autoincrement,
+        family_id integer not null,
+        class_id  integer not null,
+        count     integer,
+        unique (family_id, class_id)
+    )
+    `,
+
+    // Version 41: Added 'classifierfeatures' table with counts per family.
+    `
+    CREATE TABLE classifierfeatures (
+        id        integer not null primary key autoincrement,
+        family_id integer not null,
+        class_id  integer not null,
+        feature   text not null,
+        count     integer,
+        unique (family_id, class_id, feature)
+    )
+    `,
+
+    // Version 42: Add the 'private_classifier' field to families.
+    `
+    ALTER TABLE families ADD COLUMN private_classifier BOOLEAN
+    `,
+
+    // Version 43: Populate the 'private_classifier' field.
+    `
+    UPDATE families SET private_classifier = false WHERE private_classifier IS NULL
+    `,
+
+    // Version 44: Added 'stores' table.
+    `
+    CREATE TABLE stores (
+        id               integer not null primary key autoincrement,
+        family_id        integer,
+        name             text,
+        unknown_position integer
+    )
+    `,
+
+    // Version 45: Added 'storeaisles' table.
+    `
+    CREATE TABLE storeaisles (
+        id       integer not null primary key autoincrement,
+        store_id integer not null,
+        class_id integer not null,
+        position integer,
+        unique (store_id, class_id)
+    )
+    `,
+
+    // Version 46: Add the 'quantity' field to ingredients.
+    `
+    ALTER TABLE ingredients ADD COLUMN quantity REAL
+    `,
+
+    // Version 47: Add the 'quantity_max' field to ingredients.
+    `
+    ALTER TABLE ingredients ADD COLUMN quantity_max REAL
+    `,
+
+    // Version 48: Add the 'unit' field to ingredients. The quantity fields
+    // are populated by populateQuantities.
+    `
+    ALTER TABLE ingredients ADD COLUMN unit TEXT
+    `,
+
+    // Version 49: Add the 'servings' field to assignments.
+    `
+    ALTER TABLE assignments ADD COLUMN servings INTEGER
+    `,
+
+    // Version 50: Add the 'default_servings' field to families.
+    `
+    ALTER TABLE families ADD COLUMN default_servings INTEGER
+    `,
+
+    // Version 51: Added 'pantryitems' table.
+    `
+    CREATE TABLE pantryitems (
+        id        integer not null primary key autoincrement,
+        family_id integer,
+        name      text,
+        quantity  real,
+        unit      text,
+        always    boolean
+    )
+    `,
+
+    // Version 52: Add the 'cooked' field to assignments.
+    `
+    ALTER TABLE assignments ADD COLUMN cooked BOOLEAN
+    `,
+
+    // Version 53: Populate the 'cooked' field.
+    `
+    UPDATE assignments SET cooked = false WHERE cooked IS NULL
+    `,
+
+    // Version 54: Added 'imports' table. Recipes imported before have a
+    // client-chosen import_id without an import.
+    `
+    CREATE TABLE imports (
+        id         integer not null primary key autoincrement,
+        family_id  integer,
+        user_id    integer,
+        file_name  text,
+        recipes    integer,
+        created_on integer,
+        undone_on  integer
+    )
+    `,
+
+    // Version 55: Add the 'prep_time' field to recipes.
+    `
+    ALTER TABLE recipes ADD COLUMN prep_time INTEGER
+    `,
+
+    // Version 56: Add the 'cook_time' field to recipes.
+    `
+    ALTER TABLE recipes ADD COLUMN cook_time INTEGER
+    `,
+
+    // Version 57: Add the 'total_time' field to recipes.
+    `
+    ALTER TABLE recipes ADD COLUMN total_time INTEGER
+    `,
+
+    // Version 58: Add the 'yield' field to recipes.
+    `
+    ALTER TABLE recipes ADD COLUMN yield TEXT
+    `,
+
+    // Version 59: Add the 'notes' field to recipes.
+    `
+    ALTER TABLE recipes ADD COLUMN notes TEXT
+    `,
+
+    // Version 60: Added 'recipesteps' table.
+    `
+    CREATE TABLE recipesteps (
+        id        integer not null primary key autoincrement,
+        recipe_id integer not null,
+        position  integer,
+        text      text
+    )
+    `,
+
+    // Version 61: Added 'recipetags' table.
+    `
+    CREATE TABLE recipetags (
+        id        integer not null primary key autoincrement,
+        recipe_id integer not null,
+        kind      text,
+        name      text,
+        unique (recipe_id, kind, name)
+    )
+    `,
+}
+
+// Steps that cannot be written in SQL, run right after the migration to the
+// given version.
+var migrationHooks = map[int64]func(db *gorp.DbMap) error{
+	48: populateQuantities,
 }
 
 func getDatabaseVersion(db *gorp.DbMap) int64 {
@@ -185,21 +471,78 @@ func CheckDatabaseVersion(db *gorp.DbMap) {
 	}
 }
 
+// hasTables reports whether the database already contains the application
+// tables, as opposed to being freshly created.
+func hasTables(db *gorp.DbMap) bool {
+	_, err := db.SelectInt("SELECT COUNT(*) FROM users")
+	return err == nil
+}
+
+// adaptMigration rewrites the SQLite flavoured migration statements for the
+// dialect in use.
+func adaptMigration(db *gorp.DbMap, query string) string {
+	if _, ok := db.Dialect.(postgresDialect); ok {
+		query = strings.Replace(query,
+			"integer not null primary key autoincrement",
+			"bigserial primary key", -1)
+	}
+	return query
+}
+
+// MigrateDatabase brings the schema up to ExpectDatabaseVersion. A fresh
+// database gets its tables straight from the model definitions, so the
+// migrations only run against databases created by older versions.
 func MigrateDatabase(db *gorp.DbMap) {
-    version := getDatabaseVersion(db)
-    for version < len(migrations) {
-        fmt.Println("Migrate to version: %d", version+1)
-        fmt.Println(migrations[version])
-
-        err := db.Execute(migrations[version])
-        if err != nil {
-            panic(err.Error())
-        }
-
-        version++
-        err = setDatabaseVersion(db, version)
-        if err != nil {
-            panic(err.Error())
-        }
-    }
+	if !hasTables(db) {
+		err := db.CreateTablesIfNotExists()
+		if err != nil {
+			panic(err.Error())
+		}
+
+		err = setDatabaseVersion(db, ExpectDatabaseVersion)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		err = setupRecipeSearch(db)
+		if err != nil {
+			panic(err.Error())
+		}
+		return
+	}
+
+	version := getDatabaseVersion(db)
+	for version < int64(len(migrations)) {
+		fmt.Printf("Migrate to version: %d\n", version+1)
+		fmt.Println(migrations[version])
+
+		_, err := db.Exec(adaptMigration(db, migrations[version]))
+		if err != nil {
+			panic(err.Error())
+		}
+
+		if hook, ok := migrationHooks[version+1]; ok {
+			err = hook(db)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+
+		version++
+		err = setDatabaseVersion(db, version)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	// Tables added without a migration are created here.
+	err := db.CreateTablesIfNotExists()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	err = setupRecipeSearch(db)
+	if err != nil {
+		panic(err.Error())
+	}
 }
@@ -20,9 +20,38 @@ import (
  * 22 - Add User.Name
  * 23 - Add User.EmailVerified
  * 24 - Add User.EmailToken
+ * 26 - Add User.SessionsValidAfter
+ * 28 - Add PasswordReset
+ * 29 - Add User.EmailTokenExpiresOn
+ * 30 - Add User.EmailTokenAddress
+ * 32 - Add ApiToken
+ * 33 - Add FamilyMember.Role
+ * 35 - Add Invitation
+ * 36 - Add ClassifierClass
+ * 37 - Add ClassifierFeature
+ * 40 - Add ClassifierClass.FamilyId
+ * 41 - Add ClassifierFeature.FamilyId
+ * 42 - Add Family.PrivateClassifier
+ * 44 - Add Store
+ * 45 - Add StoreAisle
+ * 46 - Add Ingredient.Quantity
+ * 47 - Add Ingredient.QuantityMax
+ * 48 - Add Ingredient.Unit
+ * 49 - Add Assignment.Servings
+ * 50 - Add Family.DefaultServings
+ * 51 - Add PantryItem
+ * 52 - Add Assignment.Cooked
+ * 54 - Add Import
+ * 55 - Add Recipe.PrepTime
+ * 56 - Add Recipe.CookTime
+ * 57 - Add Recipe.TotalTime
+ * 58 - Add Recipe.Yield
+ * 59 - Add Recipe.Notes
+ * 60 - Add RecipeStep
+ * 61 - Add RecipeTag
  */
 
-const ExpectDatabaseVersion int64 = 25
+const ExpectDatabaseVersion int64 = 61
 
 type Migration struct {
 	Id      int64 `db:"id" json:"id"`
@@ -38,13 +67,20 @@ type Family struct {
 	CreatedOn       string `db:"created_on" json:"created_on"`
 	AccountStatus   string `db:"account_status" json:"account_status"`
 	StatusExpiresOn string `db:"status_expires_on" json:"status_expires_on"`
+
+	// Keep the family's ingredient labels out of the shared classifier.
+	PrivateClassifier bool `db:"private_classifier" json:"private_classifier"`
+
+	// How many usually eat, for scaling recipes to. Null leaves them as is.
+	DefaultServings null.Int `db:"default_servings" json:"default_servings"`
 }
 
 type FamilyMember struct {
-	Id       int64 `db:"id" json:"id"`
-	FamilyId int64 `db:"family_id" json:"family_id"`
-	UserId   int64 `db:"user_id" json:"user_id"`
-	CanEdit  bool  `db:"can_edit" json:"can_edit"`
+	Id       int64  `db:"id" json:"id"`
+	FamilyId int64  `db:"family_id" json:"family_id"`
+	UserId   int64  `db:"user_id" json:"user_id"`
+	CanEdit  bool   `db:"can_edit" json:"can_edit"` // Kept in sync with Role
+	Role     string `db:"role" json:"role"`
 }
 
 type User struct {
@@ -58,8 +94,111 @@ type User struct {
 	DefaultFamilyId int64     `db:"default_family_id" json:"default_family_id"`
 	WeekStartDay    int64     `db:"week_start_day" json:"week_start_day"`
 
-	EmailVerified zero.Bool `db:"email_verified" json:"email_verified"`
-	EmailToken    string    `db:"email_token" json:"email_token"`
+	// The pending verification token (hashed), when it expires and the
+	// address it was sent to.
+	EmailVerified       zero.Bool `db:"email_verified" json:"email_verified"`
+	EmailToken          string    `db:"email_token" json:"-"`
+	EmailTokenExpiresOn int64     `db:"email_token_expires_on" json:"-"`
+	EmailTokenAddress   string    `db:"email_token_address" json:"-"`
+
+	// Sessions started at or before this time (Unix nanoseconds) are no longer
+	// valid. Nanoseconds keep a session started in the same second as a reset
+	// from slipping through.
+	SessionsValidAfter int64 `db:"sessions_valid_after" json:"-"`
+}
+
+type PasswordReset struct {
+	Id        int64  `db:"id" json:"id"`
+	UserId    int64  `db:"user_id" json:"user_id"`
+	TokenHash string `db:"token_hash" json:"-"`
+	CreatedOn int64  `db:"created_on" json:"created_on"`
+	ExpiresOn int64  `db:"expires_on" json:"expires_on"`
+	UsedOn    int64  `db:"used_on" json:"used_on"`
+}
+
+// ApiToken is a personal access token for scripts and other clients. Only a
+// hash of the token is stored.
+type ApiToken struct {
+	Id        int64  `db:"id" json:"id"`
+	UserId    int64  `db:"user_id" json:"user_id"`
+	Name      string `db:"name" json:"name"`
+	TokenHash string `db:"token_hash" json:"-"`
+	Prefix    string `db:"prefix" json:"prefix"` // First characters, for display
+
+	// The token is limited to this family if set, otherwise it works for all
+	// of the user's families.
+	FamilyId null.Int `db:"family_id" json:"family_id"`
+	Scope    string   `db:"scope" json:"scope"`
+
+	CreatedOn  int64 `db:"created_on" json:"created_on"`
+	LastUsedOn int64 `db:"last_used_on" json:"last_used_on"`
+	RevokedOn  int64 `db:"revoked_on" json:"revoked_on"`
+}
+
+// Invitation asks someone to join a family. Only a hash of the token in the
+// emailed link is stored.
+type Invitation struct {
+	Id        int64  `db:"id" json:"id"`
+	FamilyId  int64  `db:"family_id" json:"family_id"`
+	InviterId int64  `db:"inviter_id" json:"inviter_id"`
+	Email     string `db:"email" json:"email"`
+	Role      string `db:"role" json:"role"`
+	TokenHash string `db:"token_hash" json:"-"`
+	Status    string `db:"status" json:"status"`
+	UserId    int64  `db:"user_id" json:"user_id"` // Who responded, if signed in
+
+	CreatedOn   int64 `db:"created_on" json:"created_on"`
+	ExpiresOn   int64 `db:"expires_on" json:"expires_on"`
+	RespondedOn int64 `db:"responded_on" json:"responded_on"`
+}
+
+// ClassifierClass and ClassifierFeature hold each family's counts behind the
+// ingredient classifier, so that it does not have to go through every
+// ingredient on startup.
+type ClassifierClass struct {
+	Id       int64 `db:"id" json:"id"`
+	FamilyId int64 `db:"family_id" json:"family_id"`
+	ClassId  int64 `db:"class_id" json:"class_id"`
+	Count    int64 `db:"count" json:"count"`
+}
+
+type ClassifierFeature struct {
+	Id       int64  `db:"id" json:"id"`
+	FamilyId int64  `db:"family_id" json:"family_id"`
+	ClassId  int64  `db:"class_id" json:"class_id"`
+	Feature  string `db:"feature" json:"feature"`
+	Count    int64  `db:"count" json:"count"`
+}
+
+// Store is a shop that a family goes to. Its aisles list ingredient classes in
+// the order they are passed in the store.
+type Store struct {
+	Id       int64  `db:"id" json:"id"`
+	FamilyId int64  `db:"family_id" json:"family_id"`
+	Name     string `db:"name" json:"name"`
+
+	// Where classes that are not in the aisles go, as the number of aisles
+	// before them. Null puts them at the end.
+	UnknownPosition null.Int `db:"unknown_position" json:"unknown_position"`
+}
+
+type StoreAisle struct {
+	Id       int64 `db:"id" json:"id"`
+	StoreId  int64 `db:"store_id" json:"store_id"`
+	ClassId  int64 `db:"class_id" json:"class_id"`
+	Position int64 `db:"position" json:"position"`
+}
+
+// Import is a batch of recipes imported from a file. Its recipes have its
+// id as their ImportId, and it can be undone as a whole.
+type Import struct {
+	Id        int64  `db:"id" json:"id"`
+	FamilyId  int64  `db:"family_id" json:"family_id"`
+	UserId    int64  `db:"user_id" json:"user_id"`
+	FileName  string `db:"file_name" json:"file_name"`
+	Recipes   int64  `db:"recipes" json:"recipes"`
+	CreatedOn int64  `db:"created_on" json:"created_on"`
+	UndoneOn  int64  `db:"undone_on" json:"undone_on"`
 }
 
 type Recipe struct {
@@ -71,6 +210,40 @@ type Recipe struct {
 	Source   null.String `db:"source" json:"source"`
 	Servings null.Int    `db:"servings" json:"servings"`
 	ImportId int64       `db:"import_id" json:"import_id"`
+
+	// Times are in minutes. The yield is free text, like "2 loaves", next
+	// to the servings that amounts are scaled by.
+	PrepTime  null.Int    `db:"prep_time" json:"prep_time"`
+	CookTime  null.Int    `db:"cook_time" json:"cook_time"`
+	TotalTime null.Int    `db:"total_time" json:"total_time"`
+	Yield     null.String `db:"yield" json:"yield"`
+	Notes     null.String `db:"notes" json:"notes"`
+}
+
+// RecipeStep is one instruction of a recipe, in the order of its position.
+type RecipeStep struct {
+	Id       int64  `db:"id" json:"id"`
+	RecipeId int64  `db:"recipe_id" json:"recipe_id"`
+	Position int64  `db:"position" json:"position"`
+	Text     string `db:"text" json:"text"`
+}
+
+// Kinds of recipe tags. Custom tags are anything the family wants to group
+// recipes by.
+const (
+	TagCuisine = "cuisine"
+	TagCourse  = "course"
+	TagDiet    = "diet"
+	TagCustom  = "custom"
+)
+
+// RecipeTag puts a recipe in a category, like the diet "vegetarian". Names
+// are stored in lower case.
+type RecipeTag struct {
+	Id       int64  `db:"id" json:"id"`
+	RecipeId int64  `db:"recipe_id" json:"recipe_id"`
+	Kind     string `db:"kind" json:"kind"`
+	Name     string `db:"name" json:"name"`
 }
 
 type Ingredient struct {
@@ -81,6 +254,11 @@ type Ingredient struct {
 	Name     string      `db:"name" json:"name"`
 	Amount   null.String `db:"amount" json:"amount"`
 	Have     null.Bool   `db:"have" json:"have"`
+
+	// Parsed from the amount whenever the ingredient is saved.
+	Quantity    null.Float  `db:"quantity" json:"quantity"`
+	QuantityMax null.Float  `db:"quantity_max" json:"quantity_max"`
+	Unit        null.String `db:"unit" json:"unit"`
 }
 
 type IngredientClass struct {
@@ -95,4 +273,23 @@ type Assignment struct {
 	RecipeId null.Int    `db:"recipe_id" json:"recipe_id"`
 	Date     null.String `db:"date" json:"date"`
 	Meal     null.String `db:"meal" json:"meal"`
+
+	// How many will eat, instead of the family's default.
+	Servings null.Int `db:"servings" json:"servings"`
+
+	// Set once the meal is cooked and its ingredients are taken from the
+	// pantry.
+	Cooked bool `db:"cooked" json:"cooked"`
+}
+
+// PantryItem is something the family has at home. Items without a quantity
+// are there in an unknown amount. Items marked always, like salt and oil,
+// are staples that are never used up.
+type PantryItem struct {
+	Id       int64       `db:"id" json:"id"`
+	FamilyId int64       `db:"family_id" json:"family_id"`
+	Name     string      `db:"name" json:"name"`
+	Quantity null.Float  `db:"quantity" json:"quantity"`
+	Unit     null.String `db:"unit" json:"unit"`
+	Always   bool        `db:"always" json:"always"`
 }
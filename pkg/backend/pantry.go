@@ -0,0 +1,676 @@
+package backend
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// The pantry keeps what the family has at home from week to week. The
+// shopping list takes what it can from the pantry, in date order, and only
+// lists the rest. Cooking a planned meal takes its ingredients out of the
+// pantry for good. Pantry items match ingredients by name, ignoring case and
+// plurals, and in units that can be converted into each other.
+
+// How much of an assigned ingredient the pantry has.
+const (
+	PantryAlways  = "always"
+	PantryCovered = "covered"
+	PantryPartial = "partial"
+)
+
+// Quantities smaller than this count as used up.
+const pantryEpsilon = 1e-6
+
+// stockChange adds an amount to the pantry, or takes it away if Remove is
+// set. Without a quantity, the whole item is added or taken away.
+type stockChange struct {
+	Name     string      `json:"name"`
+	Quantity null.Float  `json:"quantity"`
+	Unit     null.String `json:"unit"`
+	Remove   bool        `json:"remove"`
+}
+
+func selectPantry(db gorp.SqlExecutor, familyId int64) ([]PantryItem, error) {
+	items := []PantryItem{}
+	_, err := db.Select(&items,
+		"SELECT * FROM pantryitems WHERE family_id=? ORDER BY name", familyId)
+	return items, err
+}
+
+func selectPantryItem(db gorp.SqlExecutor, familyId int64, id int64) (*PantryItem, error) {
+	items := []PantryItem{}
+	_, err := db.Select(&items,
+		"SELECT * FROM pantryitems WHERE id=? AND family_id=?", id, familyId)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+// QuantityText writes the quantity without trailing zeros, or nothing if it
+// is not known.
+func (item PantryItem) QuantityText() string {
+	if !item.Quantity.Valid {
+		return ""
+	}
+	return strconv.FormatFloat(item.Quantity.Float64, 'f', -1, 64)
+}
+
+// canonicalUnit spells known units the way the amount parser does. Other
+// units are kept as they are written.
+func canonicalUnit(unit null.String) null.String {
+	text := strings.TrimSpace(unit.String)
+	if text == "" {
+		return null.String{}
+	}
+
+	if canonical, ok := parseUnit(text); ok {
+		return null.StringFrom(canonical)
+	}
+	return null.StringFrom(strings.ToLower(text))
+}
+
+// unitRatio is how many of the unit to one of the unit from, if they can be
+// converted.
+func unitRatio(from null.String, to null.String) (float64, bool) {
+	if from.String == to.String {
+		return 1, true
+	}
+
+	a, ok := unitScales[from.String]
+	b, ok2 := unitScales[to.String]
+	if !ok || !ok2 || a.family != b.family {
+		return 0, false
+	}
+	return a.factor / b.factor, true
+}
+
+// pantryStock is the pantry as it is used up while going through the
+// ingredients.
+type pantryStock map[string][]*PantryItem
+
+func newPantryStock(items []PantryItem) pantryStock {
+	stock := make(pantryStock)
+	for i := range items {
+		key := aggregationKey(items[i].Name)
+		stock[key] = append(stock[key], &items[i])
+	}
+	return stock
+}
+
+// take takes the quantity from the pantry and returns what is left to get,
+// with how much of it the pantry had. Amounts that are not known are only
+// covered by items that are always there or in an unknown amount, and are
+// not taken from any others.
+func (stock pantryStock) take(name string, quantity null.Float, unit null.String) (float64, string) {
+	items := stock[aggregationKey(name)]
+
+	for _, item := range items {
+		if item.Always {
+			return 0, PantryAlways
+		}
+	}
+
+	if !quantity.Valid {
+		for _, item := range items {
+			if !item.Quantity.Valid || item.Quantity.Float64 > pantryEpsilon {
+				return 0, PantryCovered
+			}
+		}
+		return 0, ""
+	}
+
+	need := quantity.Float64
+	taken := false
+	for _, item := range items {
+		if !item.Quantity.Valid {
+			return 0, PantryCovered
+		}
+
+		ratio, ok := unitRatio(unit, item.Unit)
+		if !ok {
+			continue
+		}
+
+		have := item.Quantity.Float64 / ratio
+		if have <= pantryEpsilon {
+			continue
+		}
+
+		used := math.Min(have, need)
+		item.Quantity.Float64 -= used * ratio
+		need -= used
+		taken = true
+
+		if need <= pantryEpsilon {
+			return 0, PantryCovered
+		}
+	}
+
+	if taken {
+		return need, PantryPartial
+	}
+	return need, ""
+}
+
+// subtractPantry takes the assigned ingredients from the pantry in date
+// order. What the pantry has is marked as had, and the amounts of the others
+// are reduced to what is left to buy.
+func subtractPantry(db gorp.SqlExecutor, familyId int64, items []AssignedIngredientView) error {
+	pantry, err := selectPantry(db, familyId)
+	if err != nil {
+		return err
+	}
+
+	stock := newPantryStock(pantry)
+
+	for i := range items {
+		item := &items[i]
+
+		need := item.Quantity
+		if item.QuantityMax.Valid {
+			need = item.QuantityMax
+		}
+
+		left, status := stock.take(item.Name, need, item.Unit)
+
+		item.Pantry = status
+		item.Have = null.BoolFrom(status == PantryAlways || status == PantryCovered)
+
+		if status == PantryPartial {
+			item.Quantity = null.FloatFrom(left)
+			item.QuantityMax = null.Float{}
+			item.Amount = null.StringFrom(formatAmount(item.Quantity, item.QuantityMax, item.Unit))
+		}
+	}
+
+	return nil
+}
+
+// Stock is what checking off the ingredient adds to the pantry, as JSON.
+func (item AssignedIngredientView) Stock() string {
+	change := stockChange{Name: item.Name, Quantity: item.Quantity, Unit: item.Unit}
+	if item.QuantityMax.Valid {
+		change.Quantity = item.QuantityMax
+	}
+	return stockJSON([]stockChange{change})
+}
+
+// Stock is what checking off the merged ingredient adds to the pantry, as
+// JSON.
+func (item *AggregatedIngredient) Stock() string {
+	changes := []stockChange{}
+	for _, part := range item.Amounts {
+		change := stockChange{Name: item.Name}
+		if part.Quantity.Valid {
+			change.Quantity = part.Quantity
+			if part.QuantityMax.Valid {
+				change.Quantity = part.QuantityMax
+			}
+			change.Unit = part.Unit
+		}
+		changes = append(changes, change)
+	}
+
+	if len(changes) == 0 {
+		changes = append(changes, stockChange{Name: item.Name})
+	}
+	return stockJSON(changes)
+}
+
+func stockJSON(changes []stockChange) string {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		logError(err)
+		return "[]"
+	}
+	return string(data)
+}
+
+// addStock adds to or removes from the family's pantry. Items that are
+// always there do not change, and items that run out are deleted.
+func addStock(db gorp.SqlExecutor, familyId int64, changes []stockChange) error {
+	pantry, err := selectPantry(db, familyId)
+	if err != nil {
+		return err
+	}
+
+	stock := newPantryStock(pantry)
+	deleted := make(map[*PantryItem]bool)
+
+	for _, change := range changes {
+		unit := canonicalUnit(change.Unit)
+
+		// The first item that the change can be added to.
+		var found *PantryItem
+		ratio := 1.0
+		for _, item := range stock[aggregationKey(change.Name)] {
+			if deleted[item] {
+				continue
+			}
+
+			r, ok := unitRatio(unit, item.Unit)
+			if ok || item.Always || !item.Quantity.Valid || !change.Quantity.Valid {
+				found, ratio = item, r
+				break
+			}
+		}
+
+		switch {
+		case found != nil && found.Always:
+			continue
+		case found == nil && change.Remove:
+			continue
+		case found == nil:
+			item := PantryItem{
+				FamilyId: familyId,
+				Name:     strings.TrimSpace(change.Name),
+				Quantity: change.Quantity,
+				Unit:     unit,
+			}
+			err = db.Insert(&item)
+			key := aggregationKey(item.Name)
+			stock[key] = append(stock[key], &item)
+		case change.Remove && (!change.Quantity.Valid || !found.Quantity.Valid):
+			_, err = db.Delete(found)
+			deleted[found] = true
+		case !found.Quantity.Valid:
+			// An unknown amount stays unknown.
+		case !change.Quantity.Valid:
+			found.Quantity = null.Float{}
+			_, err = db.Update(found)
+		default:
+			amount := change.Quantity.Float64 * ratio
+			if change.Remove {
+				amount = -amount
+			}
+
+			found.Quantity.Float64 += amount
+			if found.Quantity.Float64 <= pantryEpsilon {
+				_, err = db.Delete(found)
+				deleted[found] = true
+			} else {
+				_, err = db.Update(found)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validatePantryItem checks the name and the quantity and spells the unit
+// the way the amount parser does.
+func validatePantryItem(item *PantryItem) bool {
+	item.Name = strings.TrimSpace(item.Name)
+	if item.Name == "" {
+		return false
+	}
+
+	if item.Quantity.Valid && (item.Quantity.Float64 < 0 ||
+		math.IsNaN(item.Quantity.Float64) || math.IsInf(item.Quantity.Float64, 0)) {
+		return false
+	}
+
+	item.Unit = canonicalUnit(item.Unit)
+	return true
+}
+
+func getPantryItemParam(db gorp.SqlExecutor, familyId int64, params martini.Params) (*PantryItem, int) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+
+	item, err := selectPantryItem(db, familyId, id)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusInternalServerError
+	} else if item == nil {
+		return nil, http.StatusNotFound
+	}
+
+	return item, http.StatusOK
+}
+
+func ListPantry(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	items, err := selectPantry(db, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, items)
+}
+
+func GetPantryItem(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	item, status := getPantryItemParam(db, familyId, params)
+	if item == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, item)
+}
+
+func CreatePantryItem(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	item := PantryItem{}
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&item)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// No messing around with protected fields.
+	item.Id = 0
+	item.FamilyId = familyId
+
+	if !validatePantryItem(&item) {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	err = db.Insert(&item)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, item)
+}
+
+func UpdatePantryItem(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	item, status := getPantryItemParam(db, familyId, params)
+	if item == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	id := item.Id
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(item)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// No messing around with protected fields.
+	item.Id = id
+	item.FamilyId = familyId
+
+	if !validatePantryItem(item) {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	_, err = db.Update(item)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, item)
+}
+
+func DeletePantryItem(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	item, status := getPantryItemParam(db, familyId, params)
+	if item == nil {
+		ren.JSON(status, nil)
+		return
+	}
+
+	_, err := db.Delete(item)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, nil)
+}
+
+// AddPantryStock adds the bought amounts to the pantry, or takes them away
+// again. It takes a list of changes, as given by Stock on the shopping list.
+func AddPantryStock(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	changes := []stockChange{}
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&changes)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	for _, change := range changes {
+		if strings.TrimSpace(change.Name) == "" ||
+			(change.Quantity.Valid && !(change.Quantity.Float64 >= 0)) {
+			ren.JSON(http.StatusBadRequest, nil)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	err = addStock(tx, familyId, changes)
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	items, err := selectPantry(db, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, items)
+}
+
+// CookAssignment marks the planned meal as cooked and takes its ingredients,
+// scaled to its servings, out of the pantry.
+func CookAssignment(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	result, err := db.Get(Assignment{}, id)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if result == nil {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	assignment := result.(*Assignment)
+	if assignment.OwnerId != familyId {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	} else if assignment.Cooked {
+		ren.JSON(http.StatusConflict, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	// Mark the assignment as cooked first. Checking the affected row count
+	// makes sure that two concurrent requests cannot both deplete the pantry.
+	claimed, err := tx.Exec(
+		"UPDATE assignments SET cooked=? WHERE id=? AND cooked=?",
+		true, assignment.Id, false)
+	if err == nil {
+		var count int64
+		count, err = claimed.RowsAffected()
+		if err == nil && count != 1 {
+			tx.Rollback()
+			ren.JSON(http.StatusConflict, nil)
+			return
+		}
+	}
+
+	if err == nil {
+		err = cookAssignment(tx, assignment)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, assignment)
+}
+
+func cookAssignment(db gorp.SqlExecutor, assignment *Assignment) error {
+	family := &Family{}
+	result, err := db.Get(Family{}, assignment.OwnerId)
+	if err != nil {
+		return err
+	} else if result != nil {
+		family = result.(*Family)
+	}
+
+	recipe := &Recipe{}
+	result, err = db.Get(Recipe{}, assignment.RecipeId.Int64)
+	if err != nil {
+		return err
+	} else if result != nil {
+		recipe = result.(*Recipe)
+	}
+
+	ingredients := []Ingredient{}
+	_, err = db.Select(&ingredients,
+		"SELECT * FROM ingredients WHERE owner_id=? AND recipe_id=?",
+		assignment.OwnerId, assignment.RecipeId)
+	if err != nil {
+		return err
+	}
+
+	pantry, err := selectPantry(db, assignment.OwnerId)
+	if err != nil {
+		return err
+	}
+
+	before := make([]null.Float, len(pantry))
+	for i, item := range pantry {
+		before[i] = item.Quantity
+	}
+
+	stock := newPantryStock(pantry)
+
+	servings := servingsFor(assignment.Servings, family)
+	for _, ingredient := range scaleIngredients(recipe, servings, ingredients) {
+		need := ingredient.Quantity
+		if ingredient.QuantityMax.Valid {
+			need = ingredient.QuantityMax
+		}
+		stock.take(ingredient.Name, need, ingredient.Unit)
+	}
+
+	// The items in the stock point into the pantry.
+	for i, item := range pantry {
+		if item.Quantity == before[i] {
+			continue
+		}
+
+		if item.Quantity.Float64 <= pantryEpsilon {
+			_, err = db.Delete(&pantry[i])
+		} else {
+			_, err = db.Update(&pantry[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	assignment.Cooked = true
+	return nil
+}
@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/gorp.v2"
+)
+
+const (
+	PasswordResetExpiry = time.Hour
+
+	// At most PasswordResetLimit reset emails are sent to an address within
+	// PasswordResetWindow.
+	PasswordResetLimit  = 3
+	PasswordResetWindow = time.Hour
+)
+
+type passwordResetResponse struct {
+	Message string `json:"message"`
+}
+
+func RequestPasswordReset(db *gorp.DbMap, config *Config, mailer Mailer, params martini.Params, req *http.Request, ren render.Render) {
+	// The same response is sent whether or not the address belongs to an
+	// account, so this cannot be used to discover users.
+	response := passwordResetResponse{
+		Message: "If an account exists for that address, we have sent it a link to reset the password.",
+	}
+
+	email := req.FormValue("email")
+	if email == "" {
+		response.Message = "Please enter your email address."
+		ren.JSON(http.StatusBadRequest, &response)
+		return
+	}
+
+	user := User{}
+	err := db.SelectOne(&user,
+		"SELECT * FROM users WHERE email=? LIMIT 1", email)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusOK, &response)
+		return
+	}
+
+	now := time.Now()
+
+	count, err := db.SelectInt(
+		"SELECT COUNT(*) FROM passwordresets WHERE user_id=? AND created_on>?",
+		user.Id, now.Add(-PasswordResetWindow).Unix())
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	if count >= PasswordResetLimit {
+		logError(fmt.Errorf("password reset limit reached for user %d", user.Id))
+		ren.JSON(http.StatusOK, &response)
+		return
+	}
+
+	token := newToken()
+
+	reset := PasswordReset{
+		UserId:    user.Id,
+		TokenHash: hashToken(token),
+		CreatedOn: now.Unix(),
+		ExpiresOn: now.Add(PasswordResetExpiry).Unix(),
+	}
+
+	err = db.Insert(&reset)
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	url := fmt.Sprintf("%s/reset-password.html?token=%s", config.Server.BaseURL, token)
+
+	htmlBody := fmt.Sprintf(
+		"<h1>Meal Planner</h1>"+
+			"<p>Somebody asked to reset the password for your account. "+
+			"If it was you, click the link below to choose a new password. "+
+			"The link expires in one hour.</p>"+
+			"<p><a href='%s'>%s</a></p>"+
+			"<p>If you did not ask for this, you can ignore this email.</p>",
+		url, url)
+
+	textBody := "Meal Planner\r\n" +
+		"Somebody asked to reset the password for your account. " +
+		"If it was you, open the link below in a web browser to choose a new password. " +
+		"The link expires in one hour.\r\n" +
+		url + "\r\n" +
+		"If you did not ask for this, you can ignore this email.\r\n"
+
+	err = mailer.Send(&Email{
+		Recipient: user.Email,
+		Subject:   "Meal Planner - Password Reset",
+		HtmlBody:  htmlBody,
+		TextBody:  textBody,
+	})
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	ren.JSON(http.StatusOK, &response)
+}
+
+func ResetPassword(db *gorp.DbMap, session sessions.Session, params martini.Params, req *http.Request, ren render.Render) {
+	response := passwordResetResponse{}
+
+	token := req.FormValue("token")
+	password := req.FormValue("password")
+
+	if password == "" {
+		response.Message = "Please choose a new password."
+		ren.JSON(http.StatusBadRequest, &response)
+		return
+	}
+
+	reset := PasswordReset{}
+	err := db.SelectOne(&reset,
+		"SELECT * FROM passwordresets WHERE token_hash=?",
+		hashToken(token))
+	if err != nil {
+		logError(err)
+		response.Message = "The reset link is not valid. Please request a new one."
+		ren.JSON(http.StatusBadRequest, &response)
+		return
+	}
+
+	now := time.Now().Unix()
+	if reset.UsedOn != 0 || now > reset.ExpiresOn {
+		response.Message = "The reset link has expired. Please request a new one."
+		ren.JSON(http.StatusBadRequest, &response)
+		return
+	}
+
+	result, err := db.Get(User{}, reset.UserId)
+	if err != nil || result == nil {
+		logError(err)
+		response.Message = "The reset link is not valid. Please request a new one."
+		ren.JSON(http.StatusBadRequest, &response)
+		return
+	}
+
+	user, ok := result.(*User)
+	if !ok {
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), -1)
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	// Claim the token. Checking the affected row count makes sure that two
+	// concurrent requests cannot both use it.
+	claimed, err := tx.Exec(
+		"UPDATE passwordresets SET used_on=? WHERE id=? AND used_on=0",
+		now, reset.Id)
+	if err == nil {
+		var count int64
+		count, err = claimed.RowsAffected()
+		if err == nil && count != 1 {
+			tx.Rollback()
+			response.Message = "The reset link has expired. Please request a new one."
+			ren.JSON(http.StatusBadRequest, &response)
+			return
+		}
+	}
+
+	// Any other outstanding links for this user are no longer needed.
+	if err == nil {
+		_, err = tx.Exec(
+			"UPDATE passwordresets SET used_on=? WHERE user_id=? AND used_on=0",
+			now, user.Id)
+	}
+
+	// Signing out everywhere and revoking the API tokens makes sure that
+	// whoever knew the old password loses access.
+	if err == nil {
+		_, err = tx.Exec(
+			"UPDATE apitokens SET revoked_on=? WHERE user_id=? AND revoked_on=0",
+			now, user.Id)
+	}
+
+	if err == nil {
+		user.Password = string(hashed)
+		user.SessionsValidAfter = time.Now().UnixNano()
+		_, err = tx.Update(user)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		response.Message = "Server error - please try again later."
+		ren.JSON(http.StatusInternalServerError, &response)
+		return
+	}
+
+	session.Clear()
+
+	response.Message = "Your password has been changed. You can now sign in with the new password."
+	ren.JSON(http.StatusOK, &response)
+}
@@ -0,0 +1,353 @@
+package backend
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Quantity is the parsed form of an ingredient amount like "1 1/2 cups" or
+// "2-3 cloves". Max is only set for ranges. Either part is null if it could
+// not be parsed, and the amount text is always kept as it was.
+type Quantity struct {
+	Value null.Float
+	Max   null.Float
+	Unit  null.String
+}
+
+// Canonical units, by their spellings and abbreviations in lower case.
+var unitAliases = map[string]string{
+	"mg": "mg", "milligram": "mg", "milligrams": "mg",
+	"g": "g", "gr": "g", "gram": "g", "grams": "g", "gramm": "g",
+	"kg": "kg", "kilo": "kg", "kilos": "kg", "kilogram": "kg", "kilograms": "kg",
+
+	"ml": "ml", "millilitre": "ml", "millilitres": "ml", "milliliter": "ml", "milliliters": "ml",
+	"cl": "cl", "centilitre": "cl", "centilitres": "cl", "centiliter": "cl", "centiliters": "cl",
+	"dl": "dl", "decilitre": "dl", "decilitres": "dl", "deciliter": "dl", "deciliters": "dl",
+	"l": "l", "ltr": "l", "litre": "l", "litres": "l", "liter": "l", "liters": "l",
+
+	"tsp": "tsp", "tsps": "tsp", "teaspoon": "tsp", "teaspoons": "tsp",
+	"tbsp": "tbsp", "tbsps": "tbsp", "tbs": "tbsp", "tbl": "tbsp", "tablespoon": "tbsp", "tablespoons": "tbsp",
+	"c": "cup", "cup": "cup", "cups": "cup",
+	"floz": "fl oz", "fl oz": "fl oz", "fluid ounce": "fl oz", "fluid ounces": "fl oz",
+	"oz": "oz", "ounce": "oz", "ounces": "oz",
+	"lb": "lb", "lbs": "lb", "pound": "lb", "pounds": "lb",
+	"pt": "pt", "pint": "pt", "pints": "pt",
+	"qt": "qt", "quart": "qt", "quarts": "qt",
+	"gal": "gal", "gallon": "gal", "gallons": "gal",
+
+	"pinch": "pinch", "pinches": "pinch",
+	"dash": "dash", "dashes": "dash",
+	"clove": "clove", "cloves": "clove",
+	"can": "can", "cans": "can", "tin": "can", "tins": "can",
+	"package": "package", "packages": "package", "pkg": "package", "pkgs": "package", "pack": "package", "packs": "package",
+	"slice": "slice", "slices": "slice",
+	"piece": "piece", "pieces": "piece", "pc": "piece", "pcs": "piece",
+	"bunch": "bunch", "bunches": "bunch",
+	"stick": "stick", "sticks": "stick",
+	"sprig": "sprig", "sprigs": "sprig",
+	"head": "head", "heads": "head",
+	"handful": "handful", "handfuls": "handful",
+}
+
+// The traditional one-letter abbreviations, which differ only in case.
+var caseSensitiveUnits = map[string]string{
+	"t": "tsp",
+	"T": "tbsp",
+}
+
+var vulgarFractions = map[rune]float64{
+	'½': 1.0 / 2, '⅓': 1.0 / 3, '⅔': 2.0 / 3, '¼': 1.0 / 4, '¾': 3.0 / 4,
+	'⅕': 1.0 / 5, '⅖': 2.0 / 5, '⅗': 3.0 / 5, '⅘': 4.0 / 5, '⅙': 1.0 / 6,
+	'⅚': 5.0 / 6, '⅛': 1.0 / 8, '⅜': 3.0 / 8, '⅝': 5.0 / 8, '⅞': 7.0 / 8,
+}
+
+var numberWords = map[string]float64{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5,
+	"six": 6, "seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11,
+	"twelve": 12, "dozen": 12, "half": 0.5,
+}
+
+// Words before the number that do not change it.
+var approximations = map[string]bool{
+	"about": true, "approx": true, "approximately": true, "ca": true,
+	"circa": true, "roughly": true,
+}
+
+var (
+	// A whole number followed by a fraction, a fraction, or a decimal with a
+	// point or comma.
+	mixedPattern    = regexp.MustCompile(`^(\d+)\s+(\d+)\s*/\s*(\d+)`)
+	fractionPattern = regexp.MustCompile(`^(\d+)\s*/\s*(\d+)`)
+	decimalPattern  = regexp.MustCompile(`^\d+(?:[.,]\d+)?`)
+	thousands       = regexp.MustCompile(`^\d{1,3}(?:,\d{3})+(?:\.\d+)?`)
+	rangePattern    = regexp.MustCompile(`^\s*(?:-|–|—|to|or)\s*`)
+	parenthesized   = regexp.MustCompile(`\([^)]*\)`)
+)
+
+// parseNumber reads a number from the start of the text and returns it with
+// the rest of the text.
+func parseNumber(text string) (float64, string, bool) {
+	text = strings.TrimLeftFunc(text, unicode.IsSpace)
+
+	if m := mixedPattern.FindStringSubmatch(text); m != nil {
+		whole, _ := strconv.ParseFloat(m[1], 64)
+		num, _ := strconv.ParseFloat(m[2], 64)
+		den, _ := strconv.ParseFloat(m[3], 64)
+		if den != 0 {
+			return whole + num/den, text[len(m[0]):], true
+		}
+	}
+
+	if m := fractionPattern.FindStringSubmatch(text); m != nil {
+		num, _ := strconv.ParseFloat(m[1], 64)
+		den, _ := strconv.ParseFloat(m[2], 64)
+		if den != 0 {
+			return num / den, text[len(m[0]):], true
+		}
+	}
+
+	if m := thousands.FindString(text); m != "" {
+		value, err := strconv.ParseFloat(strings.Replace(m, ",", "", -1), 64)
+		if err == nil {
+			return value, text[len(m):], true
+		}
+	}
+
+	if m := decimalPattern.FindString(text); m != "" {
+		value, err := strconv.ParseFloat(strings.Replace(m, ",", ".", 1), 64)
+		if err == nil {
+			rest := text[len(m):]
+
+			// A whole number followed by a vulgar fraction, as in 1½.
+			trimmed := strings.TrimLeftFunc(rest, unicode.IsSpace)
+			r, size := firstRune(trimmed)
+			if fraction, ok := vulgarFractions[r]; ok {
+				value += fraction
+				rest = trimmed[size:]
+			}
+			return value, rest, true
+		}
+	}
+
+	r, size := firstRune(text)
+	if fraction, ok := vulgarFractions[r]; ok {
+		return fraction, text[size:], true
+	}
+
+	word := leadingWord(text)
+	if value, ok := numberWords[strings.ToLower(word)]; ok {
+		return value, text[len(word):], true
+	}
+
+	return 0, text, false
+}
+
+func firstRune(text string) (rune, int) {
+	for _, r := range text {
+		return r, len(string(r))
+	}
+	return 0, 0
+}
+
+func leadingWord(text string) string {
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if end < 0 {
+		return text
+	}
+	return text[:end]
+}
+
+// parseUnit looks up the unit at the start of the text. Two-word units like
+// "fl oz" are tried first.
+func parseUnit(text string) (string, bool) {
+	unit, _, ok := splitUnit(text)
+	return unit, ok
+}
+
+func isUnitSeparator(r rune) bool {
+	return unicode.IsSpace(r) || r == '.'
+}
+
+// splitUnit is parseUnit that also returns the text after the unit, or all
+// of it if there is no unit.
+func splitUnit(text string) (string, string, bool) {
+	text = strings.TrimSpace(text)
+	words := strings.FieldsFunc(text, isUnitSeparator)
+	if len(words) == 0 {
+		return "", "", false
+	}
+
+	if len(words) >= 2 {
+		if unit, ok := unitAliases[strings.ToLower(words[0]+" "+words[1])]; ok {
+			return unit, skipWords(text, 2), true
+		}
+	}
+
+	if unit, ok := caseSensitiveUnits[words[0]]; ok {
+		return unit, skipWords(text, 1), true
+	}
+
+	if unit, ok := unitAliases[strings.ToLower(words[0])]; ok {
+		return unit, skipWords(text, 1), true
+	}
+	return "", text, false
+}
+
+// skipWords returns the text after its first n words.
+func skipWords(text string, n int) string {
+	for i := 0; i < n; i++ {
+		text = strings.TrimLeftFunc(text, isUnitSeparator)
+		end := strings.IndexFunc(text, isUnitSeparator)
+		if end < 0 {
+			return ""
+		}
+		text = text[end:]
+	}
+	return strings.TrimLeftFunc(text, isUnitSeparator)
+}
+
+// ParseQuantity parses an amount like "1 1/2 cups", "½ tsp", "2-3 cloves",
+// "200g" or "a pinch". Amounts that start with a unit count as one of it.
+// Anything after the number that is not a known unit, as in "2 large", is
+// left out.
+func ParseQuantity(amount string) Quantity {
+	quantity, _ := parseQuantity(amount)
+	return quantity
+}
+
+// parseQuantity is ParseQuantity that also returns what it left out after the
+// number and unit, as in "2 large" or "1 can (14 oz)", with any parentheses
+// at the end.
+func parseQuantity(amount string) (Quantity, string) {
+	quantity := Quantity{}
+
+	text := strings.Replace(amount, "⁄", "/", -1)
+	notes := parenthesized.FindAllString(text, -1)
+	text = strings.TrimSpace(parenthesized.ReplaceAllString(text, " "))
+	if text == "" {
+		return quantity, ""
+	}
+
+	text = strings.TrimLeft(text, "~≈ ")
+	if word := leadingWord(text); approximations[strings.ToLower(word)] {
+		text = strings.TrimLeft(text[len(word):], ". ")
+	}
+
+	value, rest, ok := parseNumber(text)
+	if !ok {
+		unit, rest, ok := splitUnit(text)
+		if ok {
+			quantity.Value = null.FloatFrom(1)
+			quantity.Unit = null.StringFrom(unit)
+		}
+		return quantity, withNotes(rest, notes)
+	}
+
+	quantity.Value = null.FloatFrom(value)
+
+	if m := rangePattern.FindString(rest); m != "" {
+		max, after, ok := parseNumber(rest[len(m):])
+		if ok && max > value {
+			quantity.Max = null.FloatFrom(max)
+			rest = after
+		} else if ok && max < 1 && strings.TrimSpace(m) == "-" {
+			// Written as 1-1/2 for one and a half.
+			quantity.Value = null.FloatFrom(value + max)
+			rest = after
+		}
+	}
+
+	if word := leadingWord(strings.TrimSpace(rest)); strings.ToLower(word) == "dozen" {
+		quantity.Value = null.FloatFrom(quantity.Value.Float64 * 12)
+		if quantity.Max.Valid {
+			quantity.Max = null.FloatFrom(quantity.Max.Float64 * 12)
+		}
+		rest = strings.TrimSpace(rest)[len(word):]
+	}
+
+	// As in "half a cup" or "2 cups of".
+	for {
+		word := strings.ToLower(leadingWord(strings.TrimSpace(rest)))
+		if word != "a" && word != "an" && word != "of" {
+			break
+		}
+		rest = strings.TrimSpace(rest)[len(word):]
+	}
+
+	unit, rest, ok := splitUnit(rest)
+	if ok {
+		quantity.Unit = null.StringFrom(unit)
+	}
+
+	return quantity, withNotes(rest, notes)
+}
+
+// withNotes adds the parenthesized notes of an amount back to the rest of it.
+func withNotes(rest string, notes []string) string {
+	return strings.Join(strings.Fields(rest+" "+strings.Join(notes, " ")), " ")
+}
+
+// parseAmount fills in the parsed form of the amount.
+func (ingredient *Ingredient) parseAmount() {
+	quantity := Quantity{}
+	if ingredient.Amount.Valid {
+		quantity = ParseQuantity(ingredient.Amount.String)
+	}
+
+	ingredient.Quantity = quantity.Value
+	ingredient.QuantityMax = quantity.Max
+	ingredient.Unit = quantity.Unit
+}
+
+// The parsed amount is derived from the amount text whenever an ingredient
+// is written, so it cannot get out of step.
+
+func (ingredient *Ingredient) PreInsert(db gorp.SqlExecutor) error {
+	ingredient.parseAmount()
+	return nil
+}
+
+func (ingredient *Ingredient) PreUpdate(db gorp.SqlExecutor) error {
+	ingredient.parseAmount()
+	return nil
+}
+
+// populateQuantities parses the amounts of the ingredients stored before the
+// quantity columns were added.
+func populateQuantities(db *gorp.DbMap) error {
+	type storedAmount struct {
+		Id     int64       `db:"id"`
+		Amount null.String `db:"amount"`
+	}
+
+	amounts := []storedAmount{}
+	_, err := db.Select(&amounts, "SELECT id, amount FROM ingredients WHERE amount IS NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stored := range amounts {
+		quantity := ParseQuantity(stored.Amount.String)
+		_, err = tx.Exec(
+			"UPDATE ingredients SET quantity=?, quantity_max=?, unit=? WHERE id=?",
+			quantity.Value, quantity.Max, quantity.Unit, stored.Id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"math"
+	"testing"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestParseQuantity(t *testing.T) {
+	none := null.Float{}
+	some := null.FloatFrom
+
+	tests := []struct {
+		amount string
+		value  null.Float
+		max    null.Float
+		unit   string
+	}{
+		{"", none, none, ""},
+		{"to taste", none, none, ""},
+		{"2", some(2), none, ""},
+		{"2 large", some(2), none, ""},
+		{"1 1/2 cups", some(1.5), none, "cup"},
+		{"1-1/2 cups", some(1.5), none, "cup"},
+		{"3/4 tsp", some(0.75), none, "tsp"},
+		{"½ tsp", some(0.5), none, "tsp"},
+		{"1½ tbsp", some(1.5), none, "tbsp"},
+		{"1 ½ tbsp", some(1.5), none, "tbsp"},
+		{"0.5 l", some(0.5), none, "l"},
+		{"0,5 l", some(0.5), none, "l"},
+		{"1,000 g", some(1000), none, "g"},
+		{"200g", some(200), none, "g"},
+		{"2-3 cloves", some(2), some(3), "clove"},
+		{"2 to 3 Tablespoons", some(2), some(3), "tbsp"},
+		{"1 T", some(1), none, "tbsp"},
+		{"1 t", some(1), none, "tsp"},
+		{"2 fl oz", some(2), none, "fl oz"},
+		{"2 tbsp.", some(2), none, "tbsp"},
+		{"1 (14 oz) can", some(1), none, "can"},
+		{"a pinch", some(1), none, "pinch"},
+		{"pinch", some(1), none, "pinch"},
+		{"half a cup", some(0.5), none, "cup"},
+		{"2 cups of", some(2), none, "cup"},
+		{"one dozen", some(12), none, ""},
+		{"about 100 grams", some(100), none, "g"},
+		{"~2 kg", some(2), none, "kg"},
+	}
+
+	for _, test := range tests {
+		quantity := ParseQuantity(test.amount)
+		if !sameFloat(quantity.Value, test.value) || !sameFloat(quantity.Max, test.max) ||
+			quantity.Unit.String != test.unit {
+			t.Errorf("ParseQuantity(%q) = %v-%v %q, want %v-%v %q", test.amount,
+				quantity.Value, quantity.Max, quantity.Unit.String, test.value, test.max, test.unit)
+		}
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	tests := []struct {
+		text string
+		unit string
+		ok   bool
+	}{
+		{"", "", false},
+		{"cups", "cup", true},
+		{"Cups", "cup", true},
+		{"fluid ounces", "fl oz", true},
+		{"oz. chocolate", "oz", true},
+		{"T", "tbsp", true},
+		{"t", "tsp", true},
+		{"large", "", false},
+	}
+
+	for _, test := range tests {
+		unit, ok := parseUnit(test.text)
+		if unit != test.unit || ok != test.ok {
+			t.Errorf("parseUnit(%q) = %q, %v, want %q, %v", test.text, unit, ok, test.unit, test.ok)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	ingredient := Ingredient{Amount: null.StringFrom("2-3 cups")}
+	ingredient.parseAmount()
+	if ingredient.Quantity.Float64 != 2 || ingredient.QuantityMax.Float64 != 3 || ingredient.Unit.String != "cup" {
+		t.Errorf("parseAmount gave %v-%v %q for 2-3 cups",
+			ingredient.Quantity, ingredient.QuantityMax, ingredient.Unit.String)
+	}
+
+	// Clearing the amount clears the quantity.
+	ingredient.Amount = null.String{}
+	ingredient.parseAmount()
+	if ingredient.Quantity.Valid || ingredient.QuantityMax.Valid || ingredient.Unit.Valid {
+		t.Errorf("parseAmount kept %v-%v %q without an amount",
+			ingredient.Quantity, ingredient.QuantityMax, ingredient.Unit.String)
+	}
+}
+
+func sameFloat(a null.Float, b null.Float) bool {
+	return a.Valid == b.Valid && (!a.Valid || math.Abs(a.Float64-b.Float64) < 1e-9)
+}
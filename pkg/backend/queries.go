@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"gopkg.in/gorp.v2"
+)
+
+// Queries shared by the API handlers and the page views. These are written
+// to run unchanged on SQLite and PostgreSQL: use ? placeholders, = rather
+// than ==, and pass booleans as parameters instead of comparing to 1.
+
+func selectFamilyIds(db gorp.SqlExecutor, userId interface{}) ([]int64, error) {
+	memberships := []FamilyMember{}
+	_, err := db.Select(&memberships,
+		"SELECT * FROM familymembers WHERE user_id=? ORDER BY family_id",
+		userId)
+	if err != nil {
+		return nil, err
+	}
+
+	families := make([]int64, 0)
+	for _, membership := range memberships {
+		families = append(families, membership.FamilyId)
+	}
+
+	return families, nil
+}
+
+func selectUserFamilies(db gorp.SqlExecutor, userId interface{}) ([]Family, error) {
+	families := []Family{}
+	_, err := db.Select(&families,
+		"SELECT f.* "+
+			"FROM families f JOIN familymembers m ON f.id=m.family_id "+
+			"WHERE m.user_id=? "+
+			"ORDER BY f.id",
+		userId)
+	return families, err
+}
+
+func selectRecipes(db gorp.SqlExecutor, familyId int64, availableOnly bool) ([]Recipe, error) {
+	recipes := []Recipe{}
+	var err error
+	if availableOnly {
+		_, err = db.Select(&recipes,
+			"SELECT * FROM recipes WHERE show=? AND owner_id=? ORDER BY LOWER(name), id",
+			true, familyId)
+	} else {
+		_, err = db.Select(&recipes,
+			"SELECT * FROM recipes WHERE owner_id=? ORDER BY LOWER(name), id",
+			familyId)
+	}
+	return recipes, err
+}
+
+func selectAssignedRecipes(db gorp.SqlExecutor, familyId int64, fromDate string, toDate string) ([]AssignedRecipeView, error) {
+	recipes := []AssignedRecipeView{}
+	_, err := db.Select(&recipes,
+		"SELECT a.id, a.recipe_id, a.date, a.meal, a.servings, a.cooked, "+
+			"r.fixed, r.name, r.source, r.servings AS recipe_servings "+
+			"FROM assignments a JOIN recipes r ON a.recipe_id=r.id "+
+			"WHERE a.date>=? AND a.date<? AND a.owner_id=?",
+		fromDate, toDate, familyId)
+	return recipes, err
+}
+
+func selectAssignedIngredients(db gorp.SqlExecutor, familyId int64, fromDate string, toDate string) ([]AssignedIngredientView, error) {
+	assignments := []AssignedIngredientView{}
+	_, err := db.Select(&assignments,
+		"SELECT a.id, a.recipe_id, a.date, a.meal, "+
+			"i.id AS ingredient_id, i.class_id, i.name, i.amount, i.have, "+
+			"i.quantity, i.quantity_max, i.unit, "+
+			"a.servings, c.name AS class, r.name AS recipe, r.servings AS recipe_servings "+
+			"FROM assignments a "+
+			"JOIN ingredients i ON a.recipe_id=i.recipe_id "+
+			"JOIN recipes r ON r.id=a.recipe_id "+
+			"LEFT OUTER JOIN ingclasses c ON c.id=i.class_id "+
+			"WHERE a.date>=? AND a.date<? AND a.owner_id=? AND a.cooked=? "+
+			"ORDER BY a.date",
+		fromDate, toDate, familyId, false)
+	return assignments, err
+}
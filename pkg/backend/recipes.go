@@ -1,10 +1,8 @@
 package backend
 
 import (
-	"bufio"
 	"encoding/json"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -18,20 +16,162 @@ import (
 
 type AssignedRecipeView struct {
 	// Assignment table
-	AssignmentId int64  `db:"id" json:"assignment_id"`
-	RecipeId     int64  `db:"recipe_id" json:"recipe_id"`
-	Date         string `db:"date" json:"date"`
-	Meal         string `db:"meal" json:"meal"`
+	AssignmentId int64    `db:"id" json:"assignment_id"`
+	RecipeId     int64    `db:"recipe_id" json:"recipe_id"`
+	Date         string   `db:"date" json:"date"`
+	Meal         string   `db:"meal" json:"meal"`
+	Servings     null.Int `db:"servings" json:"servings"`
+	Cooked       bool     `db:"cooked" json:"cooked"`
 
 	// Recipe table
-	Fixed  bool        `db:"fixed" json:"fixed"`
-	Name   string      `db:"name" json:"name"`
-	Source null.String `db:"source" json:"source"`
+	Fixed          bool        `db:"fixed" json:"fixed"`
+	Name           string      `db:"name" json:"name"`
+	Source         null.String `db:"source" json:"source"`
+	RecipeServings null.Int    `db:"recipe_servings" json:"recipe_servings"`
 }
 
-func ListRecipes(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
-	recipes := []Recipe{}
+// RecipeView is a recipe with its instruction steps in order and its tags.
+type RecipeView struct {
+	Recipe
+	Steps []string `json:"steps"`
+	Tags  []Tag    `json:"tags"`
+}
+
+// Tag is a recipe tag without the recipe.
+type Tag struct {
+	Kind string `db:"kind" json:"kind"`
+	Name string `db:"name" json:"name"`
+}
+
+var tagKinds = map[string]bool{
+	TagCuisine: true,
+	TagCourse:  true,
+	TagDiet:    true,
+	TagCustom:  true,
+}
+
+func selectRecipeSteps(db gorp.SqlExecutor, recipeId int64) ([]string, error) {
+	steps := []string{}
+	_, err := db.Select(&steps,
+		"SELECT text FROM recipesteps WHERE recipe_id=? ORDER BY position",
+		recipeId)
+	return steps, err
+}
+
+func selectRecipeTags(db gorp.SqlExecutor, recipeId int64) ([]Tag, error) {
+	tags := []Tag{}
+	_, err := db.Select(&tags,
+		"SELECT kind, name FROM recipetags WHERE recipe_id=? ORDER BY kind, name",
+		recipeId)
+	return tags, err
+}
+
+// selectRecipeView returns the recipe with its steps and tags.
+func selectRecipeView(db gorp.SqlExecutor, recipe *Recipe) (*RecipeView, error) {
+	steps, err := selectRecipeSteps(db, recipe.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := selectRecipeTags(db, recipe.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecipeView{Recipe: *recipe, Steps: steps, Tags: tags}, nil
+}
 
+// saveRecipeSteps replaces the recipe's steps with the given ones in order.
+func saveRecipeSteps(db gorp.SqlExecutor, recipeId int64, steps []string) error {
+	_, err := db.Exec("DELETE FROM recipesteps WHERE recipe_id=?", recipeId)
+	if err != nil {
+		return err
+	}
+
+	for i, text := range steps {
+		step := RecipeStep{
+			RecipeId: recipeId,
+			Position: int64(i),
+			Text:     text,
+		}
+
+		err = db.Insert(&step)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveRecipeTags replaces the recipe's tags with the given ones.
+func saveRecipeTags(db gorp.SqlExecutor, recipeId int64, tags []Tag) error {
+	_, err := db.Exec("DELETE FROM recipetags WHERE recipe_id=?", recipeId)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		recipeTag := RecipeTag{
+			RecipeId: recipeId,
+			Kind:     tag.Kind,
+			Name:     tag.Name,
+		}
+
+		err = db.Insert(&recipeTag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeTag lower-cases the tag and makes it custom if it has no kind. It
+// returns false for tags of an unknown kind.
+func normalizeTag(tag Tag) (Tag, bool) {
+	tag.Kind = strings.ToLower(strings.TrimSpace(tag.Kind))
+	tag.Name = strings.ToLower(strings.Join(strings.Fields(tag.Name), " "))
+	if tag.Kind == "" {
+		tag.Kind = TagCustom
+	}
+	return tag, tagKinds[tag.Kind]
+}
+
+// validateRecipe checks that the times are not negative and the tags are of
+// known kinds, and drops empty steps and tags.
+func validateRecipe(recipe *RecipeView) bool {
+	for _, minutes := range []null.Int{recipe.PrepTime, recipe.CookTime, recipe.TotalTime} {
+		if minutes.Valid && minutes.Int64 < 0 {
+			return false
+		}
+	}
+
+	steps := []string{}
+	for _, step := range recipe.Steps {
+		step = strings.TrimSpace(step)
+		if step != "" {
+			steps = append(steps, step)
+		}
+	}
+	recipe.Steps = steps
+
+	tags := []Tag{}
+	seen := make(map[Tag]bool)
+	for _, tag := range recipe.Tags {
+		tag, ok := normalizeTag(tag)
+		if !ok {
+			return false
+		}
+		if tag.Name != "" && !seen[tag] {
+			tags = append(tags, tag)
+			seen[tag] = true
+		}
+	}
+	recipe.Tags = tags
+
+	return true
+}
+
+func ListRecipes(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
 	familyId, ok := checkFamilyParam(params, session)
 	if !ok {
 		ren.JSON(http.StatusUnauthorized, nil)
@@ -39,13 +179,7 @@ func ListRecipes(db *gorp.DbMap, params martini.Params, session sessions.Session
 	}
 
 	filter := req.URL.Query().Get("filter")
-	var err error
-	if filter == "available" {
-		_, err = db.Select(&recipes, "SELECT * FROM recipes WHERE show=1 AND owner_id=?", familyId)
-	} else {
-		_, err = db.Select(&recipes, "SELECT * FROM recipes WHERE owner_id=?", familyId)
-	}
-
+	recipes, err := selectRecipes(db, familyId, filter == "available")
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusNotFound, nil)
@@ -62,9 +196,11 @@ func CreateRecipe(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		return
 	}
 
-	recipe := Recipe{
-		Show:  true,
-		Fixed: false,
+	recipe := RecipeView{
+		Recipe: Recipe{
+			Show:  true,
+			Fixed: false,
+		},
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -76,8 +212,36 @@ func CreateRecipe(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 
 	// No messing around with protected fields.
 	recipe.OwnerId = familyId
+	recipe.ImportId = 0
+
+	if !validateRecipe(&recipe) {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	err = tx.Insert(&recipe.Recipe)
+
+	if err == nil {
+		err = saveRecipeSteps(tx, recipe.Id, recipe.Steps)
+	}
+
+	if err == nil {
+		err = saveRecipeTags(tx, recipe.Id, recipe.Tags)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
 
-	err = db.Insert(&recipe)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusInternalServerError, nil)
@@ -107,13 +271,7 @@ func ListAssignedRecipes(db *gorp.DbMap, params martini.Params, session sessions
 		toDate = t.Format("2006-01-02")
 	}
 
-	recipes := []AssignedRecipeView{}
-	_, err := db.Select(&recipes,
-		"SELECT a.id, a.recipe_id, a.date, a.meal, "+
-			"r.fixed, r.name, r.source "+
-			"FROM assignments a, recipes r "+
-			"WHERE a.recipe_id=r.id AND a.date>=? AND a.date<? AND a.owner_id=?",
-		fromDate, toDate, familyId)
+	recipes, err := selectAssignedRecipes(db, familyId, fromDate, toDate)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusNotFound, nil)
@@ -158,9 +316,18 @@ func GetRecipe(db *gorp.DbMap, params martini.Params, session sessions.Session,
 		return
 	}
 
-	ren.JSON(http.StatusOK, recipe)
+	view, err := selectRecipeView(db, recipe)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, view)
 }
 
+// UpdateRecipe changes the fields of the recipe that are given. Steps and
+// tags that are not given are kept.
 func UpdateRecipe(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
@@ -193,17 +360,53 @@ func UpdateRecipe(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		return
 	}
 
+	view, err := selectRecipeView(db, recipe)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
 	decoder := json.NewDecoder(req.Body)
-	err = decoder.Decode(&recipe)
+	err = decoder.Decode(view)
 	if err != nil {
 		ren.JSON(http.StatusBadRequest, nil)
 		return
 	}
 
 	// No messing around with protected fields.
-	recipe.OwnerId = familyId
+	view.Id = recipe.Id
+	view.OwnerId = familyId
+	view.ImportId = recipe.ImportId
+
+	if !validateRecipe(view) {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	_, err = tx.Update(&view.Recipe)
+
+	if err == nil {
+		err = saveRecipeSteps(tx, view.Id, view.Steps)
+	}
+
+	if err == nil {
+		err = saveRecipeTags(tx, view.Id, view.Tags)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
 
-	_, err = db.Update(recipe)
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusInternalServerError, nil)
@@ -245,90 +448,34 @@ func DeleteRecipe(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		return
 	}
 
-	_, err = db.Delete(recipe)
+	tx, err := db.Begin()
 	if err != nil {
 		logError(err)
 		ren.JSON(http.StatusInternalServerError, nil)
 		return
 	}
 
-	ren.JSON(http.StatusOK, recipe)
-}
+	_, err = tx.Exec("DELETE FROM recipesteps WHERE recipe_id=?", recipe.Id)
 
-func ImportRecipes(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
-	familyId, ok := checkFamilyParam(params, session)
-	if !ok {
-		ren.JSON(http.StatusUnauthorized, nil)
-		return
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recipetags WHERE recipe_id=?", recipe.Id)
 	}
 
-	file, _, err := req.FormFile("file")
-	defer file.Close()
+	if err == nil {
+		_, err = tx.Delete(recipe)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
 
 	if err != nil {
 		logError(err)
-		ren.JSON(http.StatusBadRequest, nil)
+		ren.JSON(http.StatusInternalServerError, nil)
 		return
 	}
 
-	addedRecipes := []Recipe{}
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		recipe := Recipe{
-			OwnerId: familyId,
-			Show:    true,
-			Fixed:   false,
-		}
-
-		parts := strings.Split(scanner.Text(), ",")
-		if len(parts) >= 1 {
-			recipe.Name = parts[0]
-		}
-		if len(parts) >= 2 {
-			recipe.Source.String = parts[1]
-			recipe.Source.Valid = true
-		}
-
-		err = db.Insert(&recipe)
-		if err != nil {
-			logError(err)
-			ren.JSON(http.StatusInternalServerError, nil)
-			return
-		}
-
-		if len(parts) >= 3 {
-			pattern, _ := regexp.Compile("(.*)[[:space:]]*\\((.*)\\)")
-
-			ingredients := strings.Split(parts[2], ":")
-			for _, ing := range ingredients {
-				ingredient := Ingredient{
-					OwnerId: familyId,
-				}
-
-				ingredient.RecipeId.Int64 = recipe.Id
-				ingredient.RecipeId.Valid = true
-
-				substrings := pattern.FindStringSubmatch(ing)
-				if len(substrings) >= 3 {
-					ingredient.Name = substrings[1]
-					ingredient.Amount.String = substrings[2]
-					ingredient.Amount.Valid = true
-				} else {
-					ingredient.Name = ing
-				}
-
-				err = db.Insert(&ingredient)
-				if err != nil {
-					logError(err)
-					ren.JSON(http.StatusInternalServerError, nil)
-					return
-				}
-			}
-		}
-
-		addedRecipes = append(addedRecipes, recipe)
-	}
-
-	ren.JSON(http.StatusOK, addedRecipes)
+	ren.JSON(http.StatusOK, recipe)
 }
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+)
+
+// Roles of a family member, from most to least privileged. Owners manage the
+// family and its members, editors change recipes and the plan, and viewers
+// can only look at them.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// roleAtLeast reports whether role grants everything that required does. An
+// unknown role grants nothing.
+func roleAtLeast(role string, required string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[required]
+}
+
+// FamilyPermissions tells the UI what the current user may do in a family.
+type FamilyPermissions struct {
+	FamilyId         int64  `json:"family_id"`
+	Role             string `json:"role"`
+	CanView          bool   `json:"can_view"`
+	CanEdit          bool   `json:"can_edit"`
+	CanManageMembers bool   `json:"can_manage_members"`
+}
+
+func newFamilyPermissions(familyId int64, role string) *FamilyPermissions {
+	return &FamilyPermissions{
+		FamilyId:         familyId,
+		Role:             role,
+		CanView:          roleAtLeast(role, RoleViewer),
+		CanEdit:          roleAtLeast(role, RoleEditor),
+		CanManageMembers: roleAtLeast(role, RoleOwner),
+	}
+}
+
+// selectMemberRole returns the user's role in the family, or "" if the user
+// is not a member.
+func selectMemberRole(db gorp.SqlExecutor, userId int64, familyId int64) (string, error) {
+	role, err := db.SelectStr(
+		"SELECT role FROM familymembers WHERE user_id=? AND family_id=?",
+		userId, familyId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// getFamilyPermissions checks the family_id parameter against the session and
+// looks up the user's role in that family. Admins act as owners. Requests
+// made with a read-only API token never get more than viewer rights.
+func getFamilyPermissions(db gorp.SqlExecutor, params martini.Params, session sessions.Session) (*FamilyPermissions, bool) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		return nil, false
+	}
+
+	admin, _ := session.Get("Admin").(bool)
+	if admin {
+		return newFamilyPermissions(familyId, RoleOwner), true
+	}
+
+	userId, ok := session.Get("UserId").(int64)
+	if !ok {
+		return nil, false
+	}
+
+	role, err := selectMemberRole(db, userId, familyId)
+	if err != nil {
+		logError(err)
+		return nil, false
+	}
+
+	if !validRole(role) {
+		return nil, false
+	}
+
+	if scope, _ := session.Get("TokenScope").(string); scope == TokenScopeRead {
+		role = RoleViewer
+	}
+
+	return newFamilyPermissions(familyId, role), true
+}
+
+// authorizeFamily is middleware for the family API routes. Members may read
+// everything, but only editors and owners may change anything. The
+// permissions are mapped for handlers that need finer checks.
+func authorizeFamily(c martini.Context, db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+	permissions, ok := getFamilyPermissions(db, params, session)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" && !permissions.CanEdit {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	c.Map(permissions)
+}
+
+// requireFamilyRole returns middleware that must follow authorizeFamily and
+// restricts a route to members with at least the given role.
+func requireFamilyRole(required string) martini.Handler {
+	return func(permissions *FamilyPermissions, res http.ResponseWriter) {
+		if !roleAtLeast(permissions.Role, required) {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+		}
+	}
+}
+
+func GetFamilyPermissions(permissions *FamilyPermissions, ren render.Render) {
+	ren.JSON(http.StatusOK, permissions)
+}
@@ -0,0 +1,508 @@
+package backend
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+)
+
+// Recipes are searched with an SQLite FTS5 index if the SQLite library has
+// it, which needs the sqlite_fts5 build tag. Triggers keep the index up to
+// date with the recipes, their ingredients, steps and tags, so it does not
+// matter which handler changes them. Without FTS5, and with PostgreSQL, the
+// search falls back to LIKE.
+
+// The text of a recipe in the search index.
+const recipeSearchText = `
+    SELECT r.id, r.name,
+        COALESCE((SELECT group_concat(name, ' ') FROM ingredients WHERE recipe_id=r.id), ''),
+        COALESCE((SELECT group_concat(name, ' ') FROM recipetags WHERE recipe_id=r.id), ''),
+        COALESCE(r.source, '') || ' ' || COALESCE(r.notes, '') || ' ' ||
+        COALESCE((SELECT group_concat(text, ' ') FROM recipesteps WHERE recipe_id=r.id), '')
+    FROM recipes r`
+
+// The tables whose changes update the index, with the column that points to
+// the recipe.
+var recipeSearchSources = []struct {
+	table  string
+	column string
+}{
+	{"recipes", "id"},
+	{"ingredients", "recipe_id"},
+	{"recipesteps", "recipe_id"},
+	{"recipetags", "recipe_id"},
+}
+
+// Bigger weights make matches in a column count more. The order is that of
+// the index columns: name, ingredients, tags and the rest.
+const recipeSearchRank = "bm25(recipesearch, 10.0, 4.0, 4.0, 1.0)"
+
+// The most recipes on a page of search results.
+const maxSearchPageSize = 100
+
+func recipeSearchTrigger(table string, event string) string {
+	return "recipesearch_" + table + "_" + event
+}
+
+// refreshRecipeSearch returns statements that index the recipe again.
+func refreshRecipeSearch(recipeId string) string {
+	return "DELETE FROM recipesearch WHERE rowid=" + recipeId + "; " +
+		"INSERT INTO recipesearch (rowid, name, ingredients, tags, body)" +
+		recipeSearchText + " WHERE r.id=" + recipeId + ";"
+}
+
+// setupRecipeSearch creates the search index and its triggers and indexes
+// all recipes, if the SQLite library has FTS5. Otherwise it removes triggers
+// that a build with FTS5 left behind, since they would fail.
+func setupRecipeSearch(db *gorp.DbMap) error {
+	if _, ok := db.Dialect.(sqliteDialect); !ok {
+		return nil
+	}
+
+	fts5, err := db.SelectInt("SELECT sqlite_compileoption_used('ENABLE_FTS5')")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, source := range recipeSearchSources {
+		for _, event := range []string{"insert", "update", "delete"} {
+			if err == nil {
+				_, err = tx.Exec("DROP TRIGGER IF EXISTS " + recipeSearchTrigger(source.table, event))
+			}
+		}
+	}
+
+	if err == nil && fts5 == 1 {
+		err = createRecipeSearch(tx)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+func createRecipeSearch(tx *gorp.Transaction) error {
+	_, err := tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS recipesearch " +
+		"USING fts5(name, ingredients, tags, body, tokenize='porter unicode61')")
+	if err != nil {
+		return err
+	}
+
+	for _, source := range recipeSearchSources {
+		triggers := map[string]string{
+			"insert": "AFTER INSERT ON " + source.table + " BEGIN " +
+				refreshRecipeSearch("NEW."+source.column),
+			"update": "AFTER UPDATE ON " + source.table + " BEGIN " +
+				refreshRecipeSearch("OLD."+source.column) + " " +
+				refreshRecipeSearch("NEW."+source.column),
+			"delete": "AFTER DELETE ON " + source.table + " BEGIN " +
+				refreshRecipeSearch("OLD."+source.column),
+		}
+
+		// A deleted recipe only leaves the index.
+		if source.table == "recipes" {
+			triggers["delete"] = "AFTER DELETE ON recipes BEGIN " +
+				"DELETE FROM recipesearch WHERE rowid=OLD.id;"
+		}
+
+		for event, body := range triggers {
+			_, err = tx.Exec("CREATE TRIGGER " + recipeSearchTrigger(source.table, event) +
+				" " + body + " END")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Changes made while the triggers were missing are picked up here.
+	_, err = tx.Exec("DELETE FROM recipesearch")
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO recipesearch (rowid, name, ingredients, tags, body)" +
+			recipeSearchText)
+	}
+	return err
+}
+
+// hasRecipeSearch tells whether the search index is there and kept up to
+// date.
+func hasRecipeSearch(db gorp.SqlExecutor, dialect gorp.Dialect) (bool, error) {
+	if _, ok := dialect.(sqliteDialect); !ok {
+		return false, nil
+	}
+
+	count, err := db.SelectInt("SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name=?",
+		recipeSearchTrigger("recipes", "insert"))
+	return count > 0, err
+}
+
+// RecipeQuery is a recipe search. All of its conditions have to match.
+type RecipeQuery struct {
+	Text          string
+	Tags          []Tag // Tags without a kind match any kind
+	Has           []string
+	Without       []string
+	MaxTime       int64 // Minutes, or 0 for any
+	AvailableOnly bool
+	Sort          string
+	Page          int // Starts at 1
+	PerPage       int
+}
+
+// The orders of search results. Relevance is the default with a text query,
+// and name otherwise.
+const (
+	SortRelevance = "relevance"
+	SortName      = "name"
+	SortTime      = "time"
+	SortRecent    = "recent"
+)
+
+type SearchedRecipe struct {
+	Recipe
+	Tags []Tag `json:"tags"`
+}
+
+// TagFacet tells how many of the recipes found have the tag.
+type TagFacet struct {
+	Kind  string `db:"kind" json:"kind"`
+	Name  string `db:"name" json:"name"`
+	Count int64  `db:"count" json:"count"`
+}
+
+// RecipeSearchResult is a page of the recipes found, with the tags of all of
+// them for narrowing the search down.
+type RecipeSearchResult struct {
+	Recipes  []SearchedRecipe `json:"recipes"`
+	Facets   []TagFacet       `json:"facets"`
+	Total    int64            `json:"total"`
+	Page     int              `json:"page"`
+	PerPage  int              `json:"per_page"`
+	Pages    int64            `json:"pages"`
+	FullText bool             `json:"full_text"`
+}
+
+// The time a recipe takes, if it is known.
+const recipeTime = "COALESCE(r.total_time, r.prep_time + r.cook_time)"
+
+// likePattern matches the text anywhere, in any case.
+func likePattern(text string) string {
+	text = strings.ToLower(text)
+	text = strings.Replace(text, `\`, `\\`, -1)
+	text = strings.Replace(text, "%", `\%`, -1)
+	text = strings.Replace(text, "_", `\_`, -1)
+	return "%" + text + "%"
+}
+
+// matchQuery turns the words into an FTS5 query for rows that have all of
+// them, each as a word or the start of one.
+func matchQuery(words []string) string {
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + strings.Replace(word, `"`, `""`, -1) + `"*`
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchConditions returns the tables and the conditions for the recipes the
+// query matches, with their arguments.
+func searchConditions(query *RecipeQuery, familyId int64, fullText bool) (string, []string, []interface{}) {
+	from := "recipes r"
+	conditions := []string{"r.owner_id=?"}
+	args := []interface{}{familyId}
+
+	if query.AvailableOnly {
+		conditions = append(conditions, "r.show=?")
+		args = append(args, true)
+	}
+
+	words := strings.Fields(query.Text)
+	if len(words) > 0 && fullText {
+		from = "recipes r JOIN recipesearch ON recipesearch.rowid=r.id"
+		conditions = append(conditions, "recipesearch MATCH ?")
+		args = append(args, matchQuery(words))
+	} else {
+		for _, word := range words {
+			conditions = append(conditions, "(LOWER(r.name) LIKE ? ESCAPE '\\' OR "+
+				"LOWER(COALESCE(r.source, '')) LIKE ? ESCAPE '\\' OR "+
+				"LOWER(COALESCE(r.notes, '')) LIKE ? ESCAPE '\\' OR "+
+				"EXISTS (SELECT 1 FROM ingredients i WHERE i.recipe_id=r.id AND LOWER(i.name) LIKE ? ESCAPE '\\') OR "+
+				"EXISTS (SELECT 1 FROM recipesteps s WHERE s.recipe_id=r.id AND LOWER(s.text) LIKE ? ESCAPE '\\') OR "+
+				"EXISTS (SELECT 1 FROM recipetags t WHERE t.recipe_id=r.id AND t.name LIKE ? ESCAPE '\\'))")
+			pattern := likePattern(word)
+			for i := 0; i < 6; i++ {
+				args = append(args, pattern)
+			}
+		}
+	}
+
+	for _, tag := range query.Tags {
+		if tag.Kind == "" {
+			conditions = append(conditions,
+				"EXISTS (SELECT 1 FROM recipetags t WHERE t.recipe_id=r.id AND t.name=?)")
+			args = append(args, tag.Name)
+		} else {
+			conditions = append(conditions,
+				"EXISTS (SELECT 1 FROM recipetags t WHERE t.recipe_id=r.id AND t.kind=? AND t.name=?)")
+			args = append(args, tag.Kind, tag.Name)
+		}
+	}
+
+	for _, name := range query.Has {
+		conditions = append(conditions,
+			"EXISTS (SELECT 1 FROM ingredients i WHERE i.recipe_id=r.id AND LOWER(i.name) LIKE ? ESCAPE '\\')")
+		args = append(args, likePattern(name))
+	}
+
+	for _, name := range query.Without {
+		conditions = append(conditions,
+			"NOT EXISTS (SELECT 1 FROM ingredients i WHERE i.recipe_id=r.id AND LOWER(i.name) LIKE ? ESCAPE '\\')")
+		args = append(args, likePattern(name))
+	}
+
+	if query.MaxTime > 0 {
+		conditions = append(conditions, recipeTime+"<=?")
+		args = append(args, query.MaxTime)
+	}
+
+	return from, conditions, args
+}
+
+// searchOrder returns the ORDER BY clause for the sort of the query, with
+// its arguments.
+func searchOrder(query *RecipeQuery, fullText bool) (string, []interface{}) {
+	byName := "LOWER(r.name), r.id"
+	text := strings.TrimSpace(query.Text)
+
+	switch query.Sort {
+	case SortTime:
+		// Recipes without a time come last.
+		return "CASE WHEN " + recipeTime + " IS NULL THEN 1 ELSE 0 END, " +
+			recipeTime + ", " + byName, nil
+	case SortRecent:
+		return "r.id DESC", nil
+	case SortRelevance:
+		if text == "" {
+			break
+		} else if fullText {
+			return recipeSearchRank + ", " + byName, nil
+		}
+
+		// Without the index, recipes with the text in the name come first.
+		return "CASE WHEN LOWER(r.name) LIKE ? ESCAPE '\\' THEN 0 ELSE 1 END, " + byName,
+			[]interface{}{likePattern(text)}
+	}
+
+	return byName, nil
+}
+
+// searchRecipes returns the page of the query's results and the facets.
+func searchRecipes(db *gorp.DbMap, familyId int64, query *RecipeQuery) (*RecipeSearchResult, error) {
+	fullText, err := hasRecipeSearch(db, db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	from, conditions, args := searchConditions(query, familyId, fullText)
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	result := &RecipeSearchResult{
+		Recipes:  []SearchedRecipe{},
+		Facets:   []TagFacet{},
+		Page:     query.Page,
+		PerPage:  query.PerPage,
+		FullText: fullText,
+	}
+
+	result.Total, err = db.SelectInt("SELECT COUNT(*) FROM "+from+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	result.Pages = (result.Total + int64(query.PerPage) - 1) / int64(query.PerPage)
+
+	_, err = db.Select(&result.Facets,
+		"SELECT kind, name, COUNT(*) AS count FROM recipetags "+
+			"WHERE recipe_id IN (SELECT r.id FROM "+from+where+") "+
+			"GROUP BY kind, name ORDER BY kind, count DESC, name",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	order, orderArgs := searchOrder(query, fullText)
+	pageArgs := append(append(args, orderArgs...),
+		query.PerPage, (query.Page-1)*query.PerPage)
+
+	recipes := []Recipe{}
+	_, err = db.Select(&recipes,
+		"SELECT r.* FROM "+from+where+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		pageArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := selectTagsOfRecipes(db, recipes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recipe := range recipes {
+		recipeTags := tags[recipe.Id]
+		if recipeTags == nil {
+			recipeTags = []Tag{}
+		}
+		result.Recipes = append(result.Recipes, SearchedRecipe{Recipe: recipe, Tags: recipeTags})
+	}
+
+	return result, nil
+}
+
+// selectTagsOfRecipes returns the tags of all the recipes by recipe id.
+func selectTagsOfRecipes(db gorp.SqlExecutor, recipes []Recipe) (map[int64][]Tag, error) {
+	tags := make(map[int64][]Tag)
+	if len(recipes) == 0 {
+		return tags, nil
+	}
+
+	placeholders := make([]string, len(recipes))
+	args := make([]interface{}, len(recipes))
+	for i, recipe := range recipes {
+		placeholders[i] = "?"
+		args[i] = recipe.Id
+	}
+
+	rows := []RecipeTag{}
+	_, err := db.Select(&rows,
+		"SELECT * FROM recipetags WHERE recipe_id IN ("+strings.Join(placeholders, ", ")+") "+
+			"ORDER BY kind, name",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		tags[row.RecipeId] = append(tags[row.RecipeId], Tag{Kind: row.Kind, Name: row.Name})
+	}
+	return tags, nil
+}
+
+// parseTagParam reads a tag as kind:name, or as a name of any kind.
+func parseTagParam(value string) (Tag, bool) {
+	kind := ""
+	if i := strings.Index(value, ":"); i >= 0 && tagKinds[strings.ToLower(value[:i])] {
+		kind, value = value[:i], value[i+1:]
+	}
+
+	tag, _ := normalizeTag(Tag{Kind: kind, Name: value})
+	if kind == "" {
+		tag.Kind = ""
+	}
+	return tag, tag.Name != ""
+}
+
+// parseRecipeQuery reads the search from the query string. It returns nil if
+// the search is not valid.
+func parseRecipeQuery(req *http.Request) *RecipeQuery {
+	values := req.URL.Query()
+
+	query := &RecipeQuery{
+		Text:          values.Get("q"),
+		AvailableOnly: values.Get("filter") == "available",
+		Sort:          values.Get("sort"),
+		Page:          1,
+		PerPage:       20,
+	}
+
+	for _, value := range values["tag"] {
+		tag, ok := parseTagParam(value)
+		if !ok {
+			return nil
+		}
+		query.Tags = append(query.Tags, tag)
+	}
+
+	for _, name := range values["has"] {
+		if name = strings.TrimSpace(name); name != "" {
+			query.Has = append(query.Has, name)
+		}
+	}
+
+	for _, name := range values["without"] {
+		if name = strings.TrimSpace(name); name != "" {
+			query.Without = append(query.Without, name)
+		}
+	}
+
+	var err error
+	if value := values.Get("max_time"); value != "" {
+		query.MaxTime, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || query.MaxTime <= 0 {
+			return nil
+		}
+	}
+
+	if value := values.Get("page"); value != "" {
+		query.Page, err = strconv.Atoi(value)
+		if err != nil || query.Page < 1 {
+			return nil
+		}
+	}
+
+	if value := values.Get("per_page"); value != "" {
+		query.PerPage, err = strconv.Atoi(value)
+		if err != nil || query.PerPage < 1 || query.PerPage > maxSearchPageSize {
+			return nil
+		}
+	}
+
+	switch query.Sort {
+	case "":
+		query.Sort = SortName
+		if strings.TrimSpace(query.Text) != "" {
+			query.Sort = SortRelevance
+		}
+	case SortRelevance, SortName, SortTime, SortRecent:
+	default:
+		return nil
+	}
+
+	return query
+}
+
+// SearchRecipes finds the family's recipes by text, tags, ingredients and
+// time, a page at a time.
+func SearchRecipes(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	query := parseRecipeQuery(req)
+	if query == nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	result, err := searchRecipes(db, familyId, query)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Recipes are scaled from the servings they are written for to the servings
+// of the assignment, or else the family's default. Recipes without servings
+// are never scaled.
+
+// servingsFor returns the assignment's servings, or the family's default.
+func servingsFor(servings null.Int, family *Family) null.Int {
+	if servings.Valid {
+		return servings
+	}
+	return family.DefaultServings
+}
+
+// servingsScale is the factor from the recipe's servings to the given ones.
+func servingsScale(recipeServings null.Int, servings null.Int) float64 {
+	if !recipeServings.Valid || recipeServings.Int64 <= 0 ||
+		!servings.Valid || servings.Int64 <= 0 {
+		return 1
+	}
+	return float64(servings.Int64) / float64(recipeServings.Int64)
+}
+
+// scaleQuantity multiplies the parsed amount. The amount text is rewritten
+// from the result, unless it could not be parsed. Whatever else the amount
+// says, as in "2 large" or "1 can (14 oz)", follows the new number.
+func scaleQuantity(amount *null.String, quantity *null.Float, max *null.Float, unit null.String, scale float64) {
+	if scale == 1 || !quantity.Valid {
+		return
+	}
+
+	quantity.Float64 *= scale
+	if max.Valid {
+		max.Float64 *= scale
+	}
+
+	text := formatAmount(*quantity, *max, unit)
+	if _, rest := parseQuantity(amount.String); rest != "" {
+		text += " " + rest
+	}
+	*amount = null.StringFrom(text)
+}
+
+// scaleAssignedIngredients scales each ingredient to the servings of its
+// assignment.
+func scaleAssignedIngredients(db gorp.SqlExecutor, familyId int64, items []AssignedIngredientView) error {
+	result, err := db.Get(Family{}, familyId)
+	if err != nil {
+		return err
+	}
+
+	family := &Family{}
+	if result != nil {
+		family = result.(*Family)
+	}
+
+	for i := range items {
+		item := &items[i]
+
+		item.Scale = servingsScale(item.RecipeServings, servingsFor(item.Servings, family))
+		item.OriginalAmount = item.Amount
+
+		scaleQuantity(&item.Amount, &item.Quantity, &item.QuantityMax, item.Unit, item.Scale)
+	}
+
+	return nil
+}
+
+// scaleIngredients scales a recipe's ingredients to the given servings.
+func scaleIngredients(recipe *Recipe, servings null.Int, ingredients []Ingredient) []Ingredient {
+	scale := servingsScale(recipe.Servings, servings)
+
+	scaled := make([]Ingredient, len(ingredients))
+	for i, ingredient := range ingredients {
+		scaleQuantity(&ingredient.Amount, &ingredient.Quantity, &ingredient.QuantityMax, ingredient.Unit, scale)
+		scaled[i] = ingredient
+	}
+	return scaled
+}
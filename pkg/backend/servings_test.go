@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"testing"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestScaleQuantity(t *testing.T) {
+	tests := []struct {
+		amount string
+		scale  float64
+		want   string
+	}{
+		{"2", 2, "4"},
+		{"1 1/2 cups", 0.5, "3/4 cup"},
+		{"2-3 cloves", 2, "4-6 cloves"},
+		{"2 large", 2, "4 large"},
+		{"1 can (14 oz)", 2, "2 cans (14 oz)"},
+		{"1 (14 oz) can", 3, "3 cans (14 oz)"},
+		{"2 tbsp. softened", 0.5, "1 tbsp softened"},
+		{"a pinch", 2, "2 pinches"},
+		{"to taste", 2, "to taste"},
+		{"2 large", 1, "2 large"},
+	}
+
+	for _, test := range tests {
+		quantity := ParseQuantity(test.amount)
+		amount := null.StringFrom(test.amount)
+		scaleQuantity(&amount, &quantity.Value, &quantity.Max, quantity.Unit, test.scale)
+		if amount.String != test.want {
+			t.Errorf("scaling %q by %v gave %q, want %q", test.amount, test.scale, amount.String, test.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"gopkg.in/gorp.v2"
+)
+
+// Supported database drivers.
+const (
+	DriverSqlite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// The guregu null and zero types are structs named Int, Bool, etc., which
+// the gorp dialects do not recognize and would map to text columns.
+func nullSqlType(val reflect.Type) string {
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+
+	path := val.PkgPath()
+	if !strings.HasPrefix(path, "gopkg.in/guregu/null.v3") {
+		return ""
+	}
+
+	switch val.Name() {
+	case "Int":
+		return "bigint"
+	case "Float":
+		return "double precision"
+	case "Bool":
+		return "boolean"
+	}
+
+	return ""
+}
+
+type sqliteDialect struct {
+	gorp.SqliteDialect
+}
+
+func (d sqliteDialect) ToSqlType(val reflect.Type, maxsize int, isAutoIncr bool) string {
+	switch nullSqlType(val) {
+	case "bigint", "boolean":
+		return "integer"
+	case "double precision":
+		return "real"
+	}
+
+	return d.SqliteDialect.ToSqlType(val, maxsize, isAutoIncr)
+}
+
+type postgresDialect struct {
+	gorp.PostgresDialect
+}
+
+func (d postgresDialect) ToSqlType(val reflect.Type, maxsize int, isAutoIncr bool) string {
+	if sqlType := nullSqlType(val); sqlType != "" {
+		return sqlType
+	}
+
+	return d.PostgresDialect.ToSqlType(val, maxsize, isAutoIncr)
+}
+
+// rebind rewrites the ? placeholders used throughout the handlers into the
+// numbered $1, $2, ... form expected by PostgreSQL. Placeholders inside
+// quoted strings or identifiers are left alone.
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var result strings.Builder
+	var quote rune
+	n := 0
+
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			result.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		result.WriteRune(c)
+	}
+
+	return result.String()
+}
+
+// rebindConnector wraps the PostgreSQL driver so that every statement passes
+// through rebind before it reaches the server.
+type rebindConnector struct {
+	driver.Connector
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rebindConn{conn}, nil
+}
+
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c *rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c *rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, rebind(query))
+	}
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c *rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if queryer, ok := c.Conn.(driver.QueryerContext); ok {
+		return queryer.QueryContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := c.Conn.(driver.ExecerContext); ok {
+		return execer.ExecContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func configureSqlite(db *sql.DB) error {
+	// synchronous=OFF increases the risk for data loss if the server crashes,
+	// but it was the easiest way to get the write performance up to an
+	// acceptable level.
+	commands := `
+		PRAGMA synchronous = NORMAL;
+	`
+
+	_, err := db.Exec(commands)
+	return err
+}
+
+func registerTables(dbmap *gorp.DbMap) {
+	dbmap.AddTableWithName(Migration{}, "migrations").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Family{}, "families").SetKeys(true, "Id")
+	dbmap.AddTableWithName(FamilyMember{}, "familymembers").SetKeys(true, "Id")
+	dbmap.AddTableWithName(User{}, "users").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Recipe{}, "recipes").SetKeys(true, "Id")
+	dbmap.AddTableWithName(RecipeStep{}, "recipesteps").SetKeys(true, "Id")
+
+	tags := dbmap.AddTableWithName(RecipeTag{}, "recipetags").SetKeys(true, "Id")
+	tags.SetUniqueTogether("recipe_id", "kind", "name")
+
+	dbmap.AddTableWithName(Ingredient{}, "ingredients").SetKeys(true, "Id")
+	dbmap.AddTableWithName(IngredientClass{}, "ingclasses").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Assignment{}, "assignments").SetKeys(true, "Id")
+	dbmap.AddTableWithName(PasswordReset{}, "passwordresets").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ApiToken{}, "apitokens").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Invitation{}, "invitations").SetKeys(true, "Id")
+
+	classes := dbmap.AddTableWithName(ClassifierClass{}, "classifierclasses").SetKeys(true, "Id")
+	classes.SetUniqueTogether("family_id", "class_id")
+
+	features := dbmap.AddTableWithName(ClassifierFeature{}, "classifierfeatures").SetKeys(true, "Id")
+	features.SetUniqueTogether("family_id", "class_id", "feature")
+
+	dbmap.AddTableWithName(Store{}, "stores").SetKeys(true, "Id")
+
+	aisles := dbmap.AddTableWithName(StoreAisle{}, "storeaisles").SetKeys(true, "Id")
+	aisles.SetUniqueTogether("store_id", "class_id")
+
+	dbmap.AddTableWithName(PantryItem{}, "pantryitems").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Import{}, "imports").SetKeys(true, "Id")
+}
+
+// OpenDatabase connects to the database identified by driverName and source
+// and returns a DbMap with the dialect and tables set up. The source is a
+// file path for SQLite and a connection string or URL for PostgreSQL.
+func OpenDatabase(driverName string, source string) (*gorp.DbMap, error) {
+	var db *sql.DB
+	var dialect gorp.Dialect
+
+	switch driverName {
+	case DriverSqlite:
+		var err error
+		db, err = sql.Open(DriverSqlite, source)
+		if err != nil {
+			return nil, err
+		}
+
+		err = configureSqlite(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		dialect = sqliteDialect{}
+
+	case DriverPostgres:
+		connector, err := pq.NewConnector(source)
+		if err != nil {
+			return nil, err
+		}
+
+		db = sql.OpenDB(rebindConnector{connector})
+		err = db.Ping()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		dialect = postgresDialect{}
+
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driverName)
+	}
+
+	dbmap := &gorp.DbMap{Db: db, Dialect: dialect}
+	registerTables(dbmap)
+
+	return dbmap, nil
+}
@@ -0,0 +1,226 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/gorp.v2"
+)
+
+// The PostgreSQL tests run against the database in this environment variable,
+// e.g. postgres://mealplanner@localhost/mealplanner_test?sslmode=disable. They
+// drop everything in its public schema, so never point it at real data.
+const testPostgresEnv = "MEALPLANNER_TEST_POSTGRES"
+
+type testDatabase struct {
+	name string
+	open func(t *testing.T) (*gorp.DbMap, func())
+}
+
+// testDatabases lists the databases the storage tests run against. SQLite is
+// always tested. The PostgreSQL cases are skipped, and say so, unless
+// testPostgresEnv is set.
+func testDatabases() []testDatabase {
+	return []testDatabase{
+		{DriverSqlite, func(t *testing.T) (*gorp.DbMap, func()) { return openTestSqlite(t) }},
+		{DriverPostgres, func(t *testing.T) (*gorp.DbMap, func()) {
+			source := os.Getenv(testPostgresEnv)
+			if source == "" {
+				t.Skipf("PostgreSQL is NOT tested: set %s, or run docker-compose -f docker-compose.test.yml run --rm test",
+					testPostgresEnv)
+			}
+			return openTestPostgres(t, source)
+		}},
+	}
+}
+
+// openTestSqlite opens an empty SQLite database in a temporary directory. The
+// returned function closes and removes it.
+func openTestSqlite(t *testing.T) (*gorp.DbMap, func()) {
+	dir, err := ioutil.TempDir("", "mealplanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabase(DriverSqlite, filepath.Join(dir, "mealplanner.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func openTestPostgres(t *testing.T, source string) (*gorp.DbMap, func()) {
+	db, err := OpenDatabase(DriverPostgres, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public")
+	if err != nil {
+		db.Db.Close()
+		t.Fatal(err)
+	}
+
+	return db, func() { db.Db.Close() }
+}
+
+// openMigratedDatabase opens an empty SQLite database with the current schema.
+func openMigratedDatabase(t *testing.T) (*gorp.DbMap, func()) {
+	db, cleanup := openTestSqlite(t)
+	MigrateDatabase(db)
+	return db, cleanup
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM users", "SELECT * FROM users"},
+		{"SELECT * FROM users WHERE id=?", "SELECT * FROM users WHERE id=$1"},
+		{
+			"UPDATE users SET name=?, email=? WHERE id=?",
+			"UPDATE users SET name=$1, email=$2 WHERE id=$3",
+		},
+		{
+			"SELECT * FROM recipes WHERE name LIKE '%?%' AND owner_id=?",
+			"SELECT * FROM recipes WHERE name LIKE '%?%' AND owner_id=$1",
+		},
+		{
+			`SELECT "what?" FROM recipes WHERE id IN (?, ?)`,
+			`SELECT "what?" FROM recipes WHERE id IN ($1, $2)`,
+		},
+		{
+			"SELECT * FROM users WHERE name='it''s?' AND id=?",
+			"SELECT * FROM users WHERE name='it''s?' AND id=$1",
+		},
+	}
+
+	for _, test := range tests {
+		got := rebind(test.query)
+		if got != test.want {
+			t.Errorf("rebind(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+// testRows has a row for every table, so that a schema missing a column of
+// the models fails to store it.
+func testRows() []interface{} {
+	return []interface{}{
+		&Family{Name: "Test"},
+		&FamilyMember{FamilyId: 1, UserId: 1, Role: RoleOwner},
+		&User{Email: "test@example.com", Name: "Test"},
+		&Recipe{OwnerId: 1, Name: "Soup"},
+		&RecipeStep{RecipeId: 1, Text: "Stir."},
+		&RecipeTag{RecipeId: 1, Kind: "course", Name: "dinner"},
+		&Ingredient{OwnerId: 1, Name: "onion"},
+		&IngredientClass{Name: "Vegetables"},
+		&Assignment{OwnerId: 1},
+		&PasswordReset{UserId: 1, TokenHash: hashToken("reset")},
+		&ApiToken{UserId: 1, TokenHash: hashToken("api")},
+		&Invitation{FamilyId: 1, Email: "guest@example.com", TokenHash: hashToken("invite")},
+		&ClassifierClass{FamilyId: 1, ClassId: 1, Count: 1},
+		&ClassifierFeature{FamilyId: 1, ClassId: 1, Feature: "onion", Count: 1},
+		&Store{FamilyId: 1, Name: "Market"},
+		&StoreAisle{StoreId: 1, ClassId: 1},
+		&PantryItem{FamilyId: 1, Name: "rice"},
+		&Import{FamilyId: 1},
+	}
+}
+
+// checkSchema stores a row in every table and reads one back with a
+// placeholder, which goes through rebind on PostgreSQL.
+func checkSchema(t *testing.T, db *gorp.DbMap) {
+	for _, row := range testRows() {
+		err := db.Insert(row)
+		if err != nil {
+			t.Errorf("inserting %T: %v", row, err)
+		}
+	}
+
+	users := []User{}
+	_, err := db.Select(&users, "SELECT * FROM users WHERE email=? AND name=?", "test@example.com", "Test")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(users) != 1 {
+		t.Fatalf("selected %d users, want 1", len(users))
+	}
+
+	users[0].Name = "Renamed"
+	_, err = db.Update(&users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := db.SelectStr("SELECT name FROM users WHERE id=?", users[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if name != "Renamed" {
+		t.Errorf("name = %q after the update, want %q", name, "Renamed")
+	}
+}
+
+func TestCreateTables(t *testing.T) {
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			db, cleanup := database.open(t)
+			defer cleanup()
+
+			MigrateDatabase(db)
+			if version := getDatabaseVersion(db); version != ExpectDatabaseVersion {
+				t.Fatalf("version = %d after creating the tables, want %d", version, ExpectDatabaseVersion)
+			}
+
+			// Starting again must neither migrate nor fail on the existing
+			// tables.
+			err := db.CreateTablesIfNotExists()
+			if err != nil {
+				t.Fatal(err)
+			}
+			MigrateDatabase(db)
+			CheckDatabaseVersion(db)
+
+			checkSchema(t, db)
+		})
+	}
+}
+
+// TestMigrations upgrades a database created by the last version without the
+// migrations of this package's storage layer, schema 25, which only ever ran
+// on SQLite. PostgreSQL databases start out with the current schema.
+func TestMigrations(t *testing.T) {
+	schema, err := ioutil.ReadFile(filepath.Join("testdata", "schema-25.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, cleanup := openTestSqlite(t)
+	defer cleanup()
+
+	for _, statement := range strings.Split(string(schema), ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	MigrateDatabase(db)
+	if version := getDatabaseVersion(db); version != ExpectDatabaseVersion {
+		t.Fatalf("version = %d after migrating, want %d", version, ExpectDatabaseVersion)
+	}
+
+	checkSchema(t, db)
+}
@@ -0,0 +1,446 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"gopkg.in/gorp.v2"
+)
+
+// StoreView is a store with its aisles, as the ids of the classes in order.
+type StoreView struct {
+	Store
+	Classes []int64 `json:"classes"`
+}
+
+func selectStoreClasses(db gorp.SqlExecutor, storeId int64) ([]int64, error) {
+	classes := []int64{}
+	_, err := db.Select(&classes,
+		"SELECT class_id FROM storeaisles WHERE store_id=? ORDER BY position",
+		storeId)
+	return classes, err
+}
+
+// selectStore returns the family's store with the given id, or nil if the
+// family has no such store.
+func selectStore(db gorp.SqlExecutor, familyId int64, id int64) (*StoreView, error) {
+	stores := []Store{}
+	_, err := db.Select(&stores,
+		"SELECT * FROM stores WHERE id=? AND family_id=?", id, familyId)
+	if err != nil || len(stores) == 0 {
+		return nil, err
+	}
+
+	classes, err := selectStoreClasses(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StoreView{Store: stores[0], Classes: classes}, nil
+}
+
+func selectFamilyStores(db gorp.SqlExecutor, familyId int64) ([]StoreView, error) {
+	stores := []Store{}
+	_, err := db.Select(&stores,
+		"SELECT * FROM stores WHERE family_id=? ORDER BY name", familyId)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]StoreView, len(stores))
+	for i, store := range stores {
+		classes, err := selectStoreClasses(db, store.Id)
+		if err != nil {
+			return nil, err
+		}
+		views[i] = StoreView{Store: store, Classes: classes}
+	}
+	return views, nil
+}
+
+// saveStoreAisles replaces the store's aisles with the classes in order.
+func saveStoreAisles(db gorp.SqlExecutor, storeId int64, classes []int64) error {
+	_, err := db.Exec("DELETE FROM storeaisles WHERE store_id=?", storeId)
+	if err != nil {
+		return err
+	}
+
+	for i, class_id := range classes {
+		aisle := StoreAisle{
+			StoreId:  storeId,
+			ClassId:  class_id,
+			Position: int64(i),
+		}
+
+		err = db.Insert(&aisle)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStore checks the name and that the aisles are existing classes,
+// each listed once.
+func validateStore(db gorp.SqlExecutor, store *StoreView) (bool, error) {
+	store.Name = strings.TrimSpace(store.Name)
+	if store.Name == "" {
+		return false, nil
+	}
+
+	if store.Classes == nil {
+		store.Classes = []int64{}
+	}
+
+	if store.UnknownPosition.Valid {
+		position := store.UnknownPosition.Int64
+		if position < 0 || position > int64(len(store.Classes)) {
+			return false, nil
+		}
+	}
+
+	tree, err := selectClassTree(db)
+	if err != nil {
+		return false, err
+	}
+
+	seen := make(map[int64]bool)
+	for _, class_id := range store.Classes {
+		if _, ok := tree[class_id]; !ok || seen[class_id] {
+			return false, nil
+		}
+		seen[class_id] = true
+	}
+
+	return true, nil
+}
+
+// storeOrder ranks shopping list sections by the store's aisles. Classes
+// that are not in the aisles take the rank of their closest ancestor that
+// is, and otherwise go to the store's unknown position.
+type storeOrder struct {
+	tree      classTree
+	positions map[int64]int
+	unknown   int
+}
+
+// newStoreOrder orders by the store's aisles, or puts every class at the
+// unknown position if there is no store.
+func newStoreOrder(tree classTree, store *StoreView) *storeOrder {
+	order := &storeOrder{
+		tree:      tree,
+		positions: make(map[int64]int),
+	}
+
+	if store == nil {
+		return order
+	}
+
+	for i, class_id := range store.Classes {
+		order.positions[class_id] = 2*i + 1
+	}
+
+	order.unknown = 2 * len(store.Classes)
+	if store.UnknownPosition.Valid {
+		order.unknown = 2 * int(store.UnknownPosition.Int64)
+	}
+
+	return order
+}
+
+// rank is the sort key of the class. A class id of 0 means no class.
+func (order *storeOrder) rank(class_id int64) int {
+	for _, class := range order.tree.ancestors(class_id) {
+		if position, ok := order.positions[class.Id]; ok {
+			return position
+		}
+	}
+	return order.unknown
+}
+
+// sortSections orders the sections by rank, then by name with no class last.
+func (order *storeOrder) sortSections(sections []*AssignmentSection) {
+	sort.SliceStable(sections, func(i, j int) bool {
+		a := order.rank(sections[i].Id)
+		b := order.rank(sections[j].Id)
+		if a != b {
+			return a < b
+		}
+		if (sections[i].Id == 0) != (sections[j].Id == 0) {
+			return sections[j].Id == 0
+		}
+		return sections[i].Name < sections[j].Name
+	})
+}
+
+// sortIngredients orders assigned ingredients by the rank of their class and
+// keeps the order within a class.
+func (order *storeOrder) sortIngredients(items []AssignedIngredientView) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a := order.rank(items[i].ClassId.Int64)
+		b := order.rank(items[j].ClassId.Int64)
+		if a != b {
+			return a < b
+		}
+		if items[i].ClassId.Valid != items[j].ClassId.Valid {
+			return items[i].ClassId.Valid
+		}
+		return items[i].Class.String < items[j].Class.String
+	})
+}
+
+// getStoreQuery returns the store chosen with the store query parameter, or
+// nil if there is none. The status is not OK if the store cannot be used.
+func getStoreQuery(db gorp.SqlExecutor, familyId int64, req *http.Request) (*StoreView, int) {
+	value := req.URL.Query().Get("store")
+	if value == "" {
+		return nil, http.StatusOK
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+
+	store, err := selectStore(db, familyId, id)
+	if err != nil {
+		logError(err)
+		return nil, http.StatusInternalServerError
+	} else if store == nil {
+		return nil, http.StatusNotFound
+	}
+
+	return store, http.StatusOK
+}
+
+func ListStores(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	stores, err := selectFamilyStores(db, familyId)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, stores)
+}
+
+func GetStore(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	store, err := selectStore(db, familyId, id)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if store == nil {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, store)
+}
+
+func CreateStore(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	store := StoreView{}
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&store)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// No messing around with protected fields.
+	store.Id = 0
+	store.FamilyId = familyId
+
+	valid, err := validateStore(db, &store)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if !valid {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	err = tx.Insert(&store.Store)
+
+	if err == nil {
+		err = saveStoreAisles(tx, store.Id, store.Classes)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, store)
+}
+
+// UpdateStore renames the store or replaces its aisles. Aisles that are not
+// given are kept.
+func UpdateStore(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	store, err := selectStore(db, familyId, id)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if store == nil {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(store)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	// No messing around with protected fields.
+	store.Id = id
+	store.FamilyId = familyId
+
+	valid, err := validateStore(db, store)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if !valid {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	_, err = tx.Update(&store.Store)
+
+	if err == nil {
+		err = saveStoreAisles(tx, store.Id, store.Classes)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, store)
+}
+
+func DeleteStore(db *gorp.DbMap, params martini.Params, session sessions.Session, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	store, err := selectStore(db, familyId, id)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if store == nil {
+		ren.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM storeaisles WHERE store_id=?", id)
+
+	if err == nil {
+		_, err = tx.Delete(&store.Store)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, nil)
+}
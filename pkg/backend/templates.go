@@ -1,18 +1,16 @@
 package backend
 
 import (
-	"bufio"
 	"net/http"
-	"regexp"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/sessions"
 	"gopkg.in/flosch/pongo2.v3"
 	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
 )
 
 //var landing = pongo2.Must(pongo2.FromFile("templates/landing.html"))
@@ -27,7 +25,7 @@ func getAccountStatus(db *gorp.DbMap, session sessions.Session) (string, bool) {
 
 	families := []Family{}
 	_, err := db.Select(&families,
-		"SELECT * FROM families WHERE id==?", familyId)
+		"SELECT * FROM families WHERE id=?", familyId)
 	if err != nil || len(families) == 0 {
 		return "", false
 	}
@@ -58,22 +56,27 @@ func getUser(db *gorp.DbMap, session sessions.Session) *User {
 		return nil
 	}
 
+	if !sessionIsCurrent(session, user) {
+		session.Clear()
+		return nil
+	}
+
+	err = refreshSession(db, session, user)
+	if err != nil {
+		logError(err)
+		return nil
+	}
+
 	return user
 }
 
 func getFamilies(db *gorp.DbMap, session sessions.Session) []Family {
-	families := []Family{}
-
 	userId := session.Get("UserId")
 	if userId == nil {
-		return families
+		return []Family{}
 	}
 
-	_, err := db.Select(&families,
-		"SELECT f.* "+
-			"FROM families f, familymembers m "+
-			"WHERE m.user_id==? AND f.id==m.family_id",
-		userId)
+	families, err := selectUserFamilies(db, userId)
 	if err != nil {
 		logError(err)
 	}
@@ -107,6 +110,16 @@ func ViewSignUpPage(db *gorp.DbMap, params martini.Params, session sessions.Sess
 		"user": user,
 	}
 
+	// Signing up from an invitation link joins the family right away.
+	token := req.URL.Query().Get("invitation")
+	if token != "" {
+		invitation, err := findInvitation(db, token)
+		if err == nil {
+			context["Invitation"] = token
+			context["Email"] = invitation.Email
+		}
+	}
+
 	landing, err := pongo2.FromCache("templates/sign-up.html")
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -119,6 +132,78 @@ func ViewSignUpPage(db *gorp.DbMap, params martini.Params, session sessions.Sess
 	}
 }
 
+func ViewForgotPasswordPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+	context := pongo2.Context{
+		"user": getUser(db, session),
+	}
+
+	view, err := pongo2.FromCache("templates/forgot-password.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = view.ExecuteWriter(context, res)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func ViewResetPasswordPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+	context := pongo2.Context{
+		"user":  getUser(db, session),
+		"Token": req.URL.Query().Get("token"),
+	}
+
+	view, err := pongo2.FromCache("templates/reset-password.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = view.ExecuteWriter(context, res)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func ViewInvitationPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+	token := req.URL.Query().Get("token")
+
+	context := pongo2.Context{
+		"user":   getUser(db, session),
+		"Token":  token,
+		"Status": "invalid",
+	}
+
+	invitation, err := findInvitation(db, token)
+	if err == nil {
+		context["Status"] = invitationStatus(invitation, time.Now().Unix())
+		context["Invitation"] = invitation
+
+		result, err := db.Get(Family{}, invitation.FamilyId)
+		if err == nil && result != nil {
+			context["Family"] = result.(*Family)
+		}
+
+		result, err = db.Get(User{}, invitation.InviterId)
+		if err == nil && result != nil {
+			context["Inviter"] = result.(*User)
+		}
+	}
+
+	view, err := pongo2.FromCache("templates/invitation.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = view.ExecuteWriter(context, res)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func ViewSignOutPage(db *gorp.DbMap, params martini.Params, req *http.Request, res http.ResponseWriter) {
 	context := pongo2.Context{
 		"user": nil,
@@ -165,12 +250,14 @@ func ViewAssignedRecipes(db *gorp.DbMap, params martini.Params, session sessions
 		return
 	}
 
-	familyId, ok := checkFamilyParam(params, session)
+	permissions, ok := getFamilyPermissions(db, params, session)
 	if !ok {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	familyId := permissions.FamilyId
+
 	var start time.Time
 	var err error
 
@@ -203,13 +290,7 @@ func ViewAssignedRecipes(db *gorp.DbMap, params martini.Params, session sessions
 	prevStart := start.AddDate(0, 0, -7)
 	nextStart := start.AddDate(0, 0, 7)
 
-	recipes := []AssignedRecipeView{}
-	_, err = db.Select(&recipes,
-		"SELECT a.id, a.recipe_id, a.date, a.meal, "+
-			"r.fixed, r.name, r.source "+
-			"FROM assignments a, recipes r "+
-			"WHERE a.recipe_id=r.id AND a.date>=? AND a.date<? AND a.owner_id=?",
-		fromDate, toDate, familyId)
+	recipes, err := selectAssignedRecipes(db, familyId, fromDate, toDate)
 	if err != nil {
 		logError(err)
 		http.Error(res, err.Error(), http.StatusNotFound)
@@ -269,6 +350,7 @@ func ViewAssignedRecipes(db *gorp.DbMap, params martini.Params, session sessions
 		"User":          user,
 		"Families":      getFamilies(db, session),
 		"FamilyId":      familyId,
+		"Permissions":   permissions,
 		"Recipes":       recipes,
 		"Weeks":         weeks,
 		"NextStart":     nextStart.Format(dateFormat),
@@ -296,12 +378,20 @@ func ViewEditPage(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		return
 	}
 
-	familyId, ok := checkFamilyParam(params, session)
+	permissions, ok := getFamilyPermissions(db, params, session)
 	if !ok {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	familyId := permissions.FamilyId
+
+	// Viewers get the read-only planner instead.
+	if !permissions.CanEdit {
+		http.Redirect(res, req, "/family/"+strconv.FormatInt(familyId, 10)+"/view.html", http.StatusSeeOther)
+		return
+	}
+
 	var start time.Time
 	var end time.Time
 	var err error
@@ -333,13 +423,7 @@ func ViewEditPage(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 	prevStart := start.AddDate(0, 0, -7)
 	nextEnd := end.AddDate(0, 0, 7)
 
-	recipes := []AssignedRecipeView{}
-	_, err = db.Select(&recipes,
-		"SELECT a.id, a.recipe_id, a.date, a.meal, "+
-			"r.fixed, r.name, r.source "+
-			"FROM assignments a, recipes r "+
-			"WHERE a.recipe_id=r.id AND a.date>=? AND a.date<? AND a.owner_id=?",
-		fromDate, toDate, familyId)
+	recipes, err := selectAssignedRecipes(db, familyId, fromDate, toDate)
 	if err != nil {
 		logError(err)
 		http.Error(res, err.Error(), http.StatusNotFound)
@@ -386,12 +470,7 @@ func ViewEditPage(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		}
 	}
 
-	available := []Recipe{}
-	_, err = db.Select(&available,
-		"SELECT *"+
-			"FROM recipes "+
-			"WHERE show=1 AND owner_id=?",
-		familyId)
+	available, err := selectRecipes(db, familyId, true)
 	if err != nil {
 		logError(err)
 		http.Error(res, err.Error(), http.StatusNotFound)
@@ -406,6 +485,7 @@ func ViewEditPage(db *gorp.DbMap, params martini.Params, session sessions.Sessio
 		"Date":          time.Now().Format(dateFormat),
 		"User":          user,
 		"FamilyId":      familyId,
+		"Permissions":   permissions,
 		"Families":      getFamilies(db, session),
 		"Available":     available,
 		"Days":          days,
@@ -437,6 +517,9 @@ type AssignmentSection struct {
 	Name          string
 	Groups        map[string]*AssignmentGroup
 	OrderedGroups []*AssignmentGroup
+
+	// Merged ingredients, instead of the groups, when aggregating.
+	Items []*AggregatedIngredient
 }
 
 func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
@@ -449,12 +532,14 @@ func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Se
 		return
 	}
 
-	familyId, ok := checkFamilyParam(params, session)
+	permissions, ok := getFamilyPermissions(db, params, session)
 	if !ok {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	familyId := permissions.FamilyId
+
 	var start time.Time
 	var end time.Time
 
@@ -482,16 +567,20 @@ func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Se
 		}
 	}
 
-	assignments := []AssignedIngredientView{}
-	_, err = db.Select(&assignments,
-		"SELECT a.id, a.recipe_id, a.date, a.meal, "+
-			"i.id AS ingredient_id, i.class_id, i.name, i.amount, i.have, "+
-			"c.name AS class "+
-			"FROM assignments a, ingredients i "+
-			"LEFT OUTER JOIN ingclasses c ON (c.id=i.class_id) "+
-			"WHERE a.date>=? AND a.date<? AND a.recipe_id=i.recipe_id AND a.owner_id=? "+
-			"ORDER BY a.date",
-		fromDate, toDate, familyId)
+	store, status := getStoreQuery(db, familyId, req)
+	if status != http.StatusOK {
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+
+	stores, err := selectFamilyStores(db, familyId)
+	if err != nil {
+		logError(err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	assignments, err := selectAssignedIngredients(db, familyId, fromDate, toDate)
 	if err != nil {
 		logError(err)
 		http.Error(res, err.Error(), http.StatusNotFound)
@@ -500,43 +589,109 @@ func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Se
 
 	for i, item := range assignments {
 		if !item.ClassId.Valid {
-			class_id := Classifier.Classify(item.Name, item.Amount.String)
+			class_id := Classifier.Classify(familyId, item.Name, item.Amount.String)
 			item.setClassLocal(db, class_id)
 			assignments[i] = item
 		}
 	}
 
+	// Amounts are for the servings of each assignment.
+	err = scaleAssignedIngredients(db, familyId, assignments)
+	if err != nil {
+		logError(err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// What is in the pantry does not need to be bought.
+	err = subtractPantry(db, familyId, assignments)
+	if err != nil {
+		logError(err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tree, err := selectClassTree(db)
+	if err != nil {
+		logError(err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// With group=parent, subclasses are listed under their top-level class,
+	// for example Fruit under Produce.
+	groupByParent := (query.Get("group") == "parent")
+
+	// With aggregate=true, ingredients with the same name are merged across
+	// all dates.
+	aggregate, _ := strconv.ParseBool(query.Get("aggregate"))
+
 	sections := make(map[string]*AssignmentSection)
-	for _, item := range assignments {
-		class := item.Class.String
+
+	// sectionFor returns the section for the class, and the subclass to show
+	// next to the ingredient if it is not the section's class.
+	sectionFor := func(classId null.Int, className null.String) (*AssignmentSection, string) {
+		class := className.String
 		if class == "" {
 			class = "Miscellaneous"
 		}
 
+		subclass := ""
+		sectionId := classId.Int64
+		if classId.Valid {
+			if groupByParent {
+				top := tree.topLevel(classId.Int64)
+				if top != nil && top.Id != classId.Int64 {
+					sectionId = top.Id
+					class = top.Name
+					subclass = className.String
+				}
+			} else {
+				class = tree.path(classId.Int64)
+			}
+		}
+
 		section, ok := sections[class]
 		if !ok {
 			sections[class] = &AssignmentSection{
-				Id:            item.ClassId.Int64,
+				Id:            sectionId,
 				Name:          class,
 				Groups:        make(map[string]*AssignmentGroup),
 				OrderedGroups: make([]*AssignmentGroup, 0),
+				Items:         make([]*AggregatedIngredient, 0),
 			}
 			section = sections[class]
 		}
 
-		group, ok := section.Groups[item.Date]
-		if !ok {
-			date, _ := time.Parse(dateFormat, item.Date)
-			section.Groups[item.Date] = &AssignmentGroup{
-				Date:        date,
-				Ingredients: make([]AssignedIngredientView, 0),
-			}
-			group = section.Groups[item.Date]
+		return section, subclass
+	}
+
+	if aggregate {
+		for _, item := range aggregateIngredients(assignments) {
+			section, subclass := sectionFor(item.ClassId, item.Class)
+			item.Subclass = subclass
+			section.Items = append(section.Items, item)
 		}
+	} else {
+		for _, item := range assignments {
+			section, subclass := sectionFor(item.ClassId, item.Class)
+			item.Subclass = subclass
+
+			group, ok := section.Groups[item.Date]
+			if !ok {
+				date, _ := time.Parse(dateFormat, item.Date)
+				section.Groups[item.Date] = &AssignmentGroup{
+					Date:        date,
+					Ingredients: make([]AssignedIngredientView, 0),
+				}
+				group = section.Groups[item.Date]
+			}
 
-		group.Ingredients = append(group.Ingredients, item)
+			group.Ingredients = append(group.Ingredients, item)
+		}
 	}
 
+	orderedSections := make([]*AssignmentSection, 0)
 	for _, section := range sections {
 		for _, group := range section.Groups {
 			section.OrderedGroups = append(section.OrderedGroups, group)
@@ -544,8 +699,12 @@ func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Se
 		sort.Slice(section.OrderedGroups, func(i, j int) bool {
 			return section.OrderedGroups[i].Date.Before(section.OrderedGroups[j].Date)
 		})
+		orderedSections = append(orderedSections, section)
 	}
 
+	// Without a store, the sections are in alphabetical order.
+	newStoreOrder(tree, store).sortSections(orderedSections)
+
 	accountStatus, expired := getAccountStatus(db, session)
 
 	context := pongo2.Context{
@@ -554,10 +713,15 @@ func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Se
 		"Date":          time.Now().Format(dateFormat),
 		"User":          user,
 		"FamilyId":      familyId,
+		"Permissions":   permissions,
 		"Families":      getFamilies(db, session),
-		"Sections":      sections,
+		"Sections":      orderedSections,
 		"From":          fromDate,
 		"To":            toDate,
+		"GroupByParent": groupByParent,
+		"Aggregate":     aggregate,
+		"Store":         store,
+		"Stores":        stores,
 	}
 
 	view, err := pongo2.FromCache("templates/shopping.html")
@@ -572,32 +736,25 @@ func ViewShoppingPage(db *gorp.DbMap, params martini.Params, session sessions.Se
 	}
 }
 
-func ViewRecipesPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+func ViewPantryPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
 	user := getUser(db, session)
 	if user == nil {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	familyId, ok := checkFamilyParam(params, session)
+	permissions, ok := getFamilyPermissions(db, params, session)
 	if !ok {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	query := req.URL.Query()
-	importId := query.Get("import_id")
+	familyId := permissions.FamilyId
 
-	available := []Recipe{}
-	_, err := db.Select(&available,
-		"SELECT *"+
-			"FROM recipes "+
-			"WHERE show=1 AND owner_id=?"+
-			"AND (? OR import_id=?)",
-		familyId, importId == "", importId)
+	items, err := selectPantry(db, familyId)
 	if err != nil {
 		logError(err)
-		http.Error(res, err.Error(), http.StatusNotFound)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -609,11 +766,12 @@ func ViewRecipesPage(db *gorp.DbMap, params martini.Params, session sessions.Ses
 		"Date":          time.Now().Format(dateFormat),
 		"User":          user,
 		"FamilyId":      familyId,
+		"Permissions":   permissions,
 		"Families":      getFamilies(db, session),
-		"Recipes":       available,
+		"Items":         items,
 	}
 
-	view, err := pongo2.FromCache("templates/recipe.html")
+	view, err := pongo2.FromCache("templates/pantry.html")
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
@@ -625,92 +783,118 @@ func ViewRecipesPage(db *gorp.DbMap, params martini.Params, session sessions.Ses
 	}
 }
 
-func ImportAndViewRecipesPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+func ViewRecipesPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
 	user := getUser(db, session)
 	if user == nil {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	familyId, ok := checkFamilyParam(params, session)
+	permissions, ok := getFamilyPermissions(db, params, session)
 	if !ok {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	file, _, err := req.FormFile("file")
-	defer file.Close()
+	familyId := permissions.FamilyId
 
+	query := req.URL.Query()
+	importId, err := strconv.ParseInt(query.Get("import_id"), 10, 64)
+
+	available := []Recipe{}
+	_, err = db.Select(&available,
+		"SELECT * "+
+			"FROM recipes "+
+			"WHERE show=? AND owner_id=? "+
+			"AND (? OR import_id=?) "+
+			"ORDER BY LOWER(name), id",
+		true, familyId, err != nil, importId)
 	if err != nil {
 		logError(err)
-		http.Error(res, "Bad Request", http.StatusBadRequest)
+		http.Error(res, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	query := req.URL.Query()
+	accountStatus, expired := getAccountStatus(db, session)
 
-	// ImportId is passed by the client for the user's convenience.
-	// We will set all recipes in this batch to the given ImportId.
-	importId, _ := strconv.ParseInt(query.Get("import_id"), 10, 64)
+	context := pongo2.Context{
+		"AccountStatus": accountStatus,
+		"Expired":       expired,
+		"Date":          time.Now().Format(dateFormat),
+		"User":          user,
+		"FamilyId":      familyId,
+		"Permissions":   permissions,
+		"Families":      getFamilies(db, session),
+		"Recipes":       available,
+	}
 
-	addedRecipes := []Recipe{}
+	view, err := pongo2.FromCache("templates/recipe.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		recipe := Recipe{
-			OwnerId:  familyId,
-			ImportId: importId,
-			Show:     true,
-			Fixed:    false,
-		}
+	err = view.ExecuteWriter(context, res)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-		parts := strings.Split(scanner.Text(), ",")
-		if len(parts) >= 1 {
-			recipe.Name = parts[0]
-		}
-		if len(parts) >= 2 {
-			recipe.Source.String = parts[1]
-			recipe.Source.Valid = true
-		}
+// ImportAndViewRecipesPage imports the uploaded recipes and shows them. With
+// preview set, or if the file has errors, it shows what would be imported
+// instead. With kind set to page, the file is a web page.
+func ImportAndViewRecipesPage(db *gorp.DbMap, config *Config, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+	user := getUser(db, session)
+	if user == nil {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		err = db.Insert(&recipe)
-		if err != nil {
-			logError(err)
-			http.Error(res, "Server Error", http.StatusInternalServerError)
-			return
-		}
+	permissions, ok := getFamilyPermissions(db, params, session)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		if len(parts) >= 3 {
-			pattern, _ := regexp.Compile("(.*)[[:space:]]*\\((.*)\\)")
+	familyId := permissions.FamilyId
 
-			ingredients := strings.Split(parts[2], ":")
-			for _, ing := range ingredients {
-				ingredient := Ingredient{
-					OwnerId: familyId,
-				}
+	if !permissions.CanEdit {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
 
-				ingredient.RecipeId.Int64 = recipe.Id
-				ingredient.RecipeId.Valid = true
+	kind := req.FormValue("kind")
 
-				substrings := pattern.FindStringSubmatch(ing)
-				if len(substrings) >= 3 {
-					ingredient.Name = substrings[1]
-					ingredient.Amount.String = substrings[2]
-					ingredient.Amount.Valid = true
-				} else {
-					ingredient.Name = ing
-				}
+	var fileName, pageURL string
+	var data []byte
+	var err error
+	if kind == "page" {
+		fileName, pageURL, data, err = readRecipePage(req, config)
+	} else {
+		fileName, data, err = readImportFile(req)
+	}
+	if err != nil {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
 
-				err = db.Insert(&ingredient)
-				if err != nil {
-					logError(err)
-					http.Error(res, "Server Error", http.StatusInternalServerError)
-					return
-				}
-			}
-		}
+	userId, _ := session.Get("UserId").(int64)
+	preview := req.FormValue("preview") != ""
 
-		addedRecipes = append(addedRecipes, recipe)
+	var recipes []ImportedRecipe
+	var errors []ImportError
+	if kind == "page" {
+		recipes, errors = parseRecipePage(data, pageURL, familyId)
+		fileName = importPageName(fileName, recipes)
+	} else {
+		recipes, errors = parseImport(data, familyId)
+	}
+
+	report, err := saveImport(db, familyId, userId, fileName, recipes, errors, preview)
+	if err != nil {
+		logError(err)
+		http.Error(res, "Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	accountStatus, expired := getAccountStatus(db, session)
@@ -721,11 +905,30 @@ func ImportAndViewRecipesPage(db *gorp.DbMap, params martini.Params, session ses
 		"Date":          time.Now().Format(dateFormat),
 		"User":          user,
 		"FamilyId":      familyId,
+		"Permissions":   permissions,
 		"Families":      getFamilies(db, session),
-		"Recipes":       addedRecipes,
 	}
 
-	view, err := pongo2.FromCache("templates/recipe.html")
+	// Nothing is saved for a preview or a file with errors, so the file is
+	// shown with what would be imported.
+	page := "templates/recipe.html"
+	if report.Import == nil {
+		page = "templates/import.html"
+		context["Report"] = report
+		context["Kind"] = kind
+		context["FileName"] = fileName
+		context["URL"] = pageURL
+		context["Content"] = string(data)
+	} else {
+		addedRecipes := make([]Recipe, len(report.Recipes))
+		for i, imported := range report.Recipes {
+			addedRecipes[i] = imported.Recipe
+		}
+		context["Recipes"] = addedRecipes
+		context["Import"] = report.Import
+	}
+
+	view, err := pongo2.FromCache(page)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
@@ -744,12 +947,14 @@ func ViewRecipePage(db *gorp.DbMap, params martini.Params, session sessions.Sess
 		return
 	}
 
-	familyId, ok := checkFamilyParam(params, session)
+	permissions, ok := getFamilyPermissions(db, params, session)
 	if !ok {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	familyId := permissions.FamilyId
+
 	recipe_id, err := strconv.Atoi(params["recipe_id"])
 	if err != nil {
 		logError(err)
@@ -788,18 +993,41 @@ func ViewRecipePage(db *gorp.DbMap, params martini.Params, session sessions.Sess
 		return
 	}
 
-	available := []Recipe{}
-	_, err = db.Select(&available,
-		"SELECT *"+
-			"FROM recipes "+
-			"WHERE show=1 AND owner_id=?",
-		familyId)
+	details, err := selectRecipeView(db, recipe)
+	if err != nil {
+		logError(err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	available, err := selectRecipes(db, familyId, true)
 	if err != nil {
 		logError(err)
 		http.Error(res, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	// The amounts are also shown for the servings in the query, or else the
+	// family's default.
+	servings := null.Int{}
+	if value := req.URL.Query().Get("servings"); value != "" {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count <= 0 {
+			http.Error(res, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		servings = null.IntFrom(count)
+	} else {
+		result, err := db.Get(Family{}, familyId)
+		if err != nil {
+			logError(err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		} else if result != nil {
+			servings = result.(*Family).DefaultServings
+		}
+	}
+
 	accountStatus, expired := getAccountStatus(db, session)
 
 	context := pongo2.Context{
@@ -808,10 +1036,16 @@ func ViewRecipePage(db *gorp.DbMap, params martini.Params, session sessions.Sess
 		"Date":          time.Now().Format(dateFormat),
 		"User":          user,
 		"FamilyId":      familyId,
+		"Permissions":   permissions,
 		"Families":      getFamilies(db, session),
 		"Recipes":       available,
 		"Recipe":        recipe,
 		"Ingredients":   ingredients,
+		"Steps":         details.Steps,
+		"Tags":          details.Tags,
+		"Servings":      servings,
+		"Scale":         servingsScale(recipe.Servings, servings),
+		"Scaled":        scaleIngredients(recipe, servings, ingredients),
 	}
 
 	view, err := pongo2.FromCache("templates/recipe.html")
@@ -826,7 +1060,7 @@ func ViewRecipePage(db *gorp.DbMap, params martini.Params, session sessions.Sess
 	}
 }
 
-func ViewProfilePage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+func ViewProfilePage(db *gorp.DbMap, config *Config, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
 	user := getUser(db, session)
 	if user == nil {
 		http.Error(res, "Unauthorized", http.StatusUnauthorized)
@@ -841,7 +1075,7 @@ func ViewProfilePage(db *gorp.DbMap, params martini.Params, session sessions.Ses
 		"Date":          time.Now().Format(dateFormat),
 		"User":          user,
 		"Families":      getFamilies(db, session),
-		"ImportId":      time.Now().Unix(),
+		"FetchURLs":     config.Import.FetchURLs,
 	}
 
 	view, err := pongo2.FromCache("templates/profile.html")
@@ -856,28 +1090,51 @@ func ViewProfilePage(db *gorp.DbMap, params martini.Params, session sessions.Ses
 	}
 }
 
-func ViewVerifiedPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
-	user := getUser(db, session)
-	if user == nil {
-		http.Error(res, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+// ViewVerifyEmailPage redeems the token from a verification email. It does
+// not require a session, so the link works on any device.
+func ViewVerifyEmailPage(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
+	token := req.URL.Query().Get("token")
 
-	query := req.URL.Query()
-	token := query.Get("token")
+	status := "invalid"
 
-	if token == user.EmailToken {
+	user := User{}
+	err := db.SelectOne(&user,
+		"SELECT * FROM users WHERE email_token=?", hashToken(token))
+	if token == "" || err != nil {
+		logError(err)
+	} else if time.Now().Unix() > user.EmailTokenExpiresOn || user.EmailTokenAddress != user.Email {
+		status = "expired"
+	} else {
 		user.EmailVerified.SetValid(true)
+		user.EmailToken = ""
+		user.EmailTokenExpiresOn = 0
+		user.EmailTokenAddress = ""
 
-		_, err := db.Update(user)
+		_, err = db.Update(&user)
 		if err != nil {
 			logError(err)
 			http.Error(res, "Server Error", http.StatusInternalServerError)
 			return
 		}
+
+		status = "verified"
+	}
+
+	context := pongo2.Context{
+		"user":   getUser(db, session),
+		"Status": status,
+	}
+
+	view, err := pongo2.FromCache("templates/verify-email.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	ViewProfilePage(db, params, session, req, res)
+	err = view.ExecuteWriter(context, res)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func AdminViewUsers(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, res http.ResponseWriter) {
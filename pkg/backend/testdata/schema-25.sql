@@ -0,0 +1,9 @@
+CREATE TABLE "migrations" ("id" integer not null primary key autoincrement, "version" integer, "time" integer);
+CREATE TABLE "families" ("id" integer not null primary key autoincrement, "user_id" integer, "name" varchar(255), "created_on" varchar(255), "account_status" varchar(255), "status_expires_on" varchar(255));
+CREATE TABLE "familymembers" ("id" integer not null primary key autoincrement, "family_id" integer, "user_id" integer, "can_edit" integer);
+CREATE TABLE "users" ("id" integer not null primary key autoincrement, "username" varchar(255), "password" varchar(255), "email" varchar(255), "name" varchar(255), "admin" varchar(255), "default_family_id" integer, "week_start_day" integer, "email_verified" varchar(255), "email_token" varchar(255));
+CREATE TABLE "recipes" ("id" integer not null primary key autoincrement, "owner_id" integer, "show" integer, "fixed" integer, "name" varchar(255), "source" varchar(255), "servings" varchar(255), "import_id" integer);
+CREATE TABLE "ingredients" ("id" integer not null primary key autoincrement, "owner_id" integer, "recipe_id" varchar(255), "class_id" varchar(255), "name" varchar(255), "amount" varchar(255), "have" varchar(255));
+CREATE TABLE "ingclasses" ("id" integer not null primary key autoincrement, "parent_id" varchar(255), "name" varchar(255));
+CREATE TABLE "assignments" ("id" integer not null primary key autoincrement, "owner_id" integer, "recipe_id" varchar(255), "date" varchar(255), "meal" varchar(255));
+INSERT INTO migrations (version, time) VALUES (25, 0);
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
@@ -13,6 +14,9 @@ import (
 	"gopkg.in/gorp.v2"
 )
 
+// How long an emailed verification link remains valid.
+const EmailVerificationExpiry = 48 * time.Hour
+
 type changePasswordRequest struct {
 	Current  string `json:"current"`
 	Password string `json:"password"`
@@ -62,6 +66,12 @@ func GetUser(db *gorp.DbMap, params martini.Params, session sessions.Session, re
 }
 
 func UpdateUser(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	// The account cannot be changed with an API token.
+	if _, ok := checkCookieSession(session); !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
 	id, err := strconv.ParseInt(params["id"], 0, 64)
 	if err != nil {
 		logError(err)
@@ -109,14 +119,32 @@ func UpdateUser(db *gorp.DbMap, params martini.Params, session sessions.Session,
 		return
 	}
 
+	// A pending verification link is bound to the old address.
 	if newUser.Email != user.Email {
 		user.EmailVerified.SetValid(false)
+		user.EmailToken = ""
+		user.EmailTokenExpiresOn = 0
+		user.EmailTokenAddress = ""
+	}
+
+	// The default family must be one the user belongs to.
+	if newUser.DefaultFamilyId != user.DefaultFamilyId {
+		role, err := selectMemberRole(db, user.Id, newUser.DefaultFamilyId)
+		if err != nil {
+			logError(err)
+			ren.JSON(http.StatusInternalServerError, nil)
+			return
+		} else if role == "" {
+			ren.JSON(http.StatusBadRequest, nil)
+			return
+		}
 	}
 
 	// We only allow updating certain fields.
 	user.Email = newUser.Email
 	user.Name = newUser.Name
 	user.UserName = newUser.Email
+	user.DefaultFamilyId = newUser.DefaultFamilyId
 
 	_, err = db.Update(user)
 	if err != nil {
@@ -125,12 +153,23 @@ func UpdateUser(db *gorp.DbMap, params martini.Params, session sessions.Session,
 		return
 	}
 
+	if user.Id == userId.(int64) {
+		session.Set("FamilyId", user.DefaultFamilyId)
+	}
+
 	ren.JSON(http.StatusOK, user)
 }
 
 func UpdateUserPassword(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
 	response := changePasswordResponse{}
 
+	// The account cannot be changed with an API token.
+	if _, ok := checkCookieSession(session); !ok {
+		response.Message = "Unauthorized"
+		ren.JSON(http.StatusUnauthorized, response)
+		return
+	}
+
 	id, err := strconv.ParseInt(params["id"], 0, 64)
 	if err != nil {
 		logError(err)
@@ -200,7 +239,13 @@ func UpdateUserPassword(db *gorp.DbMap, params martini.Params, session sessions.
 	ren.JSON(http.StatusOK, response)
 }
 
-func SendEmailVerification(db *gorp.DbMap, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+func SendEmailVerification(db *gorp.DbMap, config *Config, mailer Mailer, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	// The account cannot be changed with an API token.
+	if _, ok := checkCookieSession(session); !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
 	id, err := strconv.ParseInt(params["id"], 0, 64)
 	if err != nil {
 		logError(err)
@@ -233,7 +278,31 @@ func SendEmailVerification(db *gorp.DbMap, params martini.Params, session sessio
 		return
 	}
 
-	url := fmt.Sprintf("https://example.com/user/%d/verify.html?token=%s", user.Id, user.EmailToken)
+	err = sendEmailVerification(db, config, mailer, user)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	ren.JSON(http.StatusOK, user)
+}
+
+// sendEmailVerification generates a fresh verification token for the user's
+// current address, replacing any earlier one, and emails the link.
+func sendEmailVerification(db gorp.SqlExecutor, config *Config, mailer Mailer, user *User) error {
+	token := newToken()
+
+	user.EmailToken = hashToken(token)
+	user.EmailTokenExpiresOn = time.Now().Add(EmailVerificationExpiry).Unix()
+	user.EmailTokenAddress = user.Email
+
+	_, err := db.Update(user)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/verify-email.html?token=%s", config.Server.BaseURL, token)
 
 	htmlBody := fmt.Sprintf(
 		"<h1>Meal Planner</h1>"+
@@ -245,11 +314,10 @@ func SendEmailVerification(db *gorp.DbMap, params martini.Params, session sessio
 		"Please verify your email address by opening the link below in a web browser.\r\n" +
 		url + "\r\n"
 
-	err = SendEmail(user.Email, "Meal Planner - Email Verification", htmlBody, textBody)
-	if err != nil {
-		ren.JSON(http.StatusInternalServerError, nil)
-		return
-	}
-
-	ren.JSON(http.StatusOK, user)
+	return mailer.Send(&Email{
+		Recipient: user.Email,
+		Subject:   "Meal Planner - Email Verification",
+		HtmlBody:  htmlBody,
+		TextBody:  textBody,
+	})
 }
@@ -0,0 +1,692 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	"golang.org/x/net/html"
+	"gopkg.in/gorp.v2"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Recipes are also imported from web pages, saved or fetched, that describe
+// them with schema.org JSON-LD or microdata, as most cooking websites do.
+// JSON-LD is preferred when a page has both.
+
+// How long fetching a recipe page may take, and how many redirects it may
+// follow.
+const (
+	fetchTimeout   = 15 * time.Second
+	fetchRedirects = 10
+)
+
+// Addresses that recipe pages are not fetched from: this host, private
+// networks, link-local addresses like cloud metadata services, and other
+// ranges that are not on the public internet.
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+var (
+	markupPattern = regexp.MustCompile(`<[^>]*>`)
+	numberPattern = regexp.MustCompile(`\d+`)
+)
+
+// Elements that have no end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// The attribute that holds the value of a microdata property on elements
+// other than plain text.
+var propertyAttributes = map[string]string{
+	"a": "href", "area": "href", "link": "href",
+	"audio": "src", "embed": "src", "iframe": "src", "img": "src",
+	"source": "src", "track": "src", "video": "src",
+	"object": "data", "time": "datetime", "data": "value", "meter": "value",
+}
+
+// pageRecipe is a recipe as it is described on the page.
+type pageRecipe struct {
+	Name        string
+	URL         string
+	Yields      []string
+	Ingredients []string
+}
+
+// microItem is an element with itemscope and the properties in it.
+type microItem struct {
+	Types []string
+	Props map[string][]string
+}
+
+// pageElement is an element that has not been closed yet.
+type pageElement struct {
+	Tag   string
+	Item  *microItem
+	Owner *microItem
+	Props []string
+	Text  *strings.Builder
+}
+
+// recipePage is what was found on a page.
+type recipePage struct {
+	JSONLD []string
+	Items  []*microItem
+	URL    string
+}
+
+// scanPage reads the JSON-LD blocks, the microdata items and the canonical
+// URL of a page. The tokenizer deals with comments and scripts, and tags that
+// are not closed are closed with the element they are in.
+func scanPage(text string) *recipePage {
+	page := &recipePage{}
+	stack := []*pageElement{}
+	items := []*microItem{}
+
+	addText := func(s string) {
+		for _, element := range stack {
+			if element.Text != nil {
+				element.Text.WriteString(s)
+			}
+		}
+	}
+
+	// Closing an element closes the ones in it too.
+	closeElements := func(i int) {
+		for j := len(stack) - 1; j >= i; j-- {
+			element := stack[j]
+			if element.Text != nil {
+				value := cleanText(element.Text.String())
+				for _, prop := range element.Props {
+					element.Owner.Props[prop] = append(element.Owner.Props[prop], value)
+				}
+			}
+			if element.Item != nil {
+				items = items[:len(items)-1]
+			}
+		}
+		stack = stack[:i]
+	}
+
+	closeElement := func(tag string) {
+		i := len(stack) - 1
+		for i >= 0 && stack[i].Tag != tag {
+			i--
+		}
+		if i >= 0 {
+			closeElements(i)
+		}
+	}
+
+	// The content of scripts and styles is not text. The tokenizer returns
+	// it in one piece up to the end tag, and only JSON-LD is kept.
+	inScript := false
+	jsonLD := false
+
+	tokenizer := html.NewTokenizer(strings.NewReader(text))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		if inScript {
+			if tokenType == html.TextToken && jsonLD {
+				page.JSONLD = append(page.JSONLD, string(tokenizer.Raw()))
+			} else if tokenType == html.EndTagToken {
+				inScript = false
+			}
+			continue
+		}
+
+		if tokenType == html.TextToken {
+			addText(string(tokenizer.Raw()))
+			continue
+		} else if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken &&
+			tokenType != html.EndTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		tag := token.Data
+
+		// Words in separate elements are separate words.
+		addText(" ")
+
+		if tokenType == html.EndTagToken {
+			closeElement(tag)
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for _, attr := range token.Attr {
+			if _, ok := attrs[attr.Key]; !ok {
+				attrs[attr.Key] = attr.Val
+			}
+		}
+		void := tokenType == html.SelfClosingTagToken || voidElements[tag]
+
+		if tag == "script" || tag == "style" {
+			inScript = true
+			jsonLD = tag == "script" && strings.ToLower(strings.TrimSpace(attrs["type"])) == "application/ld+json"
+			continue
+		}
+
+		// The end tags of list items and paragraphs may be left out.
+		if (tag == "li" || tag == "p") && len(stack) > 0 && stack[len(stack)-1].Tag == tag {
+			closeElement(tag)
+		}
+
+		rel := strings.Fields(strings.ToLower(attrs["rel"]))
+		if tag == "link" && len(rel) > 0 && rel[0] == "canonical" {
+			page.URL = attrs["href"]
+		} else if tag == "meta" && attrs["property"] == "og:url" && page.URL == "" {
+			page.URL = attrs["content"]
+		}
+
+		element := &pageElement{Tag: tag}
+
+		var owner *microItem
+		if len(items) > 0 {
+			owner = items[len(items)-1]
+		}
+
+		_, scoped := attrs["itemscope"]
+		if scoped {
+			element.Item = &microItem{
+				Types: strings.Fields(attrs["itemtype"]),
+				Props: make(map[string][]string),
+			}
+			page.Items = append(page.Items, element.Item)
+		}
+
+		// A property that is an item itself is not needed for recipes.
+		props := strings.Fields(attrs["itemprop"])
+		if len(props) > 0 && owner != nil && !scoped {
+			for i, prop := range props {
+				props[i] = prop[strings.LastIndex(prop, "/")+1:]
+			}
+
+			value, ok := attrs["content"]
+			if !ok {
+				value, ok = attrs[propertyAttributes[tag]]
+			}
+
+			if ok {
+				for _, prop := range props {
+					owner.Props[prop] = append(owner.Props[prop], strings.TrimSpace(value))
+				}
+			} else if !void {
+				element.Owner = owner
+				element.Props = props
+				element.Text = &strings.Builder{}
+			}
+		}
+
+		if void {
+			continue
+		}
+
+		stack = append(stack, element)
+		if element.Item != nil {
+			items = append(items, element.Item)
+		}
+	}
+
+	closeElements(0)
+
+	return page
+}
+
+// cleanText removes markup and entities, and collapses white space.
+func cleanText(text string) string {
+	text = html.UnescapeString(markupPattern.ReplaceAllString(text, " "))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+func isRecipeType(name string) bool {
+	return name == "Recipe" || strings.HasSuffix(name, "/Recipe") || strings.HasSuffix(name, ":Recipe")
+}
+
+// jsonTexts returns the texts of a JSON-LD value, which may be a list.
+func jsonTexts(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		if text := cleanText(value); text != "" {
+			return []string{text}
+		}
+	case float64:
+		return []string{strconv.FormatFloat(value, 'f', -1, 64)}
+	case []interface{}:
+		texts := []string{}
+		for _, v := range value {
+			texts = append(texts, jsonTexts(v)...)
+		}
+		return texts
+	case map[string]interface{}:
+		if v, ok := value["@value"]; ok {
+			return jsonTexts(v)
+		}
+	}
+	return nil
+}
+
+func jsonText(value interface{}) string {
+	texts := jsonTexts(value)
+	if len(texts) == 0 {
+		return ""
+	}
+	return texts[0]
+}
+
+// jsonURL returns a URL, which may also be given as a node with an @id.
+func jsonURL(value interface{}) string {
+	if node, ok := value.(map[string]interface{}); ok {
+		if id := jsonText(node["@id"]); id != "" {
+			return id
+		}
+		return jsonText(node["url"])
+	}
+	return jsonText(value)
+}
+
+// findJSONLDRecipes collects the Recipe nodes anywhere in a JSON-LD value,
+// such as in an @graph or as the mainEntity of a page.
+func findJSONLDRecipes(value interface{}, recipes []pageRecipe) []pageRecipe {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			recipes = findJSONLDRecipes(v, recipes)
+		}
+	case map[string]interface{}:
+		isRecipe := false
+		for _, name := range jsonTexts(value["@type"]) {
+			isRecipe = isRecipe || isRecipeType(name)
+		}
+
+		if !isRecipe {
+			for _, v := range value {
+				recipes = findJSONLDRecipes(v, recipes)
+			}
+			return recipes
+		}
+
+		recipe := pageRecipe{
+			Name:   jsonText(value["name"]),
+			URL:    jsonURL(value["url"]),
+			Yields: jsonTexts(value["recipeYield"]),
+		}
+		if recipe.URL == "" {
+			recipe.URL = jsonURL(value["mainEntityOfPage"])
+		}
+
+		// ingredients is the older name of recipeIngredient.
+		ingredients, ok := value["recipeIngredient"]
+		if !ok {
+			ingredients = value["ingredients"]
+		}
+		if text, ok := ingredients.(string); ok {
+			lines := []interface{}{}
+			for _, line := range strings.Split(text, "\n") {
+				lines = append(lines, line)
+			}
+			ingredients = lines
+		}
+		recipe.Ingredients = jsonTexts(ingredients)
+
+		recipes = append(recipes, recipe)
+	}
+	return recipes
+}
+
+// microdataRecipe reads a Recipe item, or returns false for other items.
+func microdataRecipe(item *microItem) (pageRecipe, bool) {
+	isRecipe := false
+	for _, name := range item.Types {
+		isRecipe = isRecipe || isRecipeType(name)
+	}
+	if !isRecipe {
+		return pageRecipe{}, false
+	}
+
+	recipe := pageRecipe{
+		Yields:      item.Props["recipeYield"],
+		Ingredients: append(item.Props["recipeIngredient"], item.Props["ingredients"]...),
+	}
+	if names := item.Props["name"]; len(names) > 0 {
+		recipe.Name = names[0]
+	}
+	if urls := item.Props["url"]; len(urls) > 0 {
+		recipe.URL = urls[0]
+	}
+	return recipe, true
+}
+
+// splitIngredientLine splits a line like "2 cups flour, sifted" into the
+// name and the amount, which is the shortest start of the line that has the
+// same quantity as the whole line.
+func splitIngredientLine(line string) (string, string) {
+	full := ParseQuantity(line)
+	if !full.Value.Valid {
+		return line, ""
+	}
+
+	words := strings.Fields(line)
+	for i := 1; i < len(words); i++ {
+		if ParseQuantity(strings.Join(words[:i], " ")) != full {
+			continue
+		}
+
+		// As in "a pinch of salt".
+		rest := words[i:]
+		for len(rest) > 1 && (rest[0] == "of" || rest[0] == "a" || rest[0] == "an") {
+			rest = rest[1:]
+		}
+		return strings.Join(rest, " "), strings.Join(words[:i], " ")
+	}
+
+	return line, ""
+}
+
+// resolveURL makes a URL on the page absolute, or returns an empty string
+// if it cannot.
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || ref == "" {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// parsePageRecipe makes the recipe and its ingredients from what the page
+// says about it.
+func parsePageRecipe(recipe pageRecipe, base *url.URL, pageURL string, familyId int64) (ImportedRecipe, error) {
+	imported := ImportedRecipe{
+		Recipe: Recipe{
+			OwnerId: familyId,
+			Show:    true,
+			Name:    cleanText(recipe.Name),
+		},
+		Ingredients: []Ingredient{},
+	}
+
+	if imported.Recipe.Name == "" {
+		return imported, fmt.Errorf("the recipe has no name")
+	}
+
+	source := resolveURL(base, recipe.URL)
+	if source == "" {
+		source = pageURL
+	}
+	if source != "" {
+		imported.Recipe.Source = null.StringFrom(source)
+	}
+
+	// Yields like "4 servings" or "Serves 4-6" count as the first number.
+	for _, yield := range recipe.Yields {
+		servings, err := strconv.ParseInt(numberPattern.FindString(yield), 10, 64)
+		if err == nil && servings > 0 {
+			imported.Recipe.Servings = null.IntFrom(servings)
+			break
+		}
+	}
+
+	for _, line := range recipe.Ingredients {
+		line = cleanText(line)
+		if line == "" {
+			continue
+		}
+
+		name, amount := splitIngredientLine(line)
+		ingredient := Ingredient{
+			OwnerId: familyId,
+			Name:    name,
+		}
+		if amount != "" {
+			ingredient.Amount = null.StringFrom(amount)
+		}
+		imported.Ingredients = append(imported.Ingredients, ingredient)
+	}
+
+	return imported, nil
+}
+
+// parseRecipePage reads the recipes on a page. The page URL, if it is known,
+// is the source of recipes that do not name one.
+func parseRecipePage(data []byte, pageURL string, familyId int64) ([]ImportedRecipe, []ImportError) {
+	recipes := []ImportedRecipe{}
+	errors := []ImportError{}
+
+	page := scanPage(string(data))
+
+	base, err := url.Parse(pageURL)
+	if err != nil || pageURL == "" {
+		base = nil
+	}
+
+	// The canonical URL is better than the one the page was saved from.
+	if canonical := resolveURL(base, page.URL); canonical != "" {
+		pageURL = canonical
+		base, _ = url.Parse(canonical)
+	} else {
+		pageURL = resolveURL(nil, pageURL)
+	}
+
+	found := []pageRecipe{}
+	for _, block := range page.JSONLD {
+		var value interface{}
+		err := json.Unmarshal([]byte(strings.TrimSpace(block)), &value)
+		if err != nil {
+			continue
+		}
+		found = findJSONLDRecipes(value, found)
+	}
+
+	if len(found) == 0 {
+		for _, item := range page.Items {
+			if recipe, ok := microdataRecipe(item); ok {
+				found = append(found, recipe)
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return recipes, append(errors, ImportError{Row: 0, Message: "the page has no schema.org recipe"})
+	}
+
+	for i, recipe := range found {
+		imported, err := parsePageRecipe(recipe, base, pageURL, familyId)
+		if err != nil {
+			errors = append(errors, ImportError{Row: i + 1, Message: err.Error()})
+			continue
+		}
+
+		imported.Row = i + 1
+		recipes = append(recipes, imported)
+	}
+
+	return recipes, errors
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublicAddress refuses connections to addresses that are not public.
+// The dialer calls it with the address that the host name resolved to, so a
+// name cannot point the server at its own network.
+func checkPublicAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// newFetchClient returns a client that only connects to public addresses,
+// including on redirects, and does not go through a proxy, which would hide
+// the address it connects to.
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: fetchTimeout,
+		Control: checkPublicAddress,
+	}
+
+	return &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: fetchTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchRedirects {
+				return fmt.Errorf("too many redirects")
+			} else if resolveURL(nil, req.URL.String()) == "" {
+				return fmt.Errorf("%q is not an http or https URL", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// fetchRecipePage downloads a page and returns the URL it ended up at.
+func fetchRecipePage(pageURL string) (string, []byte, error) {
+	if resolveURL(nil, pageURL) == "" {
+		return "", nil, fmt.Errorf("%q is not an http or https URL", pageURL)
+	}
+
+	res, err := newFetchClient().Get(pageURL)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%s: %s", pageURL, res.Status)
+	}
+
+	data, err := readImportData(res.Body)
+	return res.Request.URL.String(), data, err
+}
+
+// readRecipePage returns the name, the URL and the content of the page, which
+// is sent as the request body, uploaded like a CSV file, or fetched by its
+// url if the configuration allows it. An uploaded page can give its url too.
+func readRecipePage(req *http.Request, config *Config) (string, string, []byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		data, err := readImportData(req.Body)
+		return "", req.URL.Query().Get("url"), data, err
+	}
+
+	err := req.ParseMultipartForm(maxImportSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return "", "", nil, err
+	}
+
+	pageURL := strings.TrimSpace(req.FormValue("url"))
+
+	uploaded := req.MultipartForm != nil && len(req.MultipartForm.File["file"]) > 0
+	if pageURL != "" && req.FormValue("content") == "" && !uploaded {
+		if !config.Import.FetchURLs {
+			return "", "", nil, fmt.Errorf("fetching recipe pages is disabled")
+		}
+
+		fetchedURL, data, err := fetchRecipePage(pageURL)
+		return fetchedURL, fetchedURL, data, err
+	}
+
+	fileName, data, err := readImportFile(req)
+	return fileName, pageURL, data, err
+}
+
+// importPageName names an import of a page by its file or by its source.
+func importPageName(fileName string, recipes []ImportedRecipe) string {
+	if fileName == "" && len(recipes) > 0 {
+		return recipes[0].Recipe.Source.String
+	}
+	return fileName
+}
+
+// ImportWebRecipes imports the recipes on a web page, like ImportRecipes
+// does for CSV files.
+func ImportWebRecipes(db *gorp.DbMap, config *Config, params martini.Params, session sessions.Session, req *http.Request, ren render.Render) {
+	familyId, ok := checkFamilyParam(params, session)
+	if !ok {
+		ren.JSON(http.StatusUnauthorized, nil)
+		return
+	}
+
+	userId, _ := session.Get("UserId").(int64)
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run"))
+
+	fileName, pageURL, data, err := readRecipePage(req, config)
+	if err != nil {
+		ren.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	recipes, errors := parseRecipePage(data, pageURL, familyId)
+
+	report, err := saveImport(db, familyId, userId, importPageName(fileName, recipes), recipes, errors, dryRun)
+	if err != nil {
+		logError(err)
+		ren.JSON(http.StatusInternalServerError, nil)
+		return
+	} else if len(report.Errors) > 0 {
+		ren.JSON(http.StatusBadRequest, report)
+		return
+	}
+
+	ren.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,213 @@
+package backend
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const jsonLDPage = `<!DOCTYPE html>
+<html>
+<head>
+<link rel="canonical" href="/recipes/soup">
+<script type="application/ld+json">
+{
+  "@context": "https://schema.org",
+  "@graph": [
+    {"@type": "WebSite", "name": "Cooking"},
+    {
+      "@type": ["Recipe", "NewsArticle"],
+      "name": "Onion &amp; Potato Soup",
+      "recipeYield": ["4", "4 servings"],
+      "recipeIngredient": [
+        "2 large onions",
+        "500 g potatoes",
+        "a pinch of salt",
+        "water"
+      ]
+    }
+  ]
+}
+</script>
+</head>
+<body></body>
+</html>`
+
+const microdataPage = `<html><body>
+<div itemscope itemtype="http://schema.org/Recipe">
+  <h1 itemprop="name">Pancakes</h1>
+  <link itemprop="url" href="https://example.org/pancakes">
+  <span itemprop="recipeYield">Serves 2-3</span>
+  <ul>
+    <li itemprop="recipeIngredient">1 1/2 cups flour</li>
+    <li itemprop="ingredients">2 eggs</li>
+  </ul>
+</div>
+</body></html>`
+
+// A page with the things a careless scanner trips over: a comment with
+// markup in it, a script that compares with <, and items in the recipe.
+const trickyPage = `<html><head>
+<script>
+if (width < 600 && height<400) { document.write("<div itemscope itemtype='https://schema.org/Recipe'>"); }
+</script>
+</head><body>
+<!-- <span itemprop="name">Old Name</span> -->
+<article itemscope itemtype="https://schema.org/Recipe">
+  <h1 itemprop="name">Lentil Stew</h1>
+  <div itemprop="author" itemscope itemtype="https://schema.org/Person">
+    <span itemprop="name">Sam</span>
+    <a itemprop="url" href="https://example.org/sam">Sam's page</a>
+  </div>
+  <p>Serves <span itemprop="recipeYield">3</span></p>
+  <ul>
+    <li itemprop="recipeIngredient">200 g lentils<!-- red or green --></li>
+    <li itemprop="recipeIngredient">1 onion
+  </ul>
+  <div itemprop="nutrition" itemscope itemtype="https://schema.org/NutritionInformation">
+    <span itemprop="calories">300 calories</span>
+  </div>
+  <link itemprop="url" href="https://example.org/stew">
+</article>
+</body></html>`
+
+func TestParseRecipePage(t *testing.T) {
+	type ingredient struct {
+		name   string
+		amount string
+	}
+
+	tests := []struct {
+		about       string
+		page        string
+		url         string
+		name        string
+		source      string
+		servings    int64
+		ingredients []ingredient
+	}{
+		{
+			"JSON-LD in a graph with the canonical URL",
+			jsonLDPage,
+			"https://example.com/print?id=1",
+			"Onion & Potato Soup",
+			"https://example.com/recipes/soup",
+			4,
+			[]ingredient{
+				{"large onions", "2"},
+				{"potatoes", "500 g"},
+				{"salt", "a pinch"},
+				{"water", ""},
+			},
+		},
+		{
+			"microdata with its own URL",
+			microdataPage,
+			"",
+			"Pancakes",
+			"https://example.org/pancakes",
+			2,
+			[]ingredient{
+				{"flour", "1 1/2 cups"},
+				{"eggs", "2"},
+			},
+		},
+		{
+			"microdata with comments, scripts and nested items",
+			trickyPage,
+			"https://example.org/print/stew",
+			"Lentil Stew",
+			"https://example.org/stew",
+			3,
+			[]ingredient{
+				{"lentils", "200 g"},
+				{"onion", "1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		recipes, errors := parseRecipePage([]byte(test.page), test.url, 5)
+		if len(errors) != 0 || len(recipes) != 1 {
+			t.Errorf("%s: got %d recipes and the errors %v, want one recipe", test.about, len(recipes), errors)
+			continue
+		}
+
+		recipe := recipes[0].Recipe
+		if recipe.Name != test.name || recipe.Source.String != test.source ||
+			recipe.Servings.Int64 != test.servings || recipe.OwnerId != 5 {
+			t.Errorf("%s: got %q from %q for %d in family %d, want %q from %q for %d in family 5",
+				test.about, recipe.Name, recipe.Source.String, recipe.Servings.Int64, recipe.OwnerId,
+				test.name, test.source, test.servings)
+		}
+
+		got := []ingredient{}
+		for _, i := range recipes[0].Ingredients {
+			got = append(got, ingredient{i.Name, i.Amount.String})
+		}
+		if len(got) != len(test.ingredients) {
+			t.Errorf("%s: ingredients %q, want %q", test.about, got, test.ingredients)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.ingredients[i] {
+				t.Errorf("%s: ingredients %q, want %q", test.about, got, test.ingredients)
+				break
+			}
+		}
+	}
+}
+
+func TestParseRecipePageWithoutRecipe(t *testing.T) {
+	page := `<html><script type="application/ld+json">{"@type": "WebSite"</script></html>`
+
+	recipes, errors := parseRecipePage([]byte(page), "https://example.com/", 1)
+	if len(recipes) != 0 || len(errors) != 1 || errors[0].Row != 0 {
+		t.Errorf("got %d recipes and the errors %v, want an error for the page", len(recipes), errors)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::248", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+
+	for _, test := range tests {
+		if got := isPublicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestFetchRecipePageRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonLDPage))
+	}))
+	defer server.Close()
+
+	_, _, err := fetchRecipePage(server.URL)
+	if err == nil {
+		t.Errorf("fetched %s, which is not a public address", server.URL)
+	}
+
+	_, _, err = fetchRecipePage("file:///etc/passwd")
+	if err == nil {
+		t.Error("fetched a file URL")
+	}
+}
@@ -3,7 +3,8 @@ function signIn(ev) {
 
   var data = {
     email: $("#email").val(),
-    password: $("#password").val()
+    password: $("#password").val(),
+    invitation: $("#invitation").val()
   };
 
   $.ajax({
@@ -11,7 +12,7 @@ function signIn(ev) {
     url: "/api/login",
     data: data
   }).then(function(response) {
-    var family_id = response.families[0];
+    var family_id = response.family_id || response.families[0];
     window.location = "/family/" + family_id + "/view.html";
   }).fail(function(xhr) {
     var response = JSON.parse(xhr.responseText);
@@ -31,13 +32,25 @@ function signOut(ev) {
   });
 }
 
+function signOutEverywhere(ev) {
+  ev.preventDefault();
+
+  $.ajax({
+    type: "POST",
+    url: "/api/logout-all",
+  }).then(function(response) {
+    window.location = "/";
+  });
+}
+
 function signUp(ev) {
   ev.preventDefault();
 
   var data = {
     username: $("#register-name").val(),
     email: $("#register-email").val(),
-    password: $("#register-password").val()
+    password: $("#register-password").val(),
+    invitation: $("#invitation").val()
   };
 
   if ($("#register-retype").val() !== data.password) {
@@ -51,7 +64,7 @@ function signUp(ev) {
     url: "/api/register",
     data: data
   }).then(function(response) {
-    var family_id = response.families[0];
+    var family_id = response.family_id || response.families[0];
     window.location = "/family/" + family_id + "/view.html";
   }).fail(function(xhr) {
     var response = JSON.parse(xhr.responseText);
@@ -59,3 +72,94 @@ function signUp(ev) {
     $("#register-alert").removeAttr("hidden");
   });
 }
+
+function requestPasswordReset(ev) {
+  ev.preventDefault();
+
+  var data = {
+    email: $("#reset-email").val()
+  };
+
+  $.ajax({
+    type: "POST",
+    url: "/api/password-reset",
+    data: data
+  }).then(function(response) {
+    $("#reset-alert").text(response.message);
+    $("#reset-alert").removeAttr("hidden");
+  }).fail(function(xhr) {
+    var response = JSON.parse(xhr.responseText);
+    $("#reset-alert").text(response.message);
+    $("#reset-alert").removeAttr("hidden");
+  });
+}
+
+function resetPassword(ev) {
+  ev.preventDefault();
+
+  var data = {
+    token: $("#reset-token").val(),
+    password: $("#reset-password-new").val()
+  };
+
+  if ($("#reset-retype").val() !== data.password) {
+    $("#reset-alert").text("The passwords do not match.");
+    $("#reset-alert").removeAttr("hidden");
+    return;
+  }
+
+  $.ajax({
+    type: "POST",
+    url: "/api/password-reset/confirm",
+    data: data
+  }).then(function(response) {
+    $("#reset-password")[0].reset();
+    $("#reset-alert").text(response.message);
+    $("#reset-alert").removeAttr("hidden");
+  }).fail(function(xhr) {
+    var response = JSON.parse(xhr.responseText);
+    $("#reset-alert").text(response.message);
+    $("#reset-alert").removeAttr("hidden");
+  });
+}
+
+function acceptInvitation(ev) {
+  ev.preventDefault();
+
+  var data = {
+    token: $("#invitation").val()
+  };
+
+  $.ajax({
+    type: "POST",
+    url: "/api/invitations/accept",
+    data: data
+  }).then(function(response) {
+    window.location = "/family/" + response.family_id + "/view.html";
+  }).fail(function(xhr) {
+    var response = JSON.parse(xhr.responseText);
+    $("#invitation-alert").text(response.message);
+    $("#invitation-alert").removeAttr("hidden");
+  });
+}
+
+function declineInvitation(ev) {
+  ev.preventDefault();
+
+  var data = {
+    token: $("#invitation").val()
+  };
+
+  $.ajax({
+    type: "POST",
+    url: "/api/invitations/decline",
+    data: data
+  }).then(function(response) {
+    $("#invitation-alert").text(response.message);
+    $("#invitation-alert").removeAttr("hidden");
+  }).fail(function(xhr) {
+    var response = JSON.parse(xhr.responseText);
+    $("#invitation-alert").text(response.message);
+    $("#invitation-alert").removeAttr("hidden");
+  });
+}